@@ -0,0 +1,298 @@
+package main
+
+// HTTP API to query status of watcher and control updates
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	log "github.com/google/logger"
+)
+
+const (
+	unixSocketPrefix = "unix://"
+	bearerPrefix     = "Bearer "
+	apiReadTimeout   = 10 * time.Second
+)
+
+// APIServer serve status and control endpoints of watchers, ?name= selects a node container
+type APIServer struct {
+	watchers []*NodeWatcher
+	token    string // bearer token, empty to allow anyone reaching the listener
+}
+
+// NodesReport response of GET /status
+type NodesReport struct {
+	Nodes []StatusReport `json:"nodes"`
+}
+
+// StatusReport status of a watcher
+type StatusReport struct {
+	Name          string           `json:"name"`
+	Container     *ContainerStatus `json:"container"`
+	LastPoll      *time.Time       `json:"last_poll,omitempty"`
+	LastPollError string           `json:"last_poll_error,omitempty"`
+	LastUpdate    *UpdateRecord    `json:"last_update,omitempty"`
+	Pinned        *ImageUpdate     `json:"pinned,omitempty"`
+	Pending       *PendingUpdate   `json:"pending,omitempty"`
+	Awaiting      string           `json:"awaiting_approval,omitempty"` // tag of a new major version
+	DBReset       string           `json:"db_reset,omitempty"`          // db reset mode requested for the next update
+	Health        []ProbeResult    `json:"health,omitempty"`            // probes of the last update
+	Liveness      []ProbeResult    `json:"liveness,omitempty"`          // probes of the last liveness check
+}
+
+// ContainerStatus node container and its image
+type ContainerStatus struct {
+	Name    string `json:"name"`
+	ID      string `json:"id"`
+	State   string `json:"state"`
+	Image   string `json:"image"`
+	ImageID string `json:"image_id"`
+	Digest  string `json:"digest"`
+}
+
+type apiMessage struct {
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// NewAPIServer create API server of the watchers
+func NewAPIServer(watchers []*NodeWatcher, token string) *APIServer {
+	return &APIServer{watchers: watchers, token: token}
+}
+
+// Handler return the handler serving all endpoints, /metrics is open to scrapers without the token
+func (s *APIServer) Handler() http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("/status", s.method(http.MethodGet, s.handleStatus))
+	api.HandleFunc("/history", s.method(http.MethodGet, s.handleHistory))
+	api.HandleFunc("/update", s.method(http.MethodPost, s.handleUpdate))
+	api.HandleFunc("/rollback", s.method(http.MethodPost, s.handleRollback))
+	api.HandleFunc("/approve", s.method(http.MethodPost, s.handleApprove))
+	mux := http.NewServeMux()
+	mux.Handle("/", s.authorize(api))
+	mux.Handle("/metrics", s.method(http.MethodGet, metricsHandler(s.watchers).ServeHTTP))
+	return mux
+}
+
+// ListenAndServe serve API on a TCP address or on unix:///path/to/socket
+func (s *APIServer) ListenAndServe(listen string) error {
+	var listener net.Listener
+	var err error
+	if strings.HasPrefix(listen, unixSocketPrefix) {
+		path := strings.TrimPrefix(listen, unixSocketPrefix)
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path) // socket left by previous run, any other file is kept and fails listen
+		}
+		listener, err = net.Listen("unix", path)
+		if err == nil {
+			err = os.Chmod(path, 0660)
+		}
+	} else {
+		listener, err = net.Listen("tcp", listen)
+	}
+	if err != nil {
+		return ErrCombind(ErrorAPIListen, err)
+	}
+	log.Info("API server listens on ", listen)
+	server := &http.Server{Handler: s.Handler(), ReadTimeout: apiReadTimeout}
+	return server.Serve(listener)
+}
+
+func (s *APIServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.token) > 0 {
+			header := r.Header.Get("Authorization")
+			given := strings.TrimPrefix(header, bearerPrefix)
+			if !strings.HasPrefix(header, bearerPrefix) || subtle.ConstantTimeCompare([]byte(given), []byte(s.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="bitmark-node-watcher"`)
+				writeJSON(w, http.StatusUnauthorized, apiMessage{Error: ErrorAPIUnauthorized.Error()})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *APIServer) method(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, apiMessage{Error: "method not allowed"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// selected return watchers chosen by name query, all watchers without it, nil after writing error
+func (s *APIServer) selected(w http.ResponseWriter, r *http.Request) []*NodeWatcher {
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 {
+		return s.watchers
+	}
+	for _, watcher := range s.watchers {
+		if watcher.ContainerName == name {
+			return []*NodeWatcher{watcher}
+		}
+	}
+	writeJSON(w, http.StatusNotFound, apiMessage{Error: "no watched container named " + name})
+	return nil
+}
+
+func (s *APIServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	watchers := s.selected(w, r)
+	if watchers == nil {
+		return
+	}
+	report := NodesReport{Nodes: []StatusReport{}}
+	for _, watcher := range watchers {
+		report.Nodes = append(report.Nodes, watcher.Status())
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleHistory return update records of selected containers, oldest first
+func (s *APIServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	watchers := s.selected(w, r)
+	if watchers == nil {
+		return
+	}
+	history := []UpdateRecord{}
+	for _, watcher := range watchers {
+		history = append(history, watcher.status.updates()...)
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].StartedAt.Before(history[j].StartedAt)
+	})
+	writeJSON(w, http.StatusOK, history)
+}
+
+// handleUpdate request an image check, query db_reset sets db reset mode of the next update,
+// it is kept until an update runs
+func (s *APIServer) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	watchers := s.selected(w, r)
+	if watchers == nil {
+		return
+	}
+	dbReset := r.URL.Query().Get("db_reset")
+	if len(dbReset) > 0 && !validDBReset(dbReset) {
+		writeJSON(w, http.StatusBadRequest, apiMessage{Error: "db_reset must be one of " + dbResetAlways + ", " + dbResetNever + ", " + dbResetLabel})
+		return
+	}
+	for _, watcher := range watchers {
+		if len(dbReset) > 0 {
+			watcher.status.requestDBReset(dbReset)
+		}
+		watcher.status.requestCheck(triggerAPI) // a waiting request covers this one
+	}
+	message := "update check requested"
+	if len(dbReset) > 0 {
+		message += ", db reset " + dbReset + " is kept for the next update"
+	}
+	writeJSON(w, http.StatusAccepted, apiMessage{Message: message})
+}
+
+func (s *APIServer) handleRollback(w http.ResponseWriter, r *http.Request) {
+	watchers := s.selected(w, r)
+	if watchers == nil {
+		return
+	}
+	if len(watchers) != 1 {
+		writeJSON(w, http.StatusBadRequest, apiMessage{Error: "name of the container to rollback is required"})
+		return
+	}
+	err := watchers[0].rollbackToPrevious(triggerAPI)
+	switch {
+	case err == ErrorNoPreviousContainer:
+		writeJSON(w, http.StatusConflict, apiMessage{Error: err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, apiMessage{Error: err.Error()})
+	default:
+		writeJSON(w, http.StatusOK, apiMessage{Message: "rolled back to previous container"})
+	}
+}
+
+// handleApprove approve major version of query major, or the major version awaiting approval without it
+func (s *APIServer) handleApprove(w http.ResponseWriter, r *http.Request) {
+	watchers := s.selected(w, r)
+	if watchers == nil {
+		return
+	}
+	var major *uint64
+	if value := r.URL.Query().Get("major"); len(value) > 0 {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiMessage{Error: "major must be a version number"})
+			return
+		}
+		major = &parsed
+	}
+	approved := 0
+	for _, watcher := range watchers {
+		if major != nil {
+			watcher.ApproveMajor(*major)
+			approved++
+			continue
+		}
+		if version, err := semver.NewVersion(watcher.status.awaitingApproval()); err == nil {
+			watcher.ApproveMajor(version.Major())
+			approved++
+		}
+	}
+	if approved == 0 {
+		writeJSON(w, http.StatusConflict, apiMessage{Error: "no major version is awaiting approval"})
+		return
+	}
+	writeJSON(w, http.StatusOK, apiMessage{Message: "major version approved, update check requested"})
+}
+
+// Status collect status of node container and monitor loop
+func (w *NodeWatcher) Status() StatusReport {
+	report := StatusReport{Name: w.ContainerName, Pinned: w.pinnedImage(), Pending: w.status.pendingUpdate(),
+		Awaiting: w.status.awaitingApproval(), DBReset: w.status.requestedDBReset(), Health: w.ProbeResults(),
+		Liveness: w.LivenessResults()}
+	if lastPoll, pollErr := w.status.poll(); !lastPoll.IsZero() {
+		report.LastPoll, report.LastPollError = &lastPoll, pollErr
+	}
+	if updates := w.status.updates(); len(updates) > 0 {
+		report.LastUpdate = &updates[len(updates)-1]
+	}
+	report.Container = w.containerStatus()
+	return report
+}
+
+// containerStatus inspect node container and its image, nil if the container does not exist
+func (w *NodeWatcher) containerStatus() *ContainerStatus {
+	nodeContainer, err := w.DockerClient.ContainerInspect(w.BackgroundContex, w.ContainerName)
+	if err != nil {
+		return nil
+	}
+	status := &ContainerStatus{Name: w.ContainerName, ID: nodeContainer.ID, ImageID: nodeContainer.Image}
+	if nodeContainer.State != nil {
+		status.State = nodeContainer.State.Status
+	}
+	if nodeContainer.Config != nil {
+		status.Image = nodeContainer.Config.Image
+	}
+	if image, _, err := w.DockerClient.ImageInspectWithRaw(w.BackgroundContex, nodeContainer.Image); err == nil {
+		status.Digest = w.repoDigest(image)
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAPIToken = "secret-token"
+
+func apiRequest(t *testing.T, server *httptest.Server, method, path, token string) *http.Response {
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	assert.NoError(t, err)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	return resp
+}
+
+func TestAPIAuthorization(t *testing.T) {
+	watcher, _ := mockData.getWatcher(t)
+	server := httptest.NewServer(NewAPIServer([]*NodeWatcher{watcher}, testAPIToken).Handler())
+	defer server.Close()
+
+	resp := apiRequest(t, server, http.MethodGet, "/status", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = apiRequest(t, server, http.MethodGet, "/status", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = apiRequest(t, server, http.MethodGet, "/status", testAPIToken)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	for _, header := range []string{testAPIToken, "Basic " + testAPIToken, "bearer " + testAPIToken} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/status", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", header)
+		resp, err = http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, header)
+	}
+	resp = apiRequest(t, server, http.MethodPost, "/status", testAPIToken)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	resp = apiRequest(t, server, http.MethodGet, "/metrics", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "scrapers do not need the token")
+	resp = apiRequest(t, server, http.MethodPost, "/metrics", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	resp = apiRequest(t, server, http.MethodGet, "/unknown", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestAPIStatusAndHistory(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	server := httptest.NewServer(NewAPIServer([]*NodeWatcher{watcher}, "").Handler())
+	defer server.Close()
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+	watcher.status.recordPoll(nil)
+	_, err = runUpdate(watcher, update)
+	assert.NoError(t, err)
+
+	resp := apiRequest(t, server, http.MethodGet, "/status", "")
+	var nodes NodesReport
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&nodes))
+	assert.Len(t, nodes.Nodes, 1)
+	report := nodes.Nodes[0]
+	assert.Equal(t, watcher.ContainerName, report.Name)
+	assert.Equal(t, watcher.ContainerName, report.Container.Name)
+	assert.Equal(t, mockNewImageID, report.Container.ImageID)
+	assert.Equal(t, mockNewDigest, report.Container.Digest)
+	assert.Equal(t, containerStateRunning, report.Container.State)
+	assert.NotNil(t, report.LastPoll)
+	assert.Equal(t, updateSucceeded, report.LastUpdate.Result)
+
+	resp = apiRequest(t, server, http.MethodGet, "/history", "")
+	var history []UpdateRecord
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&history))
+	assert.Len(t, history, 1)
+	assert.Equal(t, mockOldDigest, history[0].OldDigest)
+	assert.Equal(t, mockNewDigest, history[0].NewDigest)
+}
+
+func TestAPIUpdate(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	watcher.PollInterval = time.Hour
+	server := httptest.NewServer(NewAPIServer([]*NodeWatcher{watcher}, "").Handler())
+	defer server.Close()
+	go StartMonitor(watcher)
+	deadline := time.Now().Add(5 * time.Second)
+	for lastPoll, _ := watcher.status.poll(); lastPoll.IsZero() && time.Now().Before(deadline); lastPoll, _ = watcher.status.poll() {
+		time.Sleep(time.Millisecond)
+	}
+
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	resp := apiRequest(t, server, http.MethodPost, "/update", "")
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	for time.Now().Before(deadline) {
+		if updates := watcher.status.updates(); len(updates) > 0 {
+			assert.Equal(t, triggerAPI, updates[0].Trigger)
+			assert.Equal(t, updateSucceeded, updates[0].Result)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("update is not triggered")
+}
+
+func TestAPIRollback(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	server := httptest.NewServer(NewAPIServer([]*NodeWatcher{watcher}, "").Handler())
+	defer server.Close()
+
+	resp := apiRequest(t, server, http.MethodPost, "/rollback", "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	oldID := docker.Container(watcher.ContainerName).ID
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+	_, err = runUpdate(watcher, update)
+	assert.NoError(t, err)
+	mockData.assertDBRenamed(t, watcher, true)
+
+	resp = apiRequest(t, server, http.MethodPost, "/rollback", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	node := docker.Container(watcher.ContainerName)
+	assert.Equal(t, oldID, node.ID)
+	assert.True(t, node.State.Running)
+	mockData.assertDBRenamed(t, watcher, false)
+	assert.Equal(t, mockNewDigest, watcher.pinnedImage().NewDigest)
+	history := watcher.status.updates()
+	assert.Equal(t, updateRolledBack, history[len(history)-1].Result)
+
+	update, err = watcher.checkImage()
+	assert.NoError(t, err)
+	assert.False(t, update.Updated)
+}
+
+func TestAPIUnixSocket(t *testing.T) {
+	watcher, _ := mockData.getWatcher(t)
+	socket := filepath.Join(mockData.BaseDir, "watcher.sock")
+	go NewAPIServer([]*NodeWatcher{watcher}, testAPIToken).ListenAndServe(unixSocketPrefix + socket)
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		req, _ := http.NewRequest(http.MethodGet, "http://watcher/history", nil)
+		req.Header.Set("Authorization", "Bearer "+testAPIToken)
+		resp, err := client.Do(req)
+		if err == nil {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json"))
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAPISocketPathKeepsFile(t *testing.T) {
+	watcher, _ := mockData.getWatcher(t)
+	path := filepath.Join(mockData.BaseDir, "not-a-socket")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("data"), 0600))
+	err := NewAPIServer([]*NodeWatcher{watcher}, "").ListenAndServe(unixSocketPrefix + path)
+	if assert.Error(t, err, "a file which is not a socket is not removed") {
+		assert.Contains(t, err.Error(), ErrorAPIListen.Error())
+	}
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestAPIMultipleNodes(t *testing.T) {
+	mainnet, mainnetDocker := mockData.getNamedWatcher(t, "bitmarkNode")
+	testnet, testnetDocker := mockData.getNamedWatcher(t, "bitmarkNodeTestnet")
+	server := httptest.NewServer(NewAPIServer([]*NodeWatcher{mainnet, testnet}, "").Handler())
+	defer server.Close()
+
+	mainnetDocker.FailOn("ContainerCreate", errors.New("no space left on device"))
+	mainnetDocker.PublishImage(mainnet.ImageName, mockNewImageID, mockNewDigest)
+	testnetDocker.PublishImage(testnet.ImageName, mockNewImageID, mockNewDigest)
+	for _, watcher := range []*NodeWatcher{mainnet, testnet} {
+		update, err := watcher.checkImage()
+		assert.NoError(t, err)
+		runUpdate(watcher, update)
+	}
+
+	resp := apiRequest(t, server, http.MethodGet, "/status", "")
+	var nodes NodesReport
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&nodes))
+	if assert.Len(t, nodes.Nodes, 2) {
+		assert.Equal(t, updateRolledBack, nodes.Nodes[0].LastUpdate.Result)
+		assert.Equal(t, mockOldImageID, nodes.Nodes[0].Container.ImageID)
+		assert.Equal(t, updateSucceeded, nodes.Nodes[1].LastUpdate.Result)
+		assert.Equal(t, mockNewImageID, nodes.Nodes[1].Container.ImageID)
+	}
+
+	resp = apiRequest(t, server, http.MethodGet, "/history?name=bitmarkNodeTestnet", "")
+	var history []UpdateRecord
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&history))
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, "bitmarkNodeTestnet", history[0].Container)
+	}
+	resp = apiRequest(t, server, http.MethodGet, "/status?name=bitmarkNodeDevnet", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = apiRequest(t, server, http.MethodPost, "/rollback", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = apiRequest(t, server, http.MethodPost, "/update?name=bitmarkNodeTestnet", "")
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Len(t, mainnet.status.trigger, 0)
+	assert.Len(t, testnet.status.trigger, 1)
+
+	resp = apiRequest(t, server, http.MethodGet, "/metrics", "")
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), `bitmark_node_watcher_update_successes_total{container="bitmarkNodeTestnet"} 1`)
+	assert.Contains(t, string(body), `bitmark_node_watcher_rollbacks_total{container="bitmarkNode",reason="failed_update"} 1`)
+}
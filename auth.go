@@ -0,0 +1,236 @@
+package main
+
+// Registry credentials from configuration or docker config.json, including credential helpers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+const (
+	dockerHubHost          = "index.docker.io"
+	dockerHubServer        = "https://index.docker.io/v1/"
+	defaultAuthRefresh     = 5 * time.Minute
+	credentialHelperPrefix = "docker-credential-"
+	credentialHelperToken  = "<token>" // username of helper output holding an identity token
+)
+
+// CredentialStore look up credentials of registries, they are cached for Refresh so rotated secrets
+// and short lived tokens of credential helpers are picked up, nil store is anonymous
+type CredentialStore struct {
+	ConfigPath string // docker config.json
+	Username   string // explicit credentials used for every registry
+	Password   string
+	Refresh    time.Duration
+	lock       sync.Mutex
+	cache      map[string]cachedCredentials // registry host -> credentials
+}
+
+type cachedCredentials struct {
+	auth      types.AuthConfig
+	expiresAt time.Time
+}
+
+// dockerConfigFile fields of docker config.json about registry credentials
+type dockerConfigFile struct {
+	Auths       map[string]dockerAuthEntry `json:"auths"`
+	CredsStore  string                     `json:"credsStore"`
+	CredHelpers map[string]string          `json:"credHelpers"`
+}
+
+type dockerAuthEntry struct {
+	Auth          string `json:"auth"` // base64 of username:password
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// credentialHelperOutput output of `docker-credential-<helper> get`
+type credentialHelperOutput struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// NewCredentialStore create store of configuration, nil when credentials are not configured anywhere
+func NewCredentialStore(config AuthConfig) *CredentialStore {
+	path := config.DockerConfig
+	if len(path) == 0 {
+		path = defaultDockerConfigPath()
+	}
+	if len(config.Username) == 0 && len(path) == 0 {
+		return nil
+	}
+	refresh := config.Refresh
+	if refresh <= 0 {
+		refresh = defaultAuthRefresh
+	}
+	return &CredentialStore{ConfigPath: path, Username: config.Username, Password: config.Password, Refresh: refresh,
+		cache: make(map[string]cachedCredentials)}
+}
+
+// defaultDockerConfigPath return config.json in $DOCKER_CONFIG or ~/.docker as docker CLI does
+func defaultDockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); len(dir) > 0 {
+		return filepath.Join(dir, "config.json")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".docker", "config.json")
+	}
+	return ""
+}
+
+// Get return credentials of registry host, empty credentials for anonymous access
+func (s *CredentialStore) Get(host string) (types.AuthConfig, error) {
+	if s == nil {
+		return types.AuthConfig{}, nil
+	}
+	host = registryHost(host)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cached, ok := s.cache[host]; ok && time.Now().Before(cached.expiresAt) {
+		return cached.auth, nil
+	}
+	auth, err := s.lookup(host)
+	if err != nil {
+		return auth, err
+	}
+	s.cache[host] = cachedCredentials{auth: auth, expiresAt: time.Now().Add(s.Refresh)}
+	return auth, nil
+}
+
+// Invalidate drop cached credentials of host, the next Get looks them up again
+func (s *CredentialStore) Invalidate(host string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.cache, registryHost(host))
+}
+
+// EncodedAuth return credentials of host as RegistryAuth of image pull
+func (s *CredentialStore) EncodedAuth(host string) (string, error) {
+	auth, err := s.Get(host)
+	if err != nil || (len(auth.Username) == 0 && len(auth.IdentityToken) == 0) {
+		return "", err
+	}
+	data, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// lookup find credentials of host in order of explicit configuration, credential helper and auths of config file
+func (s *CredentialStore) lookup(host string) (types.AuthConfig, error) {
+	server := registryServer(host)
+	if len(s.Username) > 0 {
+		return types.AuthConfig{Username: s.Username, Password: s.Password, ServerAddress: server}, nil
+	}
+	data, err := ioutil.ReadFile(s.ConfigPath)
+	if os.IsNotExist(err) {
+		return types.AuthConfig{}, nil
+	}
+	if err != nil {
+		return types.AuthConfig{}, err
+	}
+	var file dockerConfigFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return types.AuthConfig{}, fmt.Errorf("%s: %s", s.ConfigPath, err)
+	}
+	helper := file.CredsStore
+	for key, name := range file.CredHelpers {
+		if registryHost(key) == host {
+			helper = name
+		}
+	}
+	if len(helper) > 0 {
+		auth, found, err := runCredentialHelper(helper, server)
+		if err != nil || found {
+			return auth, err
+		}
+	}
+	for key, entry := range file.Auths {
+		if registryHost(key) != host {
+			continue
+		}
+		auth := types.AuthConfig{Username: entry.Username, Password: entry.Password,
+			IdentityToken: entry.IdentityToken, ServerAddress: server}
+		if len(entry.Auth) > 0 {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return types.AuthConfig{}, fmt.Errorf("auth of %s: %s", key, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return types.AuthConfig{}, fmt.Errorf("auth of %s is not username:password", key)
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+		}
+		return auth, nil
+	}
+	return types.AuthConfig{}, nil
+}
+
+// runCredentialHelper get credentials of server from docker-credential-<helper>, false when it has none
+func runCredentialHelper(helper, server string) (types.AuthConfig, bool, error) {
+	cmd := exec.Command(credentialHelperPrefix+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(message, "credentials not found") {
+			return types.AuthConfig{}, false, nil
+		}
+		return types.AuthConfig{}, false, fmt.Errorf("%s%s: %s %s", credentialHelperPrefix, helper, err, message)
+	}
+	var output credentialHelperOutput
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return types.AuthConfig{}, false, fmt.Errorf("%s%s: %s", credentialHelperPrefix, helper, err)
+	}
+	auth := types.AuthConfig{ServerAddress: server}
+	if output.Username == credentialHelperToken {
+		auth.IdentityToken = output.Secret
+	} else {
+		auth.Username, auth.Password = output.Username, output.Secret
+	}
+	return auth, true, nil
+}
+
+// registryHost normalize a registry URL, host or config key into host[:port], docker hub is index.docker.io
+func registryHost(server string) string {
+	host := server
+	if strings.Contains(host, "://") {
+		if u, err := url.Parse(host); err == nil {
+			host = u.Host
+		}
+	}
+	host = strings.ToLower(strings.SplitN(host, "/", 2)[0])
+	switch host {
+	case "", "docker.io", "registry-1.docker.io", dockerHubHost:
+		return dockerHubHost
+	}
+	return host
+}
+
+// registryServer return server address of host used by docker as key of credentials
+func registryServer(host string) string {
+	if host == dockerHubHost {
+		return dockerHubServer
+	}
+	return host
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeDockerConfig write config.json in a new directory and return a store reading it
+func writeDockerConfig(t *testing.T, content string) *CredentialStore {
+	dir, err := ioutil.TempDir(mockData.BaseDir, "docker")
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "config.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return NewCredentialStore(AuthConfig{DockerConfig: path, Refresh: time.Hour})
+}
+
+// installCredentialHelper put docker-credential-test on PATH, it answers secret of secretFile and counts its runs
+func installCredentialHelper(t *testing.T) (secretFile, countFile string, restore func()) {
+	dir, err := ioutil.TempDir(mockData.BaseDir, "helper")
+	assert.NoError(t, err)
+	secretFile, countFile = filepath.Join(dir, "secret"), filepath.Join(dir, "count")
+	script := fmt.Sprintf(`#!/bin/sh
+read server
+echo run >> %s
+if [ "$server" != "registry.example.com" ]; then
+  echo "credentials not found in native keychain"
+  exit 1
+fi
+echo "{\"ServerURL\":\"$server\",\"Username\":\"helper\",\"Secret\":\"$(cat %s)\"}"
+`, countFile, secretFile)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, credentialHelperPrefix+"test"), []byte(script), 0700))
+	assert.NoError(t, ioutil.WriteFile(secretFile, []byte("first"), 0600))
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return secretFile, countFile, func() { os.Setenv("PATH", path) }
+}
+
+func helperRuns(t *testing.T, countFile string) int {
+	data, err := ioutil.ReadFile(countFile)
+	assert.NoError(t, err)
+	return strings.Count(string(data), "run")
+}
+
+func TestRegistryHost(t *testing.T) {
+	for server, host := range map[string]string{
+		"https://index.docker.io/v1/":   dockerHubHost,
+		"https://registry-1.docker.io":  dockerHubHost,
+		"docker.io":                     dockerHubHost,
+		"Registry.Example.com:5000":     "registry.example.com:5000",
+		"https://registry.example.com/": "registry.example.com",
+	} {
+		assert.Equal(t, host, registryHost(server), server)
+	}
+}
+
+func TestCredentialStoreDockerConfig(t *testing.T) {
+	hubAuth := base64.StdEncoding.EncodeToString([]byte("bitmark:hub-secret"))
+	store := writeDockerConfig(t, `{"auths": {
+		"https://index.docker.io/v1/": {"auth": "`+hubAuth+`"},
+		"registry.example.com:5000": {"identitytoken": "refresh-token"}}}`)
+
+	auth, err := store.Get("https://registry-1.docker.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "bitmark", auth.Username)
+	assert.Equal(t, "hub-secret", auth.Password)
+	assert.Equal(t, dockerHubServer, auth.ServerAddress)
+	auth, err = store.Get("registry.example.com:5000")
+	assert.NoError(t, err)
+	assert.Equal(t, "refresh-token", auth.IdentityToken)
+	encoded, err := store.EncodedAuth("other.example.com")
+	assert.NoError(t, err)
+	assert.Empty(t, encoded, "registry without credentials is anonymous")
+
+	encoded, err = store.EncodedAuth(dockerHubHost)
+	assert.NoError(t, err)
+	data, err := base64.URLEncoding.DecodeString(encoded)
+	assert.NoError(t, err)
+	decoded := types.AuthConfig{}
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, "bitmark", decoded.Username)
+	assert.Equal(t, "hub-secret", decoded.Password)
+
+	explicit := NewCredentialStore(AuthConfig{DockerConfig: store.ConfigPath, Username: "ci", Password: "ci-secret"})
+	auth, err = explicit.Get(dockerHubHost)
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", auth.Username)
+
+	broken := writeDockerConfig(t, `{"auths": `)
+	_, err = broken.Get(dockerHubHost)
+	assert.Error(t, err)
+	var nilStore *CredentialStore
+	encoded, err = nilStore.EncodedAuth(dockerHubHost)
+	assert.NoError(t, err)
+	assert.Empty(t, encoded)
+}
+
+func TestCredentialHelper(t *testing.T) {
+	secretFile, countFile, restore := installCredentialHelper(t)
+	defer restore()
+	hubAuth := base64.StdEncoding.EncodeToString([]byte("bitmark:hub-secret"))
+	store := writeDockerConfig(t, `{"credHelpers": {"registry.example.com": "test"},
+		"credsStore": "test", "auths": {"https://index.docker.io/v1/": {"auth": "`+hubAuth+`"}}}`)
+	store.Refresh = 50 * time.Millisecond
+
+	auth, err := store.Get("registry.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "helper", auth.Username)
+	assert.Equal(t, "first", auth.Password)
+	_, err = store.Get("registry.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, helperRuns(t, countFile), "credentials are cached")
+
+	// helper has no credentials of docker hub, auths of config file are used
+	auth, err = store.Get(dockerHubHost)
+	assert.NoError(t, err)
+	assert.Equal(t, "hub-secret", auth.Password)
+
+	assert.NoError(t, ioutil.WriteFile(secretFile, []byte("second"), 0600))
+	time.Sleep(2 * store.Refresh)
+	auth, err = store.Get("registry.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "second", auth.Password, "credentials are looked up again after refresh")
+
+	store.Refresh = time.Hour
+	assert.NoError(t, ioutil.WriteFile(secretFile, []byte("third"), 0600))
+	store.Invalidate("registry.example.com")
+	auth, err = store.Get("registry.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "third", auth.Password)
+
+	missing := writeDockerConfig(t, `{"credsStore": "missing"}`)
+	_, err = missing.Get(dockerHubHost)
+	assert.Error(t, err)
+}
+
+func TestPullWithCredentials(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	store := NewCredentialStore(AuthConfig{Username: "bitmark", Password: "first"})
+	encoded, err := store.EncodedAuth(dockerHubHost)
+	assert.NoError(t, err)
+	docker.RequirePullAuth(encoded)
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+
+	_, err = watcher.checkImage()
+	assert.Error(t, err, "anonymous pull is rejected")
+	assert.Contains(t, err.Error(), ErrorImagePull.Error())
+
+	watcher.Credentials = store
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+	assert.True(t, update.Updated)
+
+	// password is rotated, the cached one is rejected and looked up again
+	store.Password = "second"
+	rotated := NewCredentialStore(AuthConfig{Username: "bitmark", Password: "second"})
+	encoded, err = rotated.EncodedAuth(dockerHubHost)
+	assert.NoError(t, err)
+	docker.RequirePullAuth(encoded)
+	_, err = watcher.checkImage()
+	assert.NoError(t, err)
+}
+
+// newAuthRegistry return a registry whose token server requires basic auth of bitmark:secret,
+// or which accepts basic auth directly when basic is set
+func newAuthRegistry(t *testing.T, basic bool) (*httptest.Server, *int) {
+	tokenRequests := 0
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		valid := false
+		if r.Method == http.MethodPost {
+			valid = r.PostFormValue("grant_type") == "refresh_token" && r.PostFormValue("refresh_token") == "identity"
+		} else {
+			username, password, ok := r.BasicAuth()
+			valid = ok && username == "bitmark" && password == "secret"
+		}
+		if !valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"private-token","expires_in":300}`)
+	})
+	mux.HandleFunc("/v2/bitmark/bitmark-node/manifests/latest", func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		authorized := r.Header.Get("Authorization") == "Bearer private-token"
+		if basic {
+			authorized = ok && username == "bitmark" && password == "secret"
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry.test"`, server.URL))
+		}
+		if !authorized {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", mockManifestDigest)
+	})
+	return server, &tokenRequests
+}
+
+func TestManifestDigestWithCredentials(t *testing.T) {
+	for _, basic := range []bool{false, true} {
+		server, _ := newAuthRegistry(t, basic)
+		registry := NewRegistryClient(server.URL)
+		_, err := registry.ManifestDigest(context.Background(), "bitmark/bitmark-node", "latest")
+		assert.Error(t, err, "anonymous query is rejected")
+		assert.Contains(t, err.Error(), ErrorRegistryAuth.Error())
+
+		registry.Credentials = NewCredentialStore(AuthConfig{Username: "bitmark", Password: "secret"})
+		digest, err := registry.ManifestDigest(context.Background(), "bitmark/bitmark-node", "latest")
+		assert.NoError(t, err)
+		assert.Equal(t, mockManifestDigest, digest)
+		server.Close()
+	}
+
+	server, tokenRequests := newAuthRegistry(t, false)
+	defer server.Close()
+	host := registryHost(server.URL)
+	store := writeDockerConfig(t, `{"auths": {"`+host+`": {"identitytoken": "identity"}}}`)
+	registry := NewRegistryClient(server.URL)
+	registry.Credentials = store
+	_, err := registry.ManifestDigest(context.Background(), "bitmark/bitmark-node", "latest")
+	assert.NoError(t, err, "identity token is exchanged for a token")
+	assert.Equal(t, 1, *tokenRequests)
+}
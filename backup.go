@@ -0,0 +1,526 @@
+package main
+
+// Versioned snapshots of node databases, an update saves the databases into a snapshot before it resets them,
+// rollback and restore command bring a snapshot back
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	log "github.com/google/logger"
+)
+
+// Strategies of BackupStore
+const (
+	backupStrategyHardlink = "hardlink" // immutable table files are linked, other files are copied
+	backupStrategyCopy     = "copy"     // every file is copied
+)
+
+const (
+	defaultBackupDir        = watcherStateDir + "/backups"
+	defaultBackupKeep       = 3
+	snapshotManifestName    = "manifest.json"
+	snapshotManifestVersion = 1
+	snapshotIDFormat        = "20060102T150405.000Z"
+	snapshotNext            = "<next>" // ID of the snapshot an update would create, in plans
+	restoringPostfix        = ".restoring"
+)
+
+// SnapshotManifest content of a snapshot, it is written after all files are saved
+type SnapshotManifest struct {
+	Version   int            `json:"version"`
+	ID        string         `json:"id"`
+	Container string         `json:"container"`
+	ImageID   string         `json:"image_id"` // image of the node container which wrote the databases
+	Digest    string         `json:"digest"`
+	CreatedAt time.Time      `json:"created_at"`
+	Strategy  string         `json:"strategy"`
+	DBs       []SnapshotDB   `json:"dbs"`
+	Files     []SnapshotFile `json:"files"`
+	Size      int64          `json:"size"`
+}
+
+// SnapshotDB a database directory saved in snapshot under chain/name
+type SnapshotDB struct {
+	Chain string `json:"chain"`
+	Name  string `json:"name"`
+	Path  string `json:"path"` // directory the database is saved from and restored to
+}
+
+// SnapshotFile a file of snapshot, path is relative to the snapshot directory
+type SnapshotFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupRetention snapshots kept of a container, the newest snapshot is always kept
+type BackupRetention struct {
+	Keep      int           // count, 0 for no limit
+	MaxAge    time.Duration // 0 for no limit
+	MinFreeMB uint64        // oldest snapshots are removed while free space is lower, 0 to ignore
+}
+
+// BackupStore snapshots of node databases, each container has a directory of snapshots in Dir
+type BackupStore struct {
+	Dir       string
+	Strategy  string
+	Retention BackupRetention
+}
+
+// NewBackupStore create store of configuration
+func NewBackupStore(config BackupConfig) *BackupStore {
+	return &BackupStore{Dir: config.Dir, Strategy: config.Strategy,
+		Retention: BackupRetention{Keep: config.Keep, MaxAge: config.MaxAge, MinFreeMB: config.MinFreeMB}}
+}
+
+// containerDir return the directory of snapshots of container
+func (s *BackupStore) containerDir(container string) string {
+	return filepath.Join(s.Dir, container)
+}
+
+// Create save databases into a new snapshot, nil is returned when there is no database,
+// a snapshot is complete only when its manifest is written
+func (s *BackupStore) Create(container string, update ImageUpdate, dbs []SnapshotDB) (*SnapshotManifest, error) {
+	if len(dbs) == 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(s.containerDir(container), 0700); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	manifest := &SnapshotManifest{Version: snapshotManifestVersion, ID: now.Format(snapshotIDFormat), Container: container,
+		ImageID: update.OldID, Digest: update.OldDigest, CreatedAt: now, Strategy: s.Strategy, DBs: dbs, Files: []SnapshotFile{}}
+	dir := filepath.Join(s.containerDir(container), manifest.ID)
+	for n := 1; ; n++ {
+		err := os.Mkdir(dir, 0700)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		manifest.ID = fmt.Sprintf("%s-%d", now.Format(snapshotIDFormat), n)
+		dir = filepath.Join(s.containerDir(container), manifest.ID)
+	}
+	for _, db := range dbs {
+		files, err := s.copyTree(db.Path, filepath.Join(dir, db.Chain, db.Name))
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		for _, file := range files {
+			file.Path = filepath.Join(db.Chain, db.Name, file.Path)
+			manifest.Files = append(manifest.Files, file)
+			manifest.Size += file.Size
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = writeFileSynced(filepath.Join(dir, snapshotManifestName), data)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	log.Info("snapshot:", manifest.ID, " of container:", container, " saves ", len(manifest.Files), " files ", manifest.Size, " bytes")
+	return manifest, nil
+}
+
+// Load read manifest of snapshot id of container
+func (s *BackupStore) Load(container, id string) (*SnapshotManifest, error) {
+	if len(id) == 0 || id != filepath.Base(id) {
+		return nil, fmt.Errorf("invalid snapshot %q", id)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.containerDir(container), id, snapshotManifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &SnapshotManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %s", id, err)
+	}
+	if manifest.Version != snapshotManifestVersion {
+		return nil, fmt.Errorf("snapshot %s: manifest version %d is not supported", id, manifest.Version)
+	}
+	return manifest, nil
+}
+
+// List return complete snapshots of container, oldest first
+func (s *BackupStore) List(container string) ([]SnapshotManifest, error) {
+	entries, err := ioutil.ReadDir(s.containerDir(container))
+	if os.IsNotExist(err) {
+		return []SnapshotManifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []SnapshotManifest{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if manifest, err := s.Load(container, entry.Name()); err == nil {
+			snapshots = append(snapshots, *manifest)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].CreatedAt.Equal(snapshots[j].CreatedAt) {
+			return snapshots[i].ID < snapshots[j].ID
+		}
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+// Restore replace databases of snapshot with their saved files, all databases are rebuilt and checked
+// against manifest before they are swapped in as one transaction, record is called with its moves
+func (s *BackupStore) Restore(manifest *SnapshotManifest, record func(moves []DBMove)) error {
+	dir := filepath.Join(s.containerDir(manifest.Container), manifest.ID)
+	expected := map[string]SnapshotFile{}
+	for _, file := range manifest.Files {
+		expected[file.Path] = file
+	}
+	cleanup := func() {
+		for _, db := range manifest.DBs {
+			os.RemoveAll(db.Path + restoringPostfix)
+		}
+	}
+	for _, db := range manifest.DBs {
+		os.RemoveAll(db.Path + restoringPostfix)
+		files, err := s.copyTree(filepath.Join(dir, db.Chain, db.Name), db.Path+restoringPostfix)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		for _, file := range files {
+			path := filepath.Join(db.Chain, db.Name, file.Path)
+			if saved, ok := expected[path]; !ok || saved.Size != file.Size || saved.SHA256 != file.SHA256 {
+				cleanup()
+				return fmt.Errorf("snapshot %s: %s does not match manifest", manifest.ID, path)
+			}
+			delete(expected, path)
+		}
+	}
+	for path := range expected {
+		cleanup()
+		return fmt.Errorf("snapshot %s: %s is missing", manifest.ID, path)
+	}
+	moves := []DBMove{}
+	for _, db := range manifest.DBs {
+		if _, err := os.Stat(db.Path); err == nil {
+			os.RemoveAll(db.Path + replacedPostfix)
+			moves = append(moves, DBMove{From: db.Path, To: db.Path + replacedPostfix})
+		}
+		moves = append(moves, DBMove{From: db.Path + restoringPostfix, To: db.Path})
+	}
+	if err := moveDBs(ErrorRecoverDB, moves, record); err != nil {
+		cleanup()
+		return err
+	}
+	removeMoved(moves)
+	log.Info("snapshot:", manifest.ID, " of container:", manifest.Container, " is restored")
+	return nil
+}
+
+// Prune remove snapshots of container beyond retention and incomplete snapshots, keep is never removed
+func (s *BackupStore) Prune(container, keep string) ([]string, error) {
+	entries, err := ioutil.ReadDir(s.containerDir(container))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join(s.containerDir(container), entry.Name(), snapshotManifestName)); entry.IsDir() && os.IsNotExist(err) {
+			os.RemoveAll(filepath.Join(s.containerDir(container), entry.Name()))
+		}
+	}
+	snapshots, err := s.List(container)
+	if err != nil {
+		return nil, err
+	}
+	candidates := []SnapshotManifest{} // oldest first
+	for _, snapshot := range snapshots {
+		if snapshot.ID != keep {
+			candidates = append(candidates, snapshot)
+		}
+	}
+	removed := []string{}
+	remove := func() error {
+		if err := os.RemoveAll(filepath.Join(s.containerDir(container), candidates[0].ID)); err != nil {
+			return err
+		}
+		removed = append(removed, candidates[0].ID)
+		candidates = candidates[1:]
+		return nil
+	}
+	retention := s.Retention
+	for len(candidates) > 0 {
+		switch {
+		case retention.Keep > 0 && len(snapshots)-len(removed) > retention.Keep:
+		case retention.MaxAge > 0 && time.Since(candidates[0].CreatedAt) > retention.MaxAge:
+		case retention.MinFreeMB > 0 && freeMB(s.Dir) < retention.MinFreeMB:
+		default:
+			return removed, nil
+		}
+		if err := remove(); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// copyTree copy directory src to dst following strategy and return its files with paths relative to dst
+func (s *BackupStore) copyTree(src, dst string) ([]SnapshotFile, error) {
+	files := []SnapshotFile{}
+	crossDevice := false
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relative)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, 0700)
+		case !info.Mode().IsRegular():
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+		link := s.Strategy == backupStrategyHardlink && !crossDevice && immutableDBFile(path)
+		file, crossed, err := placeFile(path, target, link)
+		if err != nil {
+			return err
+		}
+		if crossed {
+			crossDevice = true // every other link fails the same way
+			log.Warning("files of ", src, " are copied to ", dst, " as hardlinks do not cross mounts, each snapshot takes",
+				" the full size of the databases and the node waits for the copy, mount them in one volume to link them")
+		}
+		file.Path = relative
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+// removeMoved remove databases moved aside by a committed transaction, a failure leaves them on disk
+func removeMoved(moves []DBMove) {
+	for _, move := range moves {
+		if strings.HasSuffix(move.To, removingPostfix) || strings.HasSuffix(move.To, replacedPostfix) {
+			if err := os.RemoveAll(move.To); err != nil {
+				log.Warning("remove ", move.To, " failed: ", err)
+			}
+		}
+	}
+}
+
+// immutableDBFile tell if LevelDB never changes the file once it is written
+func immutableDBFile(path string) bool {
+	return strings.HasSuffix(path, ".ldb") || strings.HasSuffix(path, ".sst")
+}
+
+// placeFile link or copy src to dst and return size and checksum of dst, a failed link is copied,
+// crossDevice tells it failed as dst is on another mount
+func placeFile(src, dst string, link bool) (file SnapshotFile, crossDevice bool, err error) {
+	if link {
+		linkErr := os.Link(src, dst)
+		if linkErr == nil {
+			file, err = checksumFile(dst)
+			return file, false, err
+		}
+		crossDevice = isCrossDevice(linkErr)
+	}
+	file, err = copyFile(src, dst)
+	return file, crossDevice, err
+}
+
+// isCrossDevice tell if err is a link failing as its paths are on different mounts
+func isCrossDevice(err error) bool {
+	linkErr, ok := err.(*os.LinkError)
+	return ok && linkErr.Err == syscall.EXDEV
+}
+
+// copyFile copy src to dst and return size and checksum of dst
+func copyFile(src, dst string) (SnapshotFile, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	return SnapshotFile{Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+func checksumFile(path string) (SnapshotFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	return SnapshotFile{Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// writeFileSynced write data to a temporary file and rename it over path
+func writeFileSynced(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// freeMB return free space of the file system of dir available to watcher, 0 when it is unknown
+func freeMB(dir string) uint64 {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0
+	}
+	return stat.Bavail * uint64(stat.Bsize) / (1 << 20)
+}
+
+// nodeDBs return databases in data directories of chains, nil chains for every chain
+func (w *NodeWatcher) nodeDBs(chains map[string]bool) []SnapshotDB {
+	dbs := []SnapshotDB{}
+	for _, dir := range w.Node.DataDirs {
+		if chains != nil && !chains[dir.Chain] {
+			continue
+		}
+		for _, name := range []string{blockLevelDB, indexLevelDB} {
+			path := w.DataRoot + dir.Path + "/" + name
+			if _, err := os.Stat(path); err == nil {
+				dbs = append(dbs, SnapshotDB{Chain: dir.Chain, Name: name, Path: path})
+			}
+		}
+	}
+	return dbs
+}
+
+// backupDB save databases of chains into a snapshot and remove them, so the new container syncs from scratch,
+// databases are kept in place when the snapshot fails
+func (w *NodeWatcher) backupDB(update ImageUpdate, chains map[string]bool) error {
+	snapshot, err := w.Backups.Create(w.ContainerName, update, w.nodeDBs(chains))
+	if err != nil {
+		return ErrCombind(ErrorBackupDB, err)
+	}
+	if snapshot == nil {
+		return nil
+	}
+	w.journalStep(journalDBSaved, func(entry *JournalEntry) { entry.Snapshot = snapshot.ID })
+	if removed, err := w.Backups.Prune(w.ContainerName, snapshot.ID); err != nil {
+		log.Error(ErrCombind(ErrorBackupDB, err))
+	} else if len(removed) > 0 {
+		log.Info("snapshots:", removed, " of container:", w.ContainerName, " are removed by retention")
+	}
+	moves := []DBMove{}
+	for _, db := range snapshot.DBs {
+		moves = append(moves, DBMove{From: db.Path, To: db.Path + removingPostfix})
+	}
+	if err := moveDBs(ErrorRenameDB, moves, w.journalDBMoves); err != nil {
+		if transaction, ok := err.(*DBTransactionError); !ok || !transaction.Consistent() {
+			w.snapshot = snapshot
+		}
+		return err
+	}
+	w.snapshot = snapshot
+	removeMoved(moves)
+	w.journalDBMoves(nil)
+	return nil
+}
+
+// restoreDB bring back the databases of snapshot, nil snapshot restores nothing
+func (w *NodeWatcher) restoreDB(snapshot *SnapshotManifest) error {
+	if snapshot == nil {
+		return nil
+	}
+	err := w.Backups.Restore(snapshot, w.journalDBMoves)
+	if _, ok := err.(*DBTransactionError); ok {
+		return err
+	}
+	if err != nil {
+		return ErrCombind(ErrorRecoverDB, err)
+	}
+	w.journalDBMoves(nil)
+	return nil
+}
+
+// previousSnapshot return the latest snapshot of databases written by image, nil when there is none
+func (w *NodeWatcher) previousSnapshot(imageID string) *SnapshotManifest {
+	snapshots, err := w.Backups.List(w.ContainerName)
+	if err != nil || len(snapshots) == 0 {
+		return nil
+	}
+	latest := snapshots[len(snapshots)-1]
+	if latest.ImageID != imageID {
+		return nil
+	}
+	return &latest
+}
+
+// RestoreSnapshot stop node container, replace its databases with snapshot id and start it again
+func (w *NodeWatcher) RestoreSnapshot(id string) error {
+	w.status.beginOperation()
+	defer w.status.endOperation()
+	snapshot, err := w.Backups.Load(w.ContainerName, id)
+	if err != nil {
+		return ErrCombind(ErrorRecoverDB, err)
+	}
+	nodeContainer, err := w.DockerClient.ContainerInspect(w.BackgroundContex, w.ContainerName)
+	running := err == nil && nodeContainer.State != nil && nodeContainer.State.Running
+	if running {
+		stopping := []types.Container{{ID: nodeContainer.ID, Names: []string{nodeContainer.Name}, State: containerStateRunning}}
+		if err := w.stopContainers(stopping, w.StopTimeout); err != nil {
+			return ErrCombind(ErrorContainerStop, err)
+		}
+	}
+	restoreErr := w.restoreDB(snapshot)
+	w.notify(eventDBRestored, ImageUpdate{}, restoreErr)
+	if running {
+		if err := w.startContainer(nodeContainer.ID); err != nil {
+			return ErrCombind(ErrorContainerStart, err)
+		}
+	}
+	return restoreErr
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupStore(t *testing.T) {
+	for _, strategy := range []string{backupStrategyHardlink, backupStrategyCopy} {
+		watcher, _ := mockData.getWatcher(t)
+		store := watcher.Backups
+		store.Strategy = strategy
+		dbs := watcher.nodeDBs(nil)
+		assert.Len(t, dbs, 2*len(watcher.dataDirs()))
+
+		snapshot, err := store.Create(watcher.ContainerName, ImageUpdate{OldID: mockOldImageID, OldDigest: mockOldDigest}, dbs)
+		assert.NoError(t, err)
+		assert.Equal(t, mockOldImageID, snapshot.ImageID)
+		assert.Len(t, snapshot.Files, 2*len(dbs))
+		for _, file := range snapshot.Files {
+			assert.Len(t, file.SHA256, 64)
+		}
+		table := filepath.Join(dbs[0].Path, "000005.ldb")
+		saved := filepath.Join(store.containerDir(watcher.ContainerName), snapshot.ID, dbs[0].Chain, dbs[0].Name, "000005.ldb")
+		tableInfo, err := os.Stat(table)
+		assert.NoError(t, err)
+		savedInfo, err := os.Stat(saved)
+		assert.NoError(t, err)
+		assert.Equal(t, strategy == backupStrategyHardlink, os.SameFile(tableInfo, savedInfo), strategy)
+
+		// the new container writes its own databases, restore brings back the saved ones
+		for _, db := range dbs {
+			assert.NoError(t, os.RemoveAll(db.Path))
+		}
+		assert.NoError(t, os.MkdirAll(dbs[0].Path, 0700))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dbs[0].Path, "000009.ldb"), []byte("new"), 0600))
+		loaded, err := store.Load(watcher.ContainerName, snapshot.ID)
+		assert.NoError(t, err)
+		assert.NoError(t, store.Restore(loaded, nil))
+		mockData.assertDBRenamed(t, watcher, false)
+		_, err = os.Stat(filepath.Join(dbs[0].Path, "000009.ldb"))
+		assert.True(t, os.IsNotExist(err))
+
+		// a changed file is found before any database is replaced
+		assert.NoError(t, os.Remove(saved))
+		assert.NoError(t, ioutil.WriteFile(saved, []byte("corrupt"), 0600))
+		err = store.Restore(loaded, nil)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "does not match manifest")
+		mockData.assertDBRenamed(t, watcher, false)
+		_, err = os.Stat(dbs[0].Path + restoringPostfix)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	watcher, _ := mockData.getWatcher(t)
+	snapshot, err := watcher.Backups.Create(watcher.ContainerName, ImageUpdate{}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, snapshot, "nothing to save")
+	_, err = watcher.Backups.Load(watcher.ContainerName, "../other")
+	assert.Error(t, err)
+}
+
+func TestBackupRetention(t *testing.T) {
+	watcher, _ := mockData.getWatcher(t)
+	store := watcher.Backups
+	store.Retention = BackupRetention{Keep: 2}
+	ids := []string{}
+	for i := 0; i < 4; i++ {
+		snapshot, err := store.Create(watcher.ContainerName, ImageUpdate{}, watcher.nodeDBs(nil))
+		assert.NoError(t, err)
+		ids = append(ids, snapshot.ID)
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Join(store.containerDir(watcher.ContainerName), "incomplete"), 0700))
+
+	removed, err := store.Prune(watcher.ContainerName, ids[3])
+	assert.NoError(t, err)
+	assert.Equal(t, ids[:2], removed)
+	snapshots, err := store.List(watcher.ContainerName)
+	assert.NoError(t, err)
+	if assert.Len(t, snapshots, 2) {
+		assert.Equal(t, ids[2], snapshots[0].ID)
+	}
+	_, err = os.Stat(filepath.Join(store.containerDir(watcher.ContainerName), "incomplete"))
+	assert.True(t, os.IsNotExist(err), "incomplete snapshot is removed")
+
+	store.Retention = BackupRetention{MaxAge: time.Nanosecond}
+	removed, err = store.Prune(watcher.ContainerName, ids[3])
+	assert.NoError(t, err)
+	assert.Equal(t, ids[2:3], removed)
+
+	snapshot, err := store.Create(watcher.ContainerName, ImageUpdate{}, watcher.nodeDBs(nil))
+	assert.NoError(t, err)
+	store.Retention = BackupRetention{MinFreeMB: 1 << 60}
+	removed, err = store.Prune(watcher.ContainerName, snapshot.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[3:], removed, "the newest snapshot is kept however disk is full")
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+	_, err = runUpdate(watcher, update)
+	assert.NoError(t, err)
+	mockData.assertDBRenamed(t, watcher, true)
+	snapshots, err := watcher.Backups.List(watcher.ContainerName)
+	assert.NoError(t, err)
+	if !assert.Len(t, snapshots, 1) {
+		return
+	}
+	assert.Equal(t, mockOldImageID, snapshots[0].ImageID)
+
+	node := docker.Container(watcher.ContainerName)
+	assert.NoError(t, watcher.RestoreSnapshot(snapshots[0].ID))
+	mockData.assertDBRenamed(t, watcher, false)
+	assert.Equal(t, node.ID, docker.Container(watcher.ContainerName).ID)
+	assert.True(t, docker.Container(watcher.ContainerName).State.Running)
+	assert.Contains(t, docker.Calls(), "ContainerStop")
+
+	assert.Error(t, watcher.RestoreSnapshot("20200101T000000.000Z"))
+}
+
+func TestFailedBackupRollsBack(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	oldID := docker.Container(watcher.ContainerName).ID
+	blocker := filepath.Join(watcher.DataRoot, "blocker")
+	assert.NoError(t, ioutil.WriteFile(blocker, []byte("not a directory"), 0600))
+	watcher.Backups.Dir = filepath.Join(blocker, "backups")
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+
+	exit, err := UpdateOnce(watcher)
+	assert.Equal(t, exitRolledBack, exit)
+	assert.Error(t, err)
+	assert.Equal(t, "backup_db", errorLabel(err))
+	node := docker.Container(watcher.ContainerName)
+	assert.Equal(t, oldID, node.ID, "new node does not start on databases which are not saved")
+	assert.True(t, node.State.Running)
+	for _, db := range watcher.nodeDBs(nil) {
+		data, err := ioutil.ReadFile(filepath.Join(db.Path, "000005.ldb"))
+		assert.NoError(t, err)
+		assert.Equal(t, db.Name, string(data))
+	}
+	assert.Len(t, watcher.nodeDBs(nil), 2*len(watcher.dataDirs()))
+}
+
+func TestPlaceFile(t *testing.T) {
+	dir, err := ioutil.TempDir(mockData.BaseDir, "place")
+	assert.NoError(t, err)
+	src := filepath.Join(dir, "000005.ldb")
+	assert.NoError(t, ioutil.WriteFile(src, []byte("table"), 0600))
+	for _, link := range []bool{true, false} {
+		dst := filepath.Join(dir, fmt.Sprintf("placed-%t.ldb", link))
+		file, crossDevice, err := placeFile(src, dst, link)
+		assert.NoError(t, err)
+		assert.False(t, crossDevice)
+		assert.Equal(t, int64(len("table")), file.Size)
+		srcInfo, _ := os.Stat(src)
+		dstInfo, _ := os.Stat(dst)
+		assert.Equal(t, link, os.SameFile(srcInfo, dstInfo))
+	}
+	assert.True(t, isCrossDevice(&os.LinkError{Op: "link", Old: src, New: "/other", Err: syscall.EXDEV}))
+	assert.False(t, isCrossDevice(&os.LinkError{Op: "link", Old: src, New: "/other", Err: syscall.ENOENT}))
+}
@@ -0,0 +1,70 @@
+package main
+
+// Chains served by node container, worked out of its NETWORK environment variable
+
+import (
+	"strings"
+
+	log "github.com/google/logger"
+)
+
+const networkEnv = "NETWORK"
+
+// networkChains NETWORK values of bitmark-node and the chain they run
+var networkChains = map[string]string{
+	"bitmark": chainBitmark,
+	"livenet": chainBitmark,
+	"testing": chainTesting,
+	"testnet": chainTesting,
+}
+
+// networkChain return the chain of a NETWORK value, empty when it is unknown
+func networkChain(network string) string {
+	return networkChains[strings.ToLower(strings.TrimSpace(network))]
+}
+
+// envValue return value of key in docker environment list, false when it is not set
+func envValue(env []string, key string) (string, bool) {
+	for _, e := range env {
+		if strings.HasPrefix(e, key+"=") {
+			return strings.TrimPrefix(e, key+"="), true
+		}
+	}
+	return "", false
+}
+
+// containerEnv return environment of a created container, variables of its image included as the daemon
+// merges them, fallback when it can not be inspected
+func (w *NodeWatcher) containerEnv(containerID string, fallback []string) []string {
+	created, err := w.DockerClient.ContainerInspect(w.BackgroundContex, containerID)
+	if err != nil || created.Config == nil {
+		log.Warning("inspect container:", containerID, " failed, chains are worked out of its create config: ", err)
+		return fallback
+	}
+	return created.Config.Env
+}
+
+// envChains return chains of data directories used by a node container of env, every chain when its network is unknown
+func (w *NodeWatcher) envChains(env []string) map[string]bool {
+	chains := map[string]bool{}
+	network, ok := envValue(env, networkEnv)
+	chain := networkChain(network)
+	for _, dir := range w.Node.DataDirs {
+		if len(chain) > 0 && dir.Chain == chain {
+			chains[chain] = true
+		}
+	}
+	if len(chains) > 0 {
+		log.Info("container:", w.ContainerName, " ", networkEnv, "=", network, " serves chain:", chain, ", databases of other chains are kept")
+		return chains
+	}
+	if ok {
+		log.Warning("container:", w.ContainerName, " ", networkEnv, "=", network, " has no data directory, databases of every chain are handled")
+	} else {
+		log.Warning("container:", w.ContainerName, " has no ", networkEnv, ", databases of every chain are handled")
+	}
+	for _, dir := range w.Node.DataDirs {
+		chains[dir.Chain] = true
+	}
+	return chains
+}
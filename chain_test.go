@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvChains(t *testing.T) {
+	assert.Equal(t, chainBitmark, networkChain("BITMARK"))
+	assert.Equal(t, chainTesting, networkChain("testing"))
+	assert.Equal(t, chainTesting, networkChain(" TESTNET "))
+	assert.Equal(t, "", networkChain("local"))
+
+	watcher, _ := mockData.getWatcher(t)
+	assert.Equal(t, map[string]bool{chainBitmark: true}, watcher.envChains([]string{"PUBLIC_IP=127.0.0.1", "NETWORK=BITMARK"}))
+	assert.Equal(t, map[string]bool{chainTesting: true}, watcher.envChains([]string{"NETWORK=TESTING"}))
+	all := map[string]bool{chainBitmark: true, chainTesting: true}
+	assert.Equal(t, all, watcher.envChains(nil), "network is unknown")
+	assert.Equal(t, all, watcher.envChains([]string{"NETWORK=local"}), "chain has no data directory")
+
+	dbs := watcher.nodeDBs(map[string]bool{chainTesting: true})
+	if assert.Len(t, dbs, 2) {
+		assert.Equal(t, chainTesting, dbs[0].Chain)
+	}
+	assert.Len(t, watcher.nodeDBs(nil), 4)
+}
+
+func TestUpdateKeepsOtherChain(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	docker.Container(watcher.ContainerName).Config.Env = []string{"NETWORK=TESTING"}
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	plan := watcher.Plan()
+	if assert.Len(t, plan.DBMoves, 2) {
+		assert.Equal(t, watcher.DataRoot+nodeDataDirTestnet+"/"+blockLevelDB, plan.DBMoves[0].From)
+	}
+
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+	_, err = runUpdate(watcher, update)
+	assert.NoError(t, err)
+	for _, db := range []string{blockLevelDB, indexLevelDB} {
+		data, err := ioutil.ReadFile(watcher.DataRoot + nodeDataDirMainnet + "/" + db + "/000005.ldb")
+		assert.NoError(t, err, "bitmark chain is kept")
+		assert.Equal(t, db, string(data))
+		_, err = os.Stat(watcher.DataRoot + nodeDataDirTestnet + "/" + db)
+		assert.True(t, os.IsNotExist(err), "testing chain is removed")
+	}
+	snapshots, err := watcher.Backups.List(watcher.ContainerName)
+	assert.NoError(t, err)
+	if assert.Len(t, snapshots, 1) {
+		for _, db := range snapshots[0].DBs {
+			assert.Equal(t, chainTesting, db.Chain)
+		}
+	}
+}
+
+func TestUpdateKeepsOtherChainOfImageNetwork(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	// NETWORK is set by the image, the cloned config leaves it out
+	docker.SetImageEnv(watcher.ImageName, []string{"NETWORK=TESTING"})
+	docker.Container(watcher.ContainerName).Config.Env = []string{"NETWORK=TESTING"}
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	docker.SetImageEnv(watcher.ImageName, []string{"NETWORK=TESTING"})
+	assert.Len(t, watcher.Plan().DBMoves, 2)
+
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+	_, err = runUpdate(watcher, update)
+	assert.NoError(t, err)
+	for _, db := range []string{blockLevelDB, indexLevelDB} {
+		_, err := os.Stat(watcher.DataRoot + nodeDataDirMainnet + "/" + db)
+		assert.NoError(t, err, "bitmark chain is kept")
+		_, err = os.Stat(watcher.DataRoot + nodeDataDirTestnet + "/" + db)
+		assert.True(t, os.IsNotExist(err), "testing chain is removed")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+// Clone configuration of the node container for the container of the new image
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+)
+
+// cloneConfig copy every field of the inspected container configuration except those derived from image.
+// Inspected fields merge old image defaults and container settings, the rules to split them are:
+//   - Image is the new image, OnBuild and ArgsEscaped belong to images only
+//   - Hostname generated from the container ID is dropped, the new container gets its own
+//   - Env, Labels, ExposedPorts and Volumes drop entries equal to the old image, the new image provides them
+//   - Entrypoint, WorkingDir, User, StopSignal, Healthcheck and Shell equal to the old image are inherited
+//   - Cmd equal to the old image is inherited unless Entrypoint is kept, docker resets image Cmd then
+//   - other fields such as Domainname, Tty, MacAddress and StopTimeout can not come from image and are kept
+//
+// oldImage nil keeps all fields, as the old image can not tell which of them it provides
+func cloneConfig(old container.Config, oldImage *container.Config, containerID, image string) *container.Config {
+	config := old
+	config.Image = image
+	config.OnBuild = nil
+	config.ArgsEscaped = false
+	if len(old.Hostname) > 0 && strings.HasPrefix(containerID, old.Hostname) {
+		config.Hostname = ""
+	}
+	if oldImage == nil {
+		return &config
+	}
+	config.Env = envNotIn(old.Env, oldImage.Env)
+	config.Labels = labelsNotIn(old.Labels, oldImage.Labels)
+	config.ExposedPorts = portsNotIn(old.ExposedPorts, oldImage.ExposedPorts)
+	config.Volumes = volumesNotIn(old.Volumes, oldImage.Volumes)
+	entrypointKept := !reflect.DeepEqual([]string(old.Entrypoint), []string(oldImage.Entrypoint))
+	if !entrypointKept {
+		config.Entrypoint = nil
+	}
+	if !entrypointKept && reflect.DeepEqual([]string(old.Cmd), []string(oldImage.Cmd)) {
+		config.Cmd = nil
+	}
+	if old.WorkingDir == oldImage.WorkingDir {
+		config.WorkingDir = ""
+	}
+	if old.User == oldImage.User {
+		config.User = ""
+	}
+	if old.StopSignal == oldImage.StopSignal {
+		config.StopSignal = ""
+	}
+	if reflect.DeepEqual(old.Healthcheck, oldImage.Healthcheck) {
+		config.Healthcheck = nil
+	}
+	if reflect.DeepEqual([]string(old.Shell), []string(oldImage.Shell)) {
+		config.Shell = nil
+	}
+	return &config
+}
+
+// envNotIn return variables of env which are not set to the same value by image
+func envNotIn(env, image []string) []string {
+	inherited := map[string]bool{}
+	for _, variable := range image {
+		inherited[variable] = true
+	}
+	kept := []string{}
+	for _, variable := range env {
+		if !inherited[variable] {
+			kept = append(kept, variable)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
+
+func labelsNotIn(labels, image map[string]string) map[string]string {
+	kept := map[string]string{}
+	for key, value := range labels {
+		if imageValue, ok := image[key]; !ok || imageValue != value {
+			kept[key] = value
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
+
+func portsNotIn(ports, image nat.PortSet) nat.PortSet {
+	kept := nat.PortSet{}
+	for port := range ports {
+		if _, ok := image[port]; !ok {
+			kept[port] = struct{}{}
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
+
+func volumesNotIn(volumes, image map[string]struct{}) map[string]struct{} {
+	kept := map[string]struct{}{}
+	for volume := range volumes {
+		if _, ok := image[volume]; !ok {
+			kept[volume] = struct{}{}
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
+
+// cloneNetworks split networks of the inspected container into the primary network to create the container on
+// and the networks to connect after create. The primary network is the network mode of the container,
+// or the first network by name when the mode is not one of them. Endpoints keep static IPs, aliases and links,
+// runtime fields are stripped and so is the alias docker adds from the container ID
+func cloneNetworks(networkMode container.NetworkMode, networks map[string]*network.EndpointSettings,
+	containerID string) (*network.NetworkingConfig, map[string]*network.EndpointSettings) {
+	primaryConfig := &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{}}
+	if len(networks) == 0 {
+		return primaryConfig, nil
+	}
+	names := []string{}
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	primary := networkMode.NetworkName()
+	if networkMode.IsDefault() {
+		primary = "bridge"
+	}
+	if _, ok := networks[primary]; !ok {
+		primary = names[0]
+	}
+	var additional map[string]*network.EndpointSettings
+	for _, name := range names {
+		endpoint := cloneEndpoint(networks[name], containerID)
+		if name == primary {
+			primaryConfig.EndpointsConfig[name] = endpoint
+			continue
+		}
+		if additional == nil {
+			additional = map[string]*network.EndpointSettings{}
+		}
+		additional[name] = endpoint
+	}
+	return primaryConfig, additional
+}
+
+// cloneEndpoint copy configuration fields of the endpoint
+func cloneEndpoint(endpoint *network.EndpointSettings, containerID string) *network.EndpointSettings {
+	cloned := &network.EndpointSettings{}
+	if endpoint == nil {
+		return cloned
+	}
+	if endpoint.IPAMConfig != nil {
+		ipam := *endpoint.IPAMConfig
+		cloned.IPAMConfig = &ipam
+	}
+	cloned.Links = append([]string(nil), endpoint.Links...)
+	for _, alias := range endpoint.Aliases {
+		if len(alias) > 0 && !strings.HasPrefix(containerID, alias) {
+			cloned.Aliases = append(cloned.Aliases, alias)
+		}
+	}
+	return cloned
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/docker/go-connections/nat"
+	"github.com/stretchr/testify/assert"
+)
+
+const cloneContainerID = "4f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0"
+
+func TestCloneConfig(t *testing.T) {
+	imageHealth := &container.HealthConfig{Test: []string{"CMD", "true"}}
+	oldImage := &container.Config{
+		Env:          []string{"PATH=/usr/bin", "NETWORK=bitmark"},
+		Labels:       map[string]string{"version": "1", "maintainer": "bitmark"},
+		ExposedPorts: nat.PortSet{"2130/tcp": {}},
+		Volumes:      map[string]struct{}{"/.config": {}},
+		Entrypoint:   strslice.StrSlice{"/entrypoint.sh"},
+		Cmd:          strslice.StrSlice{"bitmarkd"},
+		WorkingDir:   "/",
+		User:         "bitmark",
+		StopSignal:   "SIGTERM",
+		Healthcheck:  imageHealth,
+		Shell:        strslice.StrSlice{"/bin/sh", "-c"},
+		OnBuild:      []string{"RUN make"},
+	}
+	stopTimeout := 30
+	cases := []struct {
+		name     string
+		old      container.Config
+		oldImage *container.Config
+		expected container.Config
+	}{
+		{
+			name:     "image defaults are inherited",
+			old:      *oldImage,
+			oldImage: oldImage,
+			expected: container.Config{Image: "new"},
+		},
+		{
+			name: "container settings are kept",
+			old: container.Config{
+				Env:          []string{"PATH=/usr/bin", "NETWORK=testing", "PUBLIC_IP=1.2.3.4"},
+				Labels:       map[string]string{"version": "1", "maintainer": "ops", "role": "node"},
+				ExposedPorts: nat.PortSet{"2130/tcp": {}, "2136/tcp": {}},
+				Volumes:      map[string]struct{}{"/.config": {}, "/data": {}},
+				Cmd:          strslice.StrSlice{"bitmarkd", "--verbose"},
+				Entrypoint:   oldImage.Entrypoint,
+				WorkingDir:   "/home/bitmark",
+				User:         "root",
+				StopSignal:   "SIGINT",
+				Healthcheck:  &container.HealthConfig{Test: []string{"NONE"}},
+				Shell:        strslice.StrSlice{"/bin/bash", "-c"},
+			},
+			oldImage: oldImage,
+			expected: container.Config{
+				Image:        "new",
+				Env:          []string{"NETWORK=testing", "PUBLIC_IP=1.2.3.4"},
+				Labels:       map[string]string{"maintainer": "ops", "role": "node"},
+				ExposedPorts: nat.PortSet{"2136/tcp": {}},
+				Volumes:      map[string]struct{}{"/data": {}},
+				Cmd:          strslice.StrSlice{"bitmarkd", "--verbose"},
+				WorkingDir:   "/home/bitmark",
+				User:         "root",
+				StopSignal:   "SIGINT",
+				Healthcheck:  &container.HealthConfig{Test: []string{"NONE"}},
+				Shell:        strslice.StrSlice{"/bin/bash", "-c"},
+			},
+		},
+		{
+			name:     "cmd is kept with overridden entrypoint",
+			old:      container.Config{Entrypoint: strslice.StrSlice{"/bin/sh"}, Cmd: oldImage.Cmd},
+			oldImage: oldImage,
+			expected: container.Config{Image: "new", Entrypoint: strslice.StrSlice{"/bin/sh"}, Cmd: oldImage.Cmd},
+		},
+		{
+			name: "fields images can not set are kept",
+			old: container.Config{Hostname: "node", Domainname: "bitmark.com", Tty: true, OpenStdin: true,
+				AttachStdout: true, MacAddress: "02:42:ac:11:00:02", StopTimeout: &stopTimeout, NetworkDisabled: true},
+			oldImage: oldImage,
+			expected: container.Config{Image: "new", Hostname: "node", Domainname: "bitmark.com", Tty: true, OpenStdin: true,
+				AttachStdout: true, MacAddress: "02:42:ac:11:00:02", StopTimeout: &stopTimeout, NetworkDisabled: true},
+		},
+		{
+			name:     "generated hostname is dropped",
+			old:      container.Config{Hostname: cloneContainerID[:12]},
+			oldImage: oldImage,
+			expected: container.Config{Image: "new"},
+		},
+		{
+			name:     "unknown old image keeps all",
+			old:      *oldImage,
+			oldImage: nil,
+			expected: func() container.Config {
+				config := *oldImage
+				config.Image = "new"
+				config.OnBuild = nil
+				return config
+			}(),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			old := c.old
+			old.Image = "old"
+			assert.Equal(t, c.expected, *cloneConfig(old, c.oldImage, cloneContainerID, "new"))
+		})
+	}
+}
+
+func TestUpdateKeepsContainerConfig(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	stopTimeout := 60
+	node := docker.Container(watcher.ContainerName)
+	node.Config.Labels = map[string]string{"com.bitmark.role": "node"}
+	node.Config.Entrypoint = strslice.StrSlice{"/bin/sh", "-c"}
+	node.Config.Cmd = strslice.StrSlice{"start-bitmarkd"}
+	node.Config.User = "bitmark"
+	node.Config.WorkingDir = "/home/bitmark"
+	node.Config.Healthcheck = &container.HealthConfig{Test: []string{"CMD", "bitmarkd", "--info"}}
+	node.Config.StopSignal = "SIGINT"
+	node.Config.StopTimeout = &stopTimeout
+	node.Config.Hostname = "bitmark-node"
+	node.Config.Domainname = "bitmark.com"
+	node.Config.Tty = true
+	old := *node.Config
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+
+	_, err = runUpdate(watcher, update)
+	assert.NoError(t, err)
+	config := *docker.Container(watcher.ContainerName).Config
+	assert.Equal(t, watcher.ImageName+"@"+mockNewDigest, config.Image, "created from the verified digest")
+	config.Image = old.Image
+	assert.Equal(t, old, config)
+}
+
+func TestCloneNetworks(t *testing.T) {
+	static := &network.EndpointSettings{
+		IPAMConfig: &network.EndpointIPAMConfig{IPv4Address: "172.20.0.10"},
+		Aliases:    []string{"bitmarkd", cloneContainerID[:12]},
+		Links:      []string{"db:db"},
+		NetworkID:  "n1", EndpointID: "e1", IPAddress: "172.20.0.10", IPPrefixLen: 16, Gateway: "172.20.0.1", MacAddress: "02:42:ac:14:00:0a",
+	}
+	dynamic := &network.EndpointSettings{NetworkID: "n2", EndpointID: "e2", IPAddress: "172.21.0.3", IPPrefixLen: 16}
+	staticCloned := &network.EndpointSettings{
+		IPAMConfig: &network.EndpointIPAMConfig{IPv4Address: "172.20.0.10"},
+		Aliases:    []string{"bitmarkd"},
+		Links:      []string{"db:db"},
+	}
+	cases := []struct {
+		name       string
+		mode       container.NetworkMode
+		networks   map[string]*network.EndpointSettings
+		primary    map[string]*network.EndpointSettings
+		additional map[string]*network.EndpointSettings
+	}{
+		{
+			name:     "no network",
+			mode:     "container:abc",
+			primary:  map[string]*network.EndpointSettings{},
+			networks: map[string]*network.EndpointSettings{},
+		},
+		{
+			name:     "default mode is bridge",
+			mode:     "default",
+			networks: map[string]*network.EndpointSettings{"bridge": dynamic},
+			primary:  map[string]*network.EndpointSettings{"bridge": {}},
+		},
+		{
+			name:       "network mode is primary",
+			mode:       "monitoring",
+			networks:   map[string]*network.EndpointSettings{"bitmark": static, "monitoring": dynamic},
+			primary:    map[string]*network.EndpointSettings{"monitoring": {}},
+			additional: map[string]*network.EndpointSettings{"bitmark": staticCloned},
+		},
+		{
+			name:       "first network is primary when mode is not connected",
+			mode:       "default",
+			networks:   map[string]*network.EndpointSettings{"bitmark": static, "monitoring": dynamic},
+			primary:    map[string]*network.EndpointSettings{"bitmark": staticCloned},
+			additional: map[string]*network.EndpointSettings{"monitoring": {}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			primary, additional := cloneNetworks(c.mode, c.networks, cloneContainerID)
+			assert.Equal(t, c.primary, primary.EndpointsConfig)
+			assert.Equal(t, c.additional, additional)
+		})
+	}
+}
+
+// connectNetworks attach the node container to bitmark network with static IP and to monitoring network
+func connectNetworks(docker *FakeDocker, name string) {
+	node := docker.Container(name)
+	node.HostConfig.NetworkMode = "bitmark"
+	node.NetworkSettings.Networks = map[string]*network.EndpointSettings{
+		"bitmark": {IPAMConfig: &network.EndpointIPAMConfig{IPv4Address: "172.20.0.10"}, Aliases: []string{"bitmarkd", node.ID[:12]},
+			EndpointID: "e1", IPAddress: "172.20.0.10"},
+		"monitoring": {EndpointID: "e2", IPAddress: "172.21.0.3"},
+	}
+}
+
+func TestUpdateReconnectsNetworks(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	connectNetworks(docker, watcher.ContainerName)
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+
+	_, err = runUpdate(watcher, update)
+	assert.NoError(t, err)
+	node := docker.Container(watcher.ContainerName)
+	assert.Equal(t, mockNewImageID, node.Image)
+	assert.Equal(t, map[string]*network.EndpointSettings{
+		"bitmark":    {IPAMConfig: &network.EndpointIPAMConfig{IPv4Address: "172.20.0.10"}, Aliases: []string{"bitmarkd"}},
+		"monitoring": {},
+	}, node.NetworkSettings.Networks)
+}
+
+func TestNetworkConnectFailure(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	connectNetworks(docker, watcher.ContainerName)
+	oldID := docker.Container(watcher.ContainerName).ID
+	docker.FailOn("NetworkConnect", errors.New("network monitoring not found"))
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+
+	_, err = runUpdate(watcher, update)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "connect network monitoring")
+	node := docker.Container(watcher.ContainerName)
+	assert.Equal(t, oldID, node.ID)
+	assert.True(t, node.State.Running)
+	docker.lock.Lock()
+	assert.Len(t, docker.containers, 1) // created container is removed
+	docker.lock.Unlock()
+	mockData.assertDBRenamed(t, watcher, false)
+}
@@ -0,0 +1,621 @@
+package main
+
+// Watcher configuration file, flags and environment variables override values of the file
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config configuration of watcher
+type Config struct {
+	Docker   DockerConfig   `yaml:"docker"`
+	Node     NodeConfig     `yaml:"node"`
+	Nodes    []NodeOverride `yaml:"nodes"`
+	Interval IntervalConfig `yaml:"interval"`
+	Rollback RollbackConfig `yaml:"rollback"`
+	Schedule ScheduleConfig `yaml:"schedule"`
+	Policy   PolicyConfig   `yaml:"policy"`
+	Health   HealthConfig   `yaml:"health"`
+	API      APIConfig      `yaml:"api"`
+	Notify   NotifyConfig   `yaml:"notify"`
+	Journal  JournalConfig  `yaml:"journal"`
+	Backup   BackupConfig   `yaml:"backup"`
+	DB       DBConfig       `yaml:"db"`
+	Auth     AuthConfig     `yaml:"auth"`
+	Verify   VerifyConfig   `yaml:"verify"`
+	Log      LogConfig      `yaml:"log"`
+}
+
+// DockerConfig docker daemon to connect to
+type DockerConfig struct {
+	Host       string `yaml:"host"`
+	APIVersion string `yaml:"api_version"`
+}
+
+// NodeConfig node container to watch and how to create it when it does not exist
+type NodeConfig struct {
+	Image    string        `yaml:"image"`
+	Name     string        `yaml:"name"`
+	Registry string        `yaml:"registry"` // registry API URL, empty for the registry of image
+	PublicIP string        `yaml:"public_ip"`
+	Network  string        `yaml:"network"`
+	BaseDir  string        `yaml:"base_dir"`  // host directory of mount sources
+	DataRoot string        `yaml:"data_root"` // prefix of data dirs, the directories are mounted into watcher
+	Ports    []int         `yaml:"ports"`
+	Mounts   []MountConfig `yaml:"mounts"`
+	DataDirs []DataDir     `yaml:"data_dirs"`
+}
+
+// NodeOverride an entry of nodes, its fields are those of node section plus rollback, schedule, policy and health,
+// fields it does not set are inherited from the sections of the file
+type NodeOverride struct {
+	raw interface{}
+}
+
+// nodeSpecConfig fields of an entry of nodes
+type nodeSpecConfig struct {
+	NodeConfig `yaml:",inline"`
+	Rollback   RollbackConfig `yaml:"rollback"`
+	Schedule   ScheduleConfig `yaml:"schedule"`
+	Policy     PolicyConfig   `yaml:"policy"`
+	Health     HealthConfig   `yaml:"health"`
+}
+
+// NodeSpec settings of a watched node container
+type NodeSpec struct {
+	Field    string // path of the settings in configuration file
+	Node     NodeConfig
+	Rollback RollbackConfig
+	Schedule ScheduleConfig
+	Policy   PolicyConfig
+	Health   HealthConfig
+}
+
+// UnmarshalYAML keep the entry to apply it over inherited settings, unknown fields are rejected here
+func (o *NodeOverride) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var fields nodeSpecConfig
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	return unmarshal(&o.raw)
+}
+
+// MountConfig bind mount of node container, relative source is under base_dir
+type MountConfig struct {
+	Source string `yaml:"source"`
+	Target string `yaml:"target"`
+}
+
+// DataDir directory of a chain holding bitmarkd databases, as seen by watcher
+type DataDir struct {
+	Chain string `yaml:"chain"`
+	Path  string `yaml:"path"`
+}
+
+// IntervalConfig timing of the monitor loop
+type IntervalConfig struct {
+	Poll        time.Duration `yaml:"poll"`
+	StopTimeout time.Duration `yaml:"stop_timeout"`
+}
+
+// RollbackConfig configuration of RollbackPolicy
+type RollbackConfig struct {
+	GracePeriod   time.Duration `yaml:"grace_period"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+	MaxRestarts   int           `yaml:"max_restarts"`
+}
+
+// ScheduleConfig times updates may start, updates start as soon as an image is found without cron and windows
+type ScheduleConfig struct {
+	Timezone string         `yaml:"timezone"` // IANA name, UTC or Local
+	Cron     []string       `yaml:"cron"`     // standard 5 fields expressions, an update may start in matching minutes
+	Windows  []WindowConfig `yaml:"windows"`
+}
+
+// WindowConfig maintenance window
+type WindowConfig struct {
+	Days  []string `yaml:"days"`  // sun, mon, tue, wed, thu, fri, sat, empty for every day
+	Start string   `yaml:"start"` // HH:MM
+	End   string   `yaml:"end"`   // HH:MM, earlier than start when crossing midnight
+}
+
+// PolicyConfig image updates move to, the tag of image is followed by default
+type PolicyConfig struct {
+	Track          string `yaml:"track"`           // tag, semver, channel or digest
+	Constraint     string `yaml:"constraint"`      // versions of semver and channel tracks such as ~1.4, all when empty
+	Channel        string `yaml:"channel"`         // stable for releases or beta for prereleases too, of channel track
+	Digest         string `yaml:"digest"`          // sha256:... of digest track
+	ApprovedMajor  uint64 `yaml:"approved_major"`  // major version updates may move to, a higher one waits for approval
+	AllowDowngrade bool   `yaml:"allow_downgrade"` // versions lower than the running one may be the target
+}
+
+// HealthConfig health probes, no probe runs when host is empty
+type HealthConfig struct {
+	Host             string        `yaml:"host"`
+	Timeout          time.Duration `yaml:"timeout"`
+	Retries          int           `yaml:"retries"`
+	Interval         time.Duration `yaml:"interval"`
+	LivenessInterval time.Duration `yaml:"liveness_interval"`
+}
+
+// APIConfig HTTP API, disabled when listen is empty
+type APIConfig struct {
+	Listen string `yaml:"listen"` // host:port or unix:///path/to/socket
+	Token  string `yaml:"token"`  // bearer token required by all endpoints but /metrics when set
+}
+
+// JournalConfig directory of update journals, an interrupted update is not resumed when it is empty
+type JournalConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+// BackupConfig snapshots of databases saved by updates before they are reset
+type BackupConfig struct {
+	Dir       string        `yaml:"dir"`         // snapshots of a container are in its directory of dir
+	Strategy  string        `yaml:"strategy"`    // hardlink or copy
+	Keep      int           `yaml:"keep"`        // snapshots kept of a container, 0 for no limit
+	MaxAge    time.Duration `yaml:"max_age"`     // older snapshots are removed, 0 for no limit
+	MinFreeMB uint64        `yaml:"min_free_mb"` // oldest snapshots are removed while free space of dir is lower
+}
+
+// DBConfig when updates reset node databases
+type DBConfig struct {
+	Reset       string `yaml:"reset"`        // always, never or label
+	SchemaLabel string `yaml:"schema_label"` // image label of database schema version, a change resets in label mode
+}
+
+// AuthConfig registry credentials, docker config.json and its credential helpers are used
+// when username is empty
+type AuthConfig struct {
+	DockerConfig string        `yaml:"docker_config"` // empty for $DOCKER_CONFIG/config.json or ~/.docker/config.json
+	Username     string        `yaml:"username"`      // used for every registry
+	Password     string        `yaml:"password"`
+	Refresh      time.Duration `yaml:"refresh"` // credentials are looked up again after refresh
+}
+
+// VerifyConfig checks of new images before deploy, every image is deployed when nothing is set
+type VerifyConfig struct {
+	Allowlist      string   `yaml:"allowlist"`       // file of allowed digests, one per line
+	PublicKey      string   `yaml:"public_key"`      // PEM file of ECDSA or RSA key signing digests
+	Signatures     string   `yaml:"signatures"`      // directory or http(s) URL of sha256-<hex>.sig files
+	RequiredLabels []string `yaml:"required_labels"` // key or key=value
+}
+
+// NotifyConfig webhooks notified of update events
+type NotifyConfig struct {
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	Retries  int             `yaml:"retries"` // retries after the first attempt
+	Backoff  time.Duration   `yaml:"backoff"` // wait before the first retry, doubled for each retry
+	Timeout  time.Duration   `yaml:"timeout"`
+}
+
+// WebhookConfig a receiver of update events
+type WebhookConfig struct {
+	URL      string   `yaml:"url"`
+	Format   string   `yaml:"format"`   // json, slack or discord
+	Secret   string   `yaml:"secret"`   // HMAC-SHA256 key signing payload, empty to send unsigned
+	Events   []string `yaml:"events"`   // events to send, empty for all
+	Template string   `yaml:"template"` // text/template of slack and discord message
+}
+
+// LogConfig log file of watcher
+type LogConfig struct {
+	Path    string `yaml:"path"`
+	Verbose bool   `yaml:"verbose"`
+}
+
+var containerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// DefaultConfig return the configuration used when nothing is given
+func DefaultConfig() Config {
+	return Config{
+		Docker: DockerConfig{
+			Host:       "unix:///var/run/docker.sock",
+			APIVersion: dockerAPIVersion,
+		},
+		Node: NodeConfig{
+			Image:    "bitmark/bitmark-node",
+			Name:     "bitmarkNode",
+			PublicIP: "127.0.0.1",
+			Network:  "BITMARK",
+			Ports:    []int{2130, 2131, 2136, 9980},
+			Mounts: []MountConfig{
+				{Source: "db", Target: nodeConfigDir + "/db"},
+				{Source: "data", Target: nodeConfigDir + "/bitmarkd/bitmark/data"},
+				{Source: "data-test", Target: nodeConfigDir + "/bitmarkd/testing/data"},
+				{Source: "log", Target: nodeConfigDir + "/bitmarkd/bitmark/log"},
+				{Source: "log-test", Target: nodeConfigDir + "/bitmarkd/testing/log"},
+			},
+			DataDirs: []DataDir{
+				{Chain: chainBitmark, Path: nodeDataDirMainnet},
+				{Chain: chainTesting, Path: nodeDataDirTestnet},
+			},
+		},
+		Interval: IntervalConfig{
+			Poll:        pullImageInterval,
+			StopTimeout: containerStopWaitTime,
+		},
+		Rollback: RollbackConfig{
+			GracePeriod:   defaultRollbackGracePeriod,
+			CheckInterval: defaultRollbackInterval,
+			MaxRestarts:   defaultRollbackMaxRestarts,
+		},
+		Schedule: ScheduleConfig{
+			Timezone: "UTC",
+		},
+		Policy: PolicyConfig{
+			Track: trackTag,
+		},
+		Health: HealthConfig{
+			Timeout:          defaultProbeTimeout,
+			Retries:          defaultProbeRetries,
+			Interval:         defaultProbeInterval,
+			LivenessInterval: defaultLivenessInterval,
+		},
+		Notify: NotifyConfig{
+			Retries: defaultWebhookRetries,
+			Backoff: defaultWebhookBackoff,
+			Timeout: defaultWebhookTimeout,
+		},
+		Journal: JournalConfig{
+			Dir: defaultJournalDir,
+		},
+		Backup: BackupConfig{
+			Dir:      defaultBackupDir,
+			Strategy: backupStrategyHardlink,
+			Keep:     defaultBackupKeep,
+		},
+		DB: DBConfig{
+			Reset:       dbResetAlways,
+			SchemaLabel: defaultDBSchemaLabel,
+		},
+		Auth: AuthConfig{
+			Refresh: defaultAuthRefresh,
+		},
+		Log: LogConfig{
+			Path: logPath,
+		},
+	}
+}
+
+// LoadConfig read configuration file over defaults, empty path return defaults
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+	if len(path) == 0 {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, ErrCombind(ErrorConfigFile, err)
+	}
+	// lists in file replace default lists instead of being merged into them
+	config.Node.Ports, config.Node.Mounts, config.Node.DataDirs = nil, nil, nil
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return config, ErrCombind(ErrorConfigFile, fmt.Errorf("%s: %s", path, err))
+	}
+	defaults := DefaultConfig()
+	if config.Node.Ports == nil {
+		config.Node.Ports = defaults.Node.Ports
+	}
+	if config.Node.Mounts == nil {
+		config.Node.Mounts = defaults.Node.Mounts
+	}
+	if config.Node.DataDirs == nil {
+		config.Node.DataDirs = defaults.Node.DataDirs
+	}
+	return config, nil
+}
+
+// NodeSpecs return settings of node containers to watch, node section alone when nodes is empty
+func (c *Config) NodeSpecs() ([]NodeSpec, error) {
+	if len(c.Nodes) == 0 {
+		return []NodeSpec{{Node: c.Node, Rollback: c.Rollback, Schedule: c.Schedule, Policy: c.Policy, Health: c.Health}}, nil
+	}
+	specs := []NodeSpec{}
+	for i, override := range c.Nodes {
+		data, err := yaml.Marshal(override.raw)
+		if err != nil {
+			return nil, ErrCombind(ErrorConfigFile, err)
+		}
+		fields := nodeSpecConfig{NodeConfig: c.Node, Rollback: c.Rollback, Schedule: c.Schedule, Policy: c.Policy, Health: c.Health}
+		if err := yaml.UnmarshalStrict(data, &fields); err != nil {
+			return nil, ErrCombind(ErrorConfigFile, err)
+		}
+		specs = append(specs, NodeSpec{Field: fmt.Sprintf("nodes[%d]", i),
+			Node: fields.NodeConfig, Rollback: fields.Rollback, Schedule: fields.Schedule, Policy: fields.Policy, Health: fields.Health})
+	}
+	return specs, nil
+}
+
+// ApplyEnv override configuration by environment variables of node container settings and API token
+func (c *Config) ApplyEnv() {
+	if v := os.Getenv("PUBLIC_IP"); len(v) > 0 {
+		c.Node.PublicIP = v
+	}
+	if v := os.Getenv("NETWORK"); len(v) > 0 {
+		c.Node.Network = v
+	}
+	if v := os.Getenv("USER_NODE_BASE_DIR"); len(v) > 0 {
+		c.Node.BaseDir = v
+	}
+	if v := os.Getenv("WATCHER_API_TOKEN"); len(v) > 0 {
+		c.API.Token = v
+	}
+	if v := os.Getenv("REGISTRY_USERNAME"); len(v) > 0 {
+		c.Auth.Username = v
+	}
+	if v := os.Getenv("REGISTRY_PASSWORD"); len(v) > 0 {
+		c.Auth.Password = v
+	}
+}
+
+// Validate check the configuration and report all invalid fields
+func (c *Config) Validate() error {
+	problems := []string{}
+	invalid := func(field, format string, args ...interface{}) {
+		problems = append(problems, field+": "+fmt.Sprintf(format, args...))
+	}
+	if len(c.Docker.Host) == 0 {
+		invalid("docker.host", "must not be empty")
+	}
+	if c.Interval.Poll <= 0 {
+		invalid("interval.poll", "must be positive")
+	}
+	if c.Interval.StopTimeout <= 0 {
+		invalid("interval.stop_timeout", "must be positive")
+	}
+	specs, err := c.NodeSpecs()
+	if err != nil {
+		invalid("nodes", "%s", err)
+	}
+	names := make(map[string]string)
+	dataDirs := make(map[string]string)
+	for _, spec := range specs {
+		nodeField, field := "node", ""
+		if len(spec.Field) > 0 {
+			nodeField, field = spec.Field, spec.Field+"."
+		}
+		validateSpec(spec, nodeField, field, invalid)
+		if other, ok := names[spec.Node.Name]; ok {
+			invalid(nodeField+".name", "%q is used by %s", spec.Node.Name, other)
+		}
+		names[spec.Node.Name] = nodeField
+		for i, dir := range spec.Node.DataDirs {
+			path := filepath.Join(spec.Node.DataRoot, dir.Path)
+			if other, ok := dataDirs[path]; ok && other != nodeField {
+				invalid(fmt.Sprintf("%s.data_dirs[%d].path", nodeField, i), "%q is used by %s", path, other)
+			}
+			dataDirs[path] = nodeField
+		}
+	}
+	if len(c.API.Listen) > 0 && !strings.HasPrefix(c.API.Listen, unixSocketPrefix) {
+		if _, _, err := net.SplitHostPort(c.API.Listen); err != nil {
+			invalid("api.listen", "%q is neither host:port nor %s path", c.API.Listen, unixSocketPrefix)
+		}
+	}
+	if len(c.Backup.Dir) == 0 {
+		invalid("backup.dir", "must not be empty")
+	}
+	if c.Backup.Strategy != backupStrategyHardlink && c.Backup.Strategy != backupStrategyCopy {
+		invalid("backup.strategy", "%q is not one of %s, %s", c.Backup.Strategy, backupStrategyHardlink, backupStrategyCopy)
+	}
+	if c.Backup.Keep < 0 {
+		invalid("backup.keep", "must not be negative")
+	}
+	if c.Backup.MaxAge < 0 {
+		invalid("backup.max_age", "must not be negative")
+	}
+	if _, err := NewDBResetPolicy(c.DB); err != nil {
+		invalid("db.reset", "%s", err)
+	}
+	if len(c.Auth.Username) == 0 && len(c.Auth.Password) > 0 {
+		invalid("auth.username", "must not be empty when password is set")
+	}
+	if c.Auth.Refresh <= 0 {
+		invalid("auth.refresh", "must be positive")
+	}
+	if _, err := NewImageVerifier(c.Verify); err != nil {
+		invalid("verify", "%s", err)
+	}
+	if c.Notify.Retries < 0 {
+		invalid("notify.retries", "must not be negative")
+	}
+	if c.Notify.Backoff < 0 {
+		invalid("notify.backoff", "must not be negative")
+	}
+	if c.Notify.Timeout <= 0 {
+		invalid("notify.timeout", "must be positive")
+	}
+	for i, hook := range c.Notify.Webhooks {
+		field := fmt.Sprintf("notify.webhooks[%d]", i)
+		if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			invalid(field+".url", "%q is not a http(s) URL", hook.URL)
+		}
+		switch hook.Format {
+		case "", webhookFormatJSON, webhookFormatSlack, webhookFormatDiscord:
+		default:
+			invalid(field+".format", "%q is not one of json, slack, discord", hook.Format)
+		}
+		for j, event := range hook.Events {
+			if !knownEvent(event) {
+				invalid(fmt.Sprintf("%s.events[%d]", field, j), "%q is not one of %s", event, strings.Join(webhookEvents, ", "))
+			}
+		}
+		if _, err := webhookTemplate(hook); err != nil {
+			invalid(field+".template", "%s", err)
+		}
+	}
+	if len(problems) > 0 {
+		return ErrCombind(ErrorConfigInvalid, fmt.Errorf("%s", strings.Join(problems, "; ")))
+	}
+	return nil
+}
+
+// validateSpec check settings of a node container, fields of node section are under nodeField
+// and other sections are under field
+func validateSpec(spec NodeSpec, nodeField, field string, invalid func(field, format string, args ...interface{})) {
+	if len(spec.Node.Image) == 0 {
+		invalid(nodeField+".image", "must not be empty")
+	} else if _, err := ParseImageReference(spec.Node.Image); err != nil {
+		invalid(nodeField+".image", "%q is not a valid image reference: %s", spec.Node.Image, err)
+	}
+	if !containerNamePattern.MatchString(spec.Node.Name) {
+		invalid(nodeField+".name", "%q is not a valid container name", spec.Node.Name)
+	}
+	if len(spec.Node.Registry) > 0 {
+		if u, err := url.Parse(spec.Node.Registry); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			invalid(nodeField+".registry", "%q is not a http(s) URL", spec.Node.Registry)
+		}
+	}
+	if len(spec.Node.PublicIP) == 0 {
+		invalid(nodeField+".public_ip", "must not be empty")
+	}
+	if len(spec.Node.Network) == 0 {
+		invalid(nodeField+".network", "must not be empty")
+	}
+	if len(spec.Node.BaseDir) > 0 && !filepath.IsAbs(spec.Node.BaseDir) {
+		invalid(nodeField+".base_dir", "%q must be an absolute path", spec.Node.BaseDir)
+	}
+	ports := make(map[int]bool)
+	for i, port := range spec.Node.Ports {
+		if port <= 0 || port > 65535 {
+			invalid(fmt.Sprintf("%s.ports[%d]", nodeField, i), "%d is out of range", port)
+		}
+		if ports[port] {
+			invalid(fmt.Sprintf("%s.ports[%d]", nodeField, i), "%d is duplicated", port)
+		}
+		ports[port] = true
+	}
+	for i, mount := range spec.Node.Mounts {
+		if len(mount.Source) == 0 {
+			invalid(fmt.Sprintf("%s.mounts[%d].source", nodeField, i), "must not be empty")
+		}
+		if !strings.HasPrefix(mount.Target, "/") {
+			invalid(fmt.Sprintf("%s.mounts[%d].target", nodeField, i), "%q must be an absolute path", mount.Target)
+		}
+	}
+	chains := make(map[string]bool)
+	for i, dir := range spec.Node.DataDirs {
+		if len(dir.Chain) == 0 {
+			invalid(fmt.Sprintf("%s.data_dirs[%d].chain", nodeField, i), "must not be empty")
+		}
+		if chains[dir.Chain] {
+			invalid(fmt.Sprintf("%s.data_dirs[%d].chain", nodeField, i), "%q is duplicated", dir.Chain)
+		}
+		chains[dir.Chain] = true
+		if !strings.HasPrefix(dir.Path, "/") {
+			invalid(fmt.Sprintf("%s.data_dirs[%d].path", nodeField, i), "%q must be an absolute path", dir.Path)
+		}
+	}
+	if spec.Rollback.GracePeriod < 0 {
+		invalid(field+"rollback.grace_period", "must not be negative")
+	}
+	if spec.Rollback.CheckInterval <= 0 {
+		invalid(field+"rollback.check_interval", "must be positive")
+	}
+	if spec.Rollback.MaxRestarts < 0 {
+		invalid(field+"rollback.max_restarts", "must not be negative")
+	}
+	if _, err := NewUpdateSchedule(spec.Schedule); err != nil {
+		invalid(field+"schedule", "%s", err)
+	}
+	if _, err := NewUpdatePolicy(spec.Policy); err != nil {
+		invalid(field+"policy", "%s", err)
+	}
+	if spec.Health.Timeout <= 0 {
+		invalid(field+"health.timeout", "must be positive")
+	}
+	if spec.Health.Retries < 0 {
+		invalid(field+"health.retries", "must not be negative")
+	}
+	if spec.Health.Interval < 0 {
+		invalid(field+"health.interval", "must not be negative")
+	}
+	if spec.Health.LivenessInterval < 0 {
+		invalid(field+"health.liveness_interval", "must not be negative")
+	}
+}
+
+// NewWatchers build a NodeWatcher for each node container, watchers share webhooks, registry credentials
+// and image verification
+func (c *Config) NewWatchers(client DockerAPI, ctx context.Context) ([]*NodeWatcher, error) {
+	specs, err := c.NodeSpecs()
+	if err != nil {
+		return nil, err
+	}
+	var notifier *Notifier
+	if len(c.Notify.Webhooks) > 0 {
+		if notifier, err = NewNotifier(c.Notify, ctx); err != nil {
+			return nil, err
+		}
+	}
+	credentials := NewCredentialStore(c.Auth)
+	verifier, err := NewImageVerifier(c.Verify)
+	if err != nil {
+		return nil, err
+	}
+	watchers := []*NodeWatcher{}
+	for _, spec := range specs {
+		watcher, err := c.newWatcher(spec, client, ctx)
+		if err != nil {
+			return nil, err
+		}
+		watcher.Notifier = notifier
+		watcher.Credentials = credentials
+		watcher.Registry.Credentials = credentials
+		watcher.Verifier = verifier
+		watchers = append(watchers, watcher)
+	}
+	return watchers, nil
+}
+
+// newWatcher build the NodeWatcher of a node container
+func (c *Config) newWatcher(spec NodeSpec, client DockerAPI, ctx context.Context) (*NodeWatcher, error) {
+	watcher := NewNodeWatcher(client, ctx, spec.Node.Image, spec.Node.Name)
+	registryURL := spec.Node.Registry
+	if len(registryURL) == 0 {
+		registryURL = watcher.Reference.RegistryURL()
+	}
+	watcher.Registry = NewRegistryClient(registryURL)
+	watcher.Node = spec.Node
+	watcher.DataRoot = spec.Node.DataRoot
+	watcher.PollInterval = c.Interval.Poll
+	watcher.StopTimeout = c.Interval.StopTimeout
+	watcher.Rollback = RollbackPolicy{
+		GracePeriod:   spec.Rollback.GracePeriod,
+		CheckInterval: spec.Rollback.CheckInterval,
+		MaxRestarts:   spec.Rollback.MaxRestarts,
+	}
+	schedule, err := NewUpdateSchedule(spec.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	watcher.Schedule = schedule
+	if watcher.Policy, err = NewUpdatePolicy(spec.Policy); err != nil {
+		return nil, err
+	}
+	if len(c.Journal.Dir) > 0 {
+		watcher.Journal = NewJournal(c.Journal.Dir, spec.Node.Name)
+	}
+	watcher.Backups = NewBackupStore(c.Backup)
+	if watcher.DBReset, err = NewDBResetPolicy(c.DB); err != nil {
+		return nil, err
+	}
+	if len(spec.Health.Host) > 0 {
+		settings := ProbeSettings{Timeout: spec.Health.Timeout, Retries: spec.Health.Retries, Interval: spec.Health.Interval}
+		watcher.Probes = DefaultProbes(spec.Health.Host, settings)
+		watcher.LivenessInterval = spec.Health.LivenessInterval
+	}
+	return watcher, nil
+}
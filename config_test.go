@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/go-connections/nat"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(mockData.BaseDir, "config-"+t.Name()+".yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+node:
+  image: bitmark/bitmark-node-test
+  name: bitmarkNodeTest
+  base_dir: /home/bitmark/node
+  ports: [2130, 9980]
+  mounts:
+    - source: data
+      target: /.config/bitmark-node/bitmarkd/bitmark/data
+interval:
+  poll: 1m
+rollback:
+  grace_period: 90s
+health:
+  host: 172.17.0.1
+`)
+	config, err := LoadConfig(path)
+	assert.NoError(t, err)
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, "bitmark/bitmark-node-test", config.Node.Image)
+	assert.Equal(t, []int{2130, 9980}, config.Node.Ports)
+	assert.Len(t, config.Node.Mounts, 1)
+	assert.Equal(t, DefaultConfig().Node.DataDirs, config.Node.DataDirs)
+	assert.Equal(t, time.Minute, config.Interval.Poll)
+	assert.Equal(t, containerStopWaitTime, config.Interval.StopTimeout)
+	assert.Equal(t, 90*time.Second, config.Rollback.GracePeriod)
+
+	watchers, err := config.NewWatchers(NewFakeDocker(), context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, watchers, 1)
+	watcher := watchers[0]
+	assert.Equal(t, "docker.io/bitmark/bitmark-node-test:latest", watcher.Reference.String())
+	assert.Equal(t, defaultRegistryURL, watcher.Registry.BaseURL)
+	assert.Equal(t, time.Minute, watcher.PollInterval)
+	assert.Len(t, watcher.Probes, 4)
+
+	createConfig, err := getDefaultConfig(watcher)
+	assert.NoError(t, err)
+	assert.Equal(t, nat.PortSet{"2130/tcp": struct{}{}, "9980/tcp": struct{}{}}, createConfig.Config.ExposedPorts)
+	assert.Equal(t, []mount.Mount{{
+		Type:   mount.TypeBind,
+		Source: "/home/bitmark/node/data",
+		Target: "/.config/bitmark-node/bitmarkd/bitmark/data",
+	}}, createConfig.HostConfig.Mounts)
+	assert.Equal(t, []string{"PUBLIC_IP=127.0.0.1", "NETWORK=BITMARK"}, createConfig.Config.Env)
+}
+
+func TestLoadNodesConfig(t *testing.T) {
+	path := writeConfig(t, `
+node:
+  image: bitmark/bitmark-node
+  base_dir: /home/bitmark/node
+rollback:
+  grace_period: 90s
+  max_restarts: 1
+nodes:
+  - name: bitmarkNode
+    data_dirs:
+      - chain: bitmark
+        path: /.config/bitmark-node/bitmarkd/bitmark/data
+  - name: bitmarkNodeTestnet
+    network: TESTING
+    base_dir: /home/bitmark/testnet
+    data_root: /testnet
+    data_dirs:
+      - chain: testing
+        path: /.config/bitmark-node/bitmarkd/testing/data
+    rollback:
+      max_restarts: 0
+    schedule:
+      cron: ["0 3 * * *"]
+`)
+	config, err := LoadConfig(path)
+	assert.NoError(t, err)
+	assert.NoError(t, config.Validate())
+	specs, err := config.NodeSpecs()
+	assert.NoError(t, err)
+	assert.Len(t, specs, 2)
+	assert.Equal(t, "nodes[1]", specs[1].Field)
+	assert.Equal(t, "BITMARK", specs[0].Node.Network)
+	assert.Equal(t, "TESTING", specs[1].Node.Network)
+	assert.Equal(t, "bitmark/bitmark-node", specs[1].Node.Image)
+	assert.Equal(t, DefaultConfig().Node.Ports, specs[1].Node.Ports)
+	assert.Equal(t, 1, specs[0].Rollback.MaxRestarts)
+	assert.Equal(t, 0, specs[1].Rollback.MaxRestarts)
+	assert.Equal(t, 90*time.Second, specs[1].Rollback.GracePeriod)
+
+	watchers, err := config.NewWatchers(NewFakeDocker(), context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, watchers, 2)
+	assert.Equal(t, "bitmarkNode", watchers[0].ContainerName)
+	assert.Nil(t, watchers[0].Schedule)
+	assert.Equal(t, "bitmarkNodeTestnet", watchers[1].ContainerName)
+	assert.NotNil(t, watchers[1].Schedule)
+	assert.Equal(t, []string{"/testnet" + nodeDataDirTestnet}, watchers[1].dataDirs())
+	assert.Equal(t, "/home/bitmark/testnet", watchers[1].Node.BaseDir)
+}
+
+func TestValidateNodesConfig(t *testing.T) {
+	path := writeConfig(t, `
+nodes:
+  - name: bitmarkNode
+  - name: bitmarkNode
+    rollback:
+      check_interval: 0s
+`)
+	config, err := LoadConfig(path)
+	assert.NoError(t, err)
+	err = config.Validate()
+	assert.Error(t, err)
+	for _, field := range []string{"nodes[1].name", "nodes[1].data_dirs[0].path", "nodes[1].rollback.check_interval"} {
+		assert.Contains(t, err.Error(), field)
+	}
+
+	_, err = LoadConfig(writeConfig(t, `
+nodes:
+  - name: bitmarkNode
+    nmae: bitmarkNodeTestnet
+`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "nmae")
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	path := writeConfig(t, `
+node:
+  imgae: bitmark/bitmark-node
+`)
+	_, err := LoadConfig(path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "imgae")
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	_, err := LoadConfig(filepath.Join(mockData.BaseDir, "not-exist.yml"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ErrorConfigFile.Error())
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := DefaultConfig()
+	assert.NoError(t, config.Validate())
+
+	config.Node.Name = "bitmark node"
+	config.Node.Registry = "registry.local:5000"
+	config.Node.Ports = []int{2130, 2130, 70000}
+	config.Node.DataDirs = append(config.Node.DataDirs, DataDir{Chain: chainBitmark, Path: "data"})
+	config.Interval.Poll = 0
+	config.Schedule.Cron = []string{"every night"}
+	config.Notify.Webhooks = []WebhookConfig{{URL: "hooks.local", Format: "teams", Events: []string{"deployed"}, Template: "{{.Event"}}
+	config.Auth.Password = "secret"
+	config.Auth.Refresh = 0
+	config.Verify.PublicKey = "cosign.pub"
+	config.Backup.Strategy = "rsync"
+	config.DB.Reset = "sometimes"
+	err := config.Validate()
+	assert.Error(t, err)
+	for _, field := range []string{"node.name", "node.registry", "node.ports[1]", "node.ports[2]",
+		"node.data_dirs[2].chain", "node.data_dirs[2].path", "interval.poll", "schedule", "notify.webhooks[0].url",
+		"notify.webhooks[0].format", "notify.webhooks[0].events[0]", "notify.webhooks[0].template",
+		"auth.username", "auth.refresh", "verify", "backup.strategy", "db.reset"} {
+		assert.Contains(t, err.Error(), field)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	defer os.Setenv("NETWORK", mockData.Env["NETWORK"])
+	os.Setenv("NETWORK", "testing")
+	config := DefaultConfig()
+	config.ApplyEnv()
+	assert.Equal(t, "testing", config.Node.Network)
+	assert.Equal(t, mockData.BaseDir, config.Node.BaseDir)
+}
+
+func TestLoadExampleConfig(t *testing.T) {
+	config, err := LoadConfig("config.example.yml")
+	assert.NoError(t, err)
+	assert.NoError(t, config.Validate())
+	defaults := DefaultConfig()
+	defaults.Node.BaseDir = config.Node.BaseDir
+	assert.Equal(t, defaults, config)
+}
+
+func TestNodeFlagsWithNodes(t *testing.T) {
+	flags := func(args ...string) *cli.Context {
+		set := flag.NewFlagSet("watcher", flag.ContinueOnError)
+		for _, name := range []string{"config", "image", "name"} {
+			set.String(name, "", "")
+		}
+		assert.NoError(t, set.Parse(args))
+		return cli.NewContext(cli.NewApp(), set, nil)
+	}
+	single := writeConfig(t, "node:\n  name: bitmarkNode\n")
+	config, err := configFromContext(flags("--config", single, "--name", "bitmarkNodeTestnet", "--image", "bitmark/bitmark-node-test"))
+	assert.NoError(t, err)
+	assert.Equal(t, "bitmarkNodeTestnet", config.Node.Name)
+	assert.Equal(t, "bitmark/bitmark-node-test", config.Node.Image)
+
+	nodes := writeConfig(t, "nodes:\n  - name: bitmarkNode\n    image: bitmark/bitmark-node\n")
+	for _, name := range []string{"name", "image"} {
+		_, err = configFromContext(flags("--config", nodes, "--"+name, "bitmarkNodeTestnet"))
+		if assert.Error(t, err, name) {
+			assert.Contains(t, err.Error(), "--"+name)
+			assert.Contains(t, err.Error(), ErrorConfigInvalid.Error())
+		}
+	}
+	_, err = configFromContext(flags("--config", nodes))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,151 @@
+package main
+
+// Database moves applied as one transaction, either every move is done or the done ones are undone
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/google/logger"
+)
+
+// Results of DBMoveResult
+const (
+	dbMoveDone       = "moved"
+	dbMoveUndone     = "undone"      // moved, then moved back after another move failed
+	dbMoveFailed     = "failed"      // the move failing the transaction
+	dbMoveSkipped    = "not moved"   // not tried after another move failed
+	dbMoveUndoFailed = "undo failed" // moved and could not be moved back, the database is at To
+)
+
+const (
+	removingPostfix = ".removing" // a database being removed after its snapshot is complete
+	replacedPostfix = ".replaced" // a database being replaced by the one of a snapshot
+)
+
+// DBMove a rename of a database directory, Done is set once it is applied
+type DBMove struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Done bool   `json:"done"`
+}
+
+// DBMoveResult outcome of a move in a failed transaction
+type DBMoveResult struct {
+	DBMove
+	Result string
+	Err    error
+}
+
+// DBTransactionError a transaction of database moves failed, Cause is ErrorRenameDB or ErrorRecoverDB
+type DBTransactionError struct {
+	Cause   error
+	Results []DBMoveResult
+}
+
+func (e *DBTransactionError) Error() string {
+	outcomes := []string{}
+	for _, result := range e.Results {
+		outcome := fmt.Sprintf("%s => %s: %s", result.From, result.To, result.Result)
+		if result.Err != nil {
+			outcome += " (" + result.Err.Error() + ")"
+		}
+		outcomes = append(outcomes, outcome)
+	}
+	return ErrCombind(e.Cause, fmt.Errorf("%s", strings.Join(outcomes, "; "))).Error()
+}
+
+// Unwrap return Cause, ErrorRenameDB or ErrorRecoverDB
+func (e *DBTransactionError) Unwrap() error {
+	return e.Cause
+}
+
+// PathErrors return errors of the moves which failed or could not be undone by From path, such as *os.LinkError
+func (e *DBTransactionError) PathErrors() map[string]error {
+	errs := map[string]error{}
+	for _, result := range e.Results {
+		if result.Err != nil {
+			errs[result.From] = result.Err
+		}
+	}
+	return errs
+}
+
+// Consistent tell if every database is back where it was before the transaction
+func (e *DBTransactionError) Consistent() bool {
+	for _, result := range e.Results {
+		if result.Result == dbMoveUndoFailed {
+			return false
+		}
+	}
+	return true
+}
+
+// moveDBs apply moves in order, when a move fails the done moves are undone in reverse order,
+// record is called with the moves whenever one of them is done or undone
+func moveDBs(cause error, moves []DBMove, record func(moves []DBMove)) error {
+	results := make([]DBMoveResult, len(moves))
+	for i := range moves {
+		results[i] = DBMoveResult{DBMove: moves[i], Result: dbMoveSkipped}
+	}
+	failed := -1
+	for i := range moves {
+		if err := os.Rename(moves[i].From, moves[i].To); err != nil {
+			results[i].Result, results[i].Err = dbMoveFailed, err
+			failed = i
+			break
+		}
+		log.Info("move db:", moves[i].From, " => ", moves[i].To)
+		moves[i].Done = true
+		results[i].DBMove, results[i].Result = moves[i], dbMoveDone
+		if record != nil {
+			record(moves)
+		}
+	}
+	if failed < 0 {
+		return nil
+	}
+	for i := failed - 1; i >= 0; i-- {
+		if err := os.Rename(moves[i].To, moves[i].From); err != nil {
+			results[i].Result, results[i].Err = dbMoveUndoFailed, err
+			continue
+		}
+		moves[i].Done = false
+		results[i].Result = dbMoveUndone
+		if record != nil {
+			record(moves)
+		}
+	}
+	return &DBTransactionError{Cause: cause, Results: results}
+}
+
+// undoDBMoves move back the done moves of an interrupted transaction in reverse order
+func undoDBMoves(moves []DBMove) error {
+	for i := len(moves) - 1; i >= 0; i-- {
+		if !moves[i].Done {
+			continue
+		}
+		if _, err := os.Stat(moves[i].To); os.IsNotExist(err) { // already moved back
+			continue
+		}
+		if _, err := os.Stat(moves[i].From); err == nil { // a later step of the transaction put a database there
+			if err := os.RemoveAll(moves[i].From); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(moves[i].To, moves[i].From); err != nil {
+			return err
+		}
+		log.Info("undo db move:", moves[i].From, " <= ", moves[i].To)
+	}
+	return nil
+}
+
+// journalDBMoves record the moves of the running transaction, a failure is logged
+func (w *NodeWatcher) journalDBMoves(moves []DBMove) {
+	recorded := append([]DBMove{}, moves...)
+	if err := w.Journal.Update(func(entry *JournalEntry) { entry.DBTransaction = recorded }); err != nil {
+		log.Error(err)
+	}
+}
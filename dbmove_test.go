@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMoveDBs(t *testing.T) {
+	dir, err := ioutil.TempDir(mockData.BaseDir, "move")
+	assert.NoError(t, err)
+	for _, name := range []string{"a", "b", "c"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, name), 0700))
+	}
+	moves := []DBMove{
+		{From: filepath.Join(dir, "a"), To: filepath.Join(dir, "a"+removingPostfix)},
+		{From: filepath.Join(dir, "b"), To: filepath.Join(dir, "b"+removingPostfix)},
+	}
+	recorded := 0
+	assert.NoError(t, moveDBs(ErrorRenameDB, moves, func([]DBMove) { recorded++ }))
+	assert.Equal(t, 2, recorded)
+	assert.True(t, moves[0].Done && moves[1].Done)
+	assert.NoError(t, undoDBMoves(moves))
+	assert.DirExists(t, filepath.Join(dir, "a"))
+	assert.DirExists(t, filepath.Join(dir, "b"))
+
+	// the second move fails, the first one is moved back and the third one is not tried
+	moves = []DBMove{
+		{From: filepath.Join(dir, "a"), To: filepath.Join(dir, "a"+removingPostfix)},
+		{From: filepath.Join(dir, "b"), To: filepath.Join(dir, "missing", "b")},
+		{From: filepath.Join(dir, "c"), To: filepath.Join(dir, "c"+removingPostfix)},
+	}
+	err = moveDBs(ErrorRenameDB, moves, nil)
+	if assert.IsType(t, &DBTransactionError{}, err) {
+		transaction := err.(*DBTransactionError)
+		assert.True(t, transaction.Consistent())
+		results := []string{}
+		for _, result := range transaction.Results {
+			results = append(results, result.Result)
+		}
+		assert.Equal(t, []string{dbMoveUndone, dbMoveFailed, dbMoveSkipped}, results)
+		assert.Error(t, transaction.Results[1].Err)
+		assert.Equal(t, ErrorRenameDB, transaction.Unwrap())
+		pathErrors := transaction.PathErrors()
+		assert.Len(t, pathErrors, 1)
+		assert.IsType(t, &os.LinkError{}, pathErrors[filepath.Join(dir, "b")])
+	}
+	assert.Contains(t, err.Error(), filepath.Join(dir, "missing", "b"))
+	assert.Equal(t, "rename_db", errorLabel(err))
+	for _, name := range []string{"a", "b", "c"} {
+		assert.DirExists(t, filepath.Join(dir, name))
+	}
+	assert.False(t, moves[0].Done)
+}
+
+func TestResumeDBTransaction(t *testing.T) {
+	watcher, _ := getJournaledWatcher(t)
+	assert.NoError(t, watcher.Journal.Begin(watcher.ContainerName, ImageUpdate{Updated: true, NewID: mockNewImageID}))
+	moves := []DBMove{}
+	for _, db := range watcher.nodeDBs(nil) {
+		moves = append(moves, DBMove{From: db.Path, To: db.Path + removingPostfix})
+	}
+	// the watcher crashes after the first move of the transaction
+	assert.NoError(t, os.Rename(moves[0].From, moves[0].To))
+	moves[0].Done = true
+	watcher.journalDBMoves(moves)
+
+	entry, err := watcher.Journal.Load()
+	assert.NoError(t, err)
+	if assert.NotNil(t, entry) && assert.Len(t, entry.DBTransaction, len(moves)) {
+		assert.True(t, entry.DBTransaction[0].Done)
+		assert.NoError(t, undoDBMoves(entry.DBTransaction))
+		assert.NoError(t, undoDBMoves(entry.DBTransaction), "undo can be repeated")
+	}
+	mockData.assertDBRenamed(t, watcher, false)
+
+	watcher.journalDBMoves(nil)
+	entry, err = watcher.Journal.Load()
+	assert.NoError(t, err)
+	if assert.NotNil(t, entry) {
+		assert.Empty(t, entry.DBTransaction)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+// Policy deciding whether an update resets node databases, a reset saves them into a snapshot and removes them
+// so the new container syncs from scratch
+
+import (
+	"fmt"
+	"strconv"
+
+	log "github.com/google/logger"
+)
+
+// Modes of DBResetPolicy
+const (
+	dbResetAlways = "always" // every update resets databases
+	dbResetNever  = "never"  // databases are kept by every update
+	dbResetLabel  = "label"  // databases are reset when the new image declares it by its labels
+)
+
+const (
+	dbResetImageLabel    = "bitmark.db-reset"  // true on an image which needs databases of a new sync
+	defaultDBSchemaLabel = "bitmark.db-schema" // database schema version of an image
+)
+
+// DBResetPolicy when updates reset databases
+type DBResetPolicy struct {
+	Mode        string // always, never or label
+	SchemaLabel string // label of database schema version, a changed value resets databases in label mode
+}
+
+// DefaultDBResetPolicy return the policy resetting databases on every update
+func DefaultDBResetPolicy() DBResetPolicy {
+	return DBResetPolicy{Mode: dbResetAlways, SchemaLabel: defaultDBSchemaLabel}
+}
+
+// NewDBResetPolicy build policy of configuration
+func NewDBResetPolicy(config DBConfig) (DBResetPolicy, error) {
+	if !validDBReset(config.Reset) {
+		return DBResetPolicy{}, fmt.Errorf("%q is not one of %s, %s, %s", config.Reset, dbResetAlways, dbResetNever, dbResetLabel)
+	}
+	return DBResetPolicy{Mode: config.Reset, SchemaLabel: config.SchemaLabel}, nil
+}
+
+// validDBReset tell if mode is a mode of DBResetPolicy
+func validDBReset(mode string) bool {
+	return mode == dbResetAlways || mode == dbResetNever || mode == dbResetLabel
+}
+
+// Decide tell if an update from an image of oldLabels to an image of newLabels resets databases and why,
+// a non empty override replaces the mode of policy
+func (p DBResetPolicy) Decide(override string, oldLabels, newLabels map[string]string) (bool, string) {
+	mode, source := p.Mode, "db reset policy"
+	if len(override) > 0 {
+		mode, source = override, "db reset override"
+	}
+	switch mode {
+	case dbResetNever:
+		return false, source + " is " + dbResetNever
+	case dbResetLabel:
+		if reset, err := strconv.ParseBool(newLabels[dbResetImageLabel]); err == nil && reset {
+			return true, fmt.Sprintf("%s is %s and new image has %s=%s", source, mode, dbResetImageLabel, newLabels[dbResetImageLabel])
+		}
+		if len(p.SchemaLabel) > 0 {
+			if schema := newLabels[p.SchemaLabel]; len(schema) > 0 && schema != oldLabels[p.SchemaLabel] {
+				return true, fmt.Sprintf("%s is %s and %s changes from %q to %q", source, mode, p.SchemaLabel, oldLabels[p.SchemaLabel], schema)
+			}
+		}
+		return false, fmt.Sprintf("%s is %s and new image declares no reset", source, mode)
+	default:
+		return true, source + " is " + dbResetAlways
+	}
+}
+
+// imageLabels return labels of a local image, empty when it can not be inspected
+func (w *NodeWatcher) imageLabels(imageID string) map[string]string {
+	image, _, err := w.DockerClient.ImageInspectWithRaw(w.BackgroundContex, imageID)
+	if err != nil || image.Config == nil || image.Config.Labels == nil {
+		return map[string]string{}
+	}
+	return image.Config.Labels
+}
+
+// decideDBReset set ResetDB of update by db reset policy and its override, the decision is logged
+func (w *NodeWatcher) decideDBReset(update *ImageUpdate) string {
+	reset, reason := w.DBReset.Decide(update.DBReset, w.imageLabels(update.OldID), w.imageLabels(update.NewID))
+	update.ResetDB = reset
+	if reset {
+		log.Info("databases of container:", w.ContainerName, " are reset by update to ", update.NewID, ": ", reason)
+	} else {
+		log.Info("databases of container:", w.ContainerName, " are kept by update to ", update.NewID, ": ", reason)
+	}
+	return reason
+}
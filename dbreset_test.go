@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDBResetPolicy(t *testing.T) {
+	v1 := map[string]string{defaultDBSchemaLabel: "1"}
+	v2 := map[string]string{defaultDBSchemaLabel: "2"}
+	declared := map[string]string{dbResetImageLabel: "true"}
+	cases := []struct {
+		mode      string
+		override  string
+		oldLabels map[string]string
+		newLabels map[string]string
+		reset     bool
+	}{
+		{mode: dbResetAlways, oldLabels: v1, newLabels: v1, reset: true},
+		{mode: dbResetNever, oldLabels: v1, newLabels: v2, reset: false},
+		{mode: dbResetNever, newLabels: declared, reset: false},
+		{mode: dbResetLabel, oldLabels: v1, newLabels: v1, reset: false},
+		{mode: dbResetLabel, oldLabels: v1, newLabels: v2, reset: true},
+		{mode: dbResetLabel, oldLabels: map[string]string{}, newLabels: v1, reset: true},
+		{mode: dbResetLabel, oldLabels: v1, newLabels: map[string]string{}, reset: false},
+		{mode: dbResetLabel, newLabels: declared, reset: true},
+		{mode: dbResetLabel, newLabels: map[string]string{dbResetImageLabel: "false"}, reset: false},
+		{mode: dbResetLabel, override: dbResetAlways, oldLabels: v1, newLabels: v1, reset: true},
+		{mode: dbResetAlways, override: dbResetNever, oldLabels: v1, newLabels: v2, reset: false},
+	}
+	for _, c := range cases {
+		policy := DBResetPolicy{Mode: c.mode, SchemaLabel: defaultDBSchemaLabel}
+		reset, reason := policy.Decide(c.override, c.oldLabels, c.newLabels)
+		assert.Equal(t, c.reset, reset, "%+v", c)
+		assert.NotEmpty(t, reason)
+	}
+
+	_, err := NewDBResetPolicy(DBConfig{Reset: "sometimes"})
+	assert.Error(t, err)
+	policy, err := NewDBResetPolicy(DBConfig{Reset: dbResetLabel, SchemaLabel: "schema"})
+	assert.NoError(t, err)
+	assert.Equal(t, DBResetPolicy{Mode: dbResetLabel, SchemaLabel: "schema"}, policy)
+}
+
+func TestUpdateKeepsDB(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	watcher.DBReset.Mode = dbResetLabel
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	exit, err := UpdateOnce(watcher)
+	assert.NoError(t, err)
+	assert.Equal(t, exitUpdated, exit)
+	mockData.assertDBRenamed(t, watcher, false)
+	if history := watcher.status.updates(); assert.Len(t, history, 1) {
+		assert.False(t, history[0].ResetDB)
+		assert.Contains(t, history[0].DBReset, "declares no reset")
+	}
+
+	// the image declares a reset
+	docker.PublishImage(watcher.ImageName, "declared", mockVersionDigest(1))
+	docker.LabelImage(watcher.ImageName, map[string]string{dbResetImageLabel: "true"})
+	exit, err = UpdateOnce(watcher)
+	assert.NoError(t, err)
+	assert.Equal(t, exitUpdated, exit)
+	mockData.assertDBRenamed(t, watcher, true)
+	if history := watcher.status.updates(); assert.Len(t, history, 2) {
+		assert.True(t, history[1].ResetDB)
+	}
+}
+
+func TestUpdateDBResetOverride(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	watcher.status.requestDBReset(dbResetNever)
+	exit, err := UpdateOnce(watcher)
+	assert.NoError(t, err)
+	assert.Equal(t, exitUpdated, exit)
+	mockData.assertDBRenamed(t, watcher, false)
+	if history := watcher.status.updates(); assert.Len(t, history, 1) {
+		assert.Contains(t, history[0].DBReset, "override is never")
+	}
+	assert.Empty(t, watcher.status.takeDBReset(), "override is for one update")
+
+	plan := watcher.Plan()
+	assert.Len(t, plan.DBMoves, 2*len(watcher.dataDirs()))
+	watcher.DBReset.Mode = dbResetNever
+	plan = watcher.Plan()
+	assert.Equal(t, dbResetNever, plan.DBReset)
+	assert.Empty(t, plan.DBMoves)
+}
+
+func TestAPIUpdateDBReset(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	watcher.PollInterval = time.Hour
+	server := httptest.NewServer(NewAPIServer([]*NodeWatcher{watcher}, "").Handler())
+	defer server.Close()
+	resp := apiRequest(t, server, http.MethodPost, "/update?db_reset=sometimes", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	go StartMonitor(watcher)
+	deadline := time.Now().Add(5 * time.Second)
+	for lastPoll, _ := watcher.status.poll(); lastPoll.IsZero() && time.Now().Before(deadline); lastPoll, _ = watcher.status.poll() {
+		time.Sleep(time.Millisecond)
+	}
+	// a check finding no image keeps the requested mode for the next update
+	firstPoll, _ := watcher.status.poll()
+	resp = apiRequest(t, server, http.MethodPost, "/update?db_reset=never", "")
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	for lastPoll, _ := watcher.status.poll(); !lastPoll.After(firstPoll) && time.Now().Before(deadline); lastPoll, _ = watcher.status.poll() {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Empty(t, watcher.status.updates())
+	assert.Equal(t, dbResetNever, watcher.Status().DBReset)
+
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	resp = apiRequest(t, server, http.MethodPost, "/update", "")
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	for time.Now().Before(deadline) {
+		if updates := watcher.status.updates(); len(updates) > 0 {
+			assert.Equal(t, updateSucceeded, updates[0].Result)
+			assert.False(t, updates[0].ResetDB)
+			assert.Contains(t, updates[0].DBReset, "override is never")
+			assert.Empty(t, watcher.status.requestedDBReset())
+			mockData.assertDBRenamed(t, watcher, false)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("update is not triggered")
+}
@@ -3,13 +3,15 @@ package main
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 var ( // Error variable
 	// Directory Error
 	ErrorUserNodeDirEnv = errors.New("User input node base directory not found")
 	ErrorRenameDB       = errors.New("rename db failed")
-	ErrorRecoverDB      = errors.New("rename db failed")
+	ErrorRecoverDB      = errors.New("recover db failed")
+	ErrorBackupDB       = errors.New("backup db failed")
 	// Process Error
 	ErrorGetAPIFail              = errors.New("Get Docker API failed")
 	ErrorStartMonitorService     = errors.New("StartMonitor failed")
@@ -22,14 +24,85 @@ var ( // Error variable
 	ErrorContainerStop          = errors.New("Container stop failed")
 	ErrorConfigCreateNew        = errors.New("Create a new Config error")
 	ErrorNamedContainerNotFound = errors.New("Named container is not found")
+	ErrorContainerExited        = errors.New("Container exited")
+	ErrorContainerRestarting    = errors.New("Container restarts repeatedly")
+	ErrorContainerUnhealthy     = errors.New("Container is unhealthy")
+	ErrorRollback               = errors.New("Rollback container failed")
+	ErrorNoPreviousContainer    = errors.New("No previous container to rollback to")
+	// Health Errors
+	ErrorHealthCheck = errors.New("Health check failed")
+	ErrorLiveness    = errors.New("Liveness check failed")
 	// Image Errors
 	ErrorImagePull             = errors.New("Image pull failed")
 	ErrorGetContainerWithImage = errors.New("Get container with image failed")
+	ErrorImageUnverified       = errors.New("Image verification failed")
+	// Registry Errors
+	ErrorRegistryQuery = errors.New("Registry manifest query failed")
+	ErrorRegistryAuth  = errors.New("Registry authorization failed")
+
+	// Config Errors
+	ErrorConfigFile    = errors.New("Read config file failed")
+	ErrorConfigInvalid = errors.New("Invalid config")
+
+	// API Errors
+	ErrorAPIListen       = errors.New("API server listen failed")
+	ErrorAPIUnauthorized = errors.New("Unauthorized")
+
+	// Schedule Errors
+	ErrorSchedule = errors.New("Invalid update schedule")
+
+	// Notify Errors
+	ErrorWebhook = errors.New("Webhook delivery failed")
+
+	// Journal Errors
+	ErrorJournal = errors.New("Update journal failed")
 
 	// NodeWatcher Errors
+	ErrorShutdown      = errors.New("Watcher is shutting down")
 	ErrorCreateWatcher = errors.New("Create NodeWatcher failed")
 )
 
 func ErrCombind(cause, detail error) error {
 	return fmt.Errorf("%s-%s", cause, detail)
 }
+
+// errorLabels short names of sentinel errors used as metric labels
+var errorLabels = map[error]string{
+	ErrorImagePull:              "image_pull",
+	ErrorRegistryQuery:          "registry_query",
+	ErrorRegistryAuth:           "registry_auth",
+	ErrorNamedContainerNotFound: "container_not_found",
+	ErrorGetContainerWithImage:  "container_list",
+	ErrorImageUnverified:        "image_unverified",
+	ErrorRenameDB:               "rename_db",
+	ErrorRecoverDB:              "recover_db",
+	ErrorBackupDB:               "backup_db",
+	ErrorContainerCreate:        "container_create",
+	ErrorContainerStart:         "container_start",
+	ErrorContainerStop:          "container_stop",
+	ErrorContainerExited:        "container_exited",
+	ErrorContainerRestarting:    "container_restarting",
+	ErrorContainerUnhealthy:     "container_unhealthy",
+	ErrorHealthCheck:            "health_check",
+	ErrorRollback:               "rollback",
+	ErrorShutdown:               "shutdown",
+}
+
+// errorLabel return label of the innermost sentinel error combined into err, "unknown" if there is none
+func errorLabel(err error) string {
+	message := err.Error()
+	label, position := "unknown", -1
+	for sentinel, name := range errorLabels {
+		i := strings.LastIndex(message, sentinel.Error())
+		if i < 0 || (i > 0 && message[i-1] != '-') {
+			continue
+		}
+		if end := i + len(sentinel.Error()); end < len(message) && message[end] != '-' {
+			continue
+		}
+		if i > position {
+			label, position = name, i
+		}
+	}
+	return label
+}
@@ -0,0 +1,526 @@
+package main
+
+// In-memory docker daemon for tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+type fakeNotFoundError struct {
+	kind string
+	id   string
+}
+
+func (e fakeNotFoundError) Error() string {
+	return fmt.Sprintf("Error: No such %s: %s", e.kind, e.id)
+}
+
+// NotFound makes docker client.IsErrNotFound family recognize the error
+func (e fakeNotFoundError) NotFound() bool {
+	return true
+}
+
+// FakeDocker implements DockerAPI in memory
+type FakeDocker struct {
+	lock       sync.Mutex
+	containers []*types.ContainerJSON
+	images     map[string]types.ImageInspect // image ID -> image
+	tags       map[string]string             // local reference -> image ID
+	remote     map[string]types.ImageInspect // reference -> image in registry
+	failures   map[string]error              // method -> error to return
+	failOnce   map[string]error              // method -> error to return on next call only
+	hooks      map[string]func(c *types.ContainerJSON)
+	pullAuth   string // RegistryAuth required by ImagePull, empty for anonymous pulls
+	calls      []string
+	nextID     int
+}
+
+// NewFakeDocker create an empty fake daemon
+func NewFakeDocker() *FakeDocker {
+	return &FakeDocker{
+		images:   make(map[string]types.ImageInspect),
+		tags:     make(map[string]string),
+		remote:   make(map[string]types.ImageInspect),
+		failures: make(map[string]error),
+		failOnce: make(map[string]error),
+		hooks:    make(map[string]func(c *types.ContainerJSON)),
+	}
+}
+
+// FailOn make every following call of method return err, nil err to clear
+func (f *FakeDocker) FailOn(method string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err == nil {
+		delete(f.failures, method)
+		return
+	}
+	f.failures[method] = err
+}
+
+// FailNext make the next call of method return err
+func (f *FakeDocker) FailNext(method string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failOnce[method] = err
+}
+
+// Hook run fn on the container after method changes it, it simulates what happens in the container
+func (f *FakeDocker) Hook(method string, fn func(c *types.ContainerJSON)) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.hooks[method] = fn
+}
+
+// RequirePullAuth make ImagePull reject pulls without the encoded credentials, as a private registry does
+func (f *FakeDocker) RequirePullAuth(encoded string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.pullAuth = encoded
+}
+
+// runHook lock must be held
+func (f *FakeDocker) runHook(method string, c *types.ContainerJSON) {
+	if fn, ok := f.hooks[method]; ok {
+		fn(c)
+	}
+}
+
+// Calls return the called methods in order
+func (f *FakeDocker) Calls() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+// PublishImage put an image with id into the fake registry for ref
+func (f *FakeDocker) PublishImage(ref, id, digest string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ref = fakeNormalizeRef(ref)
+	f.remote[ref] = types.ImageInspect{
+		ID:          id,
+		RepoTags:    []string{fakeFamiliar(ref)},
+		RepoDigests: []string{fakeRepository(ref) + "@" + digest},
+		Config:      &container.Config{Image: ref},
+	}
+}
+
+// LabelImage set labels of the image published for ref
+func (f *FakeDocker) LabelImage(ref string, labels map[string]string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ref = fakeNormalizeRef(ref)
+	image := f.remote[ref]
+	image.Config = &container.Config{Image: ref, Labels: labels}
+	f.remote[ref] = image
+}
+
+// SetImageEnv set ENV of the image published for ref and of its local copy
+func (f *FakeDocker) SetImageEnv(ref string, env []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ref = fakeNormalizeRef(ref)
+	image := f.remote[ref]
+	config := *image.Config
+	config.Env = env
+	image.Config = &config
+	f.remote[ref] = image
+	if id, ok := f.tags[ref]; ok && id == image.ID {
+		f.images[id] = image
+	}
+}
+
+// AddImage store an image locally as if it was pulled
+func (f *FakeDocker) AddImage(ref, id, digest string) {
+	f.PublishImage(ref, id, digest)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.tag(fakeNormalizeRef(ref), f.remote[fakeNormalizeRef(ref)])
+}
+
+// tag store image locally under ref, the tag is removed from the image it pointed to, lock must be held
+func (f *FakeDocker) tag(ref string, image types.ImageInspect) {
+	if oldID, ok := f.tags[ref]; ok && oldID != image.ID {
+		old := f.images[oldID]
+		tags := []string{}
+		for _, tag := range old.RepoTags {
+			if tag != fakeFamiliar(ref) {
+				tags = append(tags, tag)
+			}
+		}
+		old.RepoTags = tags
+		f.images[oldID] = old
+	}
+	f.images[image.ID] = image
+	f.tags[ref] = image.ID
+	for _, digest := range image.RepoDigests {
+		f.tags[fakeNormalizeRef(digest)] = image.ID
+	}
+}
+
+// AddContainer create a container from a local image with the state
+func (f *FakeDocker) AddContainer(name, image, state string) string {
+	body, _ := f.ContainerCreate(context.Background(), &container.Config{Image: image}, &container.HostConfig{}, nil, name)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c := f.find(body.ID)
+	c.State.Status = state
+	c.State.Running = state == containerStateRunning
+	f.calls = nil
+	return body.ID
+}
+
+// Container return the container by name or id
+func (f *FakeDocker) Container(nameOrID string) *types.ContainerJSON {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.find(nameOrID)
+}
+
+// call record method, a cancelled ctx fails the call as the docker client does
+func (f *FakeDocker) call(ctx context.Context, method string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls = append(f.calls, method)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err, ok := f.failOnce[method]; ok {
+		delete(f.failOnce, method)
+		return err
+	}
+	return f.failures[method]
+}
+
+// find lookup container by name, full id or id prefix, lock must be held
+func (f *FakeDocker) find(nameOrID string) *types.ContainerJSON {
+	name := "/" + strings.TrimPrefix(nameOrID, "/")
+	for _, c := range f.containers {
+		if c.Name == name || c.ID == nameOrID {
+			return c
+		}
+	}
+	for _, c := range f.containers {
+		if len(nameOrID) >= 10 && strings.HasPrefix(c.ID, nameOrID) {
+			return c
+		}
+	}
+	return nil
+}
+
+// ContainerList implements DockerAPI
+func (f *FakeDocker) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	if err := f.call(ctx, "ContainerList"); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	list := []types.Container{}
+	for _, c := range f.containers {
+		if !options.All && !c.State.Running {
+			continue
+		}
+		image := c.Config.Image
+		if id, ok := f.tags[fakeNormalizeRef(image)]; ok && id != c.Image { // tag is moved, docker lists the ID
+			image = c.Image
+		}
+		list = append(list, types.Container{
+			ID:      c.ID,
+			Names:   []string{c.Name},
+			Image:   image,
+			ImageID: c.Image,
+			State:   c.State.Status,
+		})
+	}
+	return list, nil
+}
+
+// ContainerInspect implements DockerAPI
+func (f *FakeDocker) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	if err := f.call(ctx, "ContainerInspect"); err != nil {
+		return types.ContainerJSON{}, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c := f.find(containerID)
+	if c == nil {
+		return types.ContainerJSON{}, fakeNotFoundError{"container", containerID}
+	}
+	f.runHook("ContainerInspect", c)
+	state := *c.State
+	inspect := *c
+	inspect.ContainerJSONBase = &types.ContainerJSONBase{}
+	*inspect.ContainerJSONBase = *c.ContainerJSONBase
+	inspect.State = &state
+	return inspect, nil
+}
+
+// ContainerCreate implements DockerAPI
+func (f *FakeDocker) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig,
+	networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error) {
+	if err := f.call(ctx, "ContainerCreate"); err != nil {
+		return container.ContainerCreateCreatedBody{}, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.find(containerName) != nil {
+		return container.ContainerCreateCreatedBody{}, fmt.Errorf("Conflict. The container name %q is already in use", containerName)
+	}
+	imageID, ok := f.tags[fakeNormalizeRef(config.Image)]
+	if !ok {
+		imageID, ok = f.digested(config.Image)
+	}
+	if !ok {
+		if _, ok := f.images[config.Image]; !ok {
+			return container.ContainerCreateCreatedBody{}, fakeNotFoundError{"image", config.Image}
+		}
+		imageID = config.Image
+	}
+	config = withImageEnv(config, f.images[imageID].Config)
+	f.nextID++
+	id := fmt.Sprintf("%064x", f.nextID)
+	networks := map[string]*network.EndpointSettings{}
+	if networkingConfig != nil && networkingConfig.EndpointsConfig != nil {
+		if len(networkingConfig.EndpointsConfig) > 1 {
+			return container.ContainerCreateCreatedBody{}, fmt.Errorf("Container cannot be connected to network endpoints: %d", len(networkingConfig.EndpointsConfig))
+		}
+		for name, endpoint := range networkingConfig.EndpointsConfig {
+			networks[name] = endpoint
+		}
+	}
+	c := &types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         id,
+			Name:       "/" + containerName,
+			Image:      imageID,
+			State:      &types.ContainerState{Status: "created"},
+			HostConfig: hostConfig,
+		},
+		Config:          config,
+		NetworkSettings: &types.NetworkSettings{Networks: networks},
+	}
+	f.containers = append(f.containers, c)
+	f.runHook("ContainerCreate", c)
+	return container.ContainerCreateCreatedBody{ID: id}, nil
+}
+
+// withImageEnv add variables of image which config does not set, as the daemon does on create
+func withImageEnv(config *container.Config, image *container.Config) *container.Config {
+	if image == nil || len(image.Env) == 0 {
+		return config
+	}
+	merged := *config
+	merged.Env = append([]string{}, config.Env...)
+	for _, variable := range image.Env {
+		key := strings.SplitN(variable, "=", 2)[0]
+		if _, ok := envValue(config.Env, key); !ok {
+			merged.Env = append(merged.Env, variable)
+		}
+	}
+	return &merged
+}
+
+// ContainerStart implements DockerAPI
+func (f *FakeDocker) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	if err := f.call(ctx, "ContainerStart"); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c := f.find(containerID)
+	if c == nil {
+		return fakeNotFoundError{"container", containerID}
+	}
+	c.State.Status = containerStateRunning
+	c.State.Running = true
+	c.State.StartedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	f.runHook("ContainerStart", c)
+	return nil
+}
+
+// ContainerStop implements DockerAPI
+func (f *FakeDocker) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+	if err := f.call(ctx, "ContainerStop"); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c := f.find(containerID)
+	if c == nil {
+		return fakeNotFoundError{"container", containerID}
+	}
+	c.State.Status = "exited"
+	c.State.Running = false
+	f.runHook("ContainerStop", c)
+	return nil
+}
+
+// ContainerRename implements DockerAPI
+func (f *FakeDocker) ContainerRename(ctx context.Context, containerID, newContainerName string) error {
+	if err := f.call(ctx, "ContainerRename"); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c := f.find(containerID)
+	if c == nil {
+		return fakeNotFoundError{"container", containerID}
+	}
+	if other := f.find(newContainerName); other != nil && other != c {
+		return fmt.Errorf("Conflict. The container name %q is already in use", newContainerName)
+	}
+	c.Name = "/" + strings.TrimPrefix(newContainerName, "/")
+	f.runHook("ContainerRename", c)
+	return nil
+}
+
+// NetworkConnect implements DockerAPI
+func (f *FakeDocker) NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+	if err := f.call(ctx, "NetworkConnect"); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c := f.find(containerID)
+	if c == nil {
+		return fakeNotFoundError{"container", containerID}
+	}
+	if _, ok := c.NetworkSettings.Networks[networkID]; ok {
+		return fmt.Errorf("endpoint with name %s already exists in network %s", strings.TrimPrefix(c.Name, "/"), networkID)
+	}
+	c.NetworkSettings.Networks[networkID] = config
+	f.runHook("NetworkConnect", c)
+	return nil
+}
+
+// ContainerRemove implements DockerAPI
+func (f *FakeDocker) ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error {
+	if err := f.call(ctx, "ContainerRemove"); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i, c := range f.containers {
+		if c == f.find(containerID) {
+			if c.State.Running && !options.Force {
+				return fmt.Errorf("You cannot remove a running container %s", c.ID)
+			}
+			f.containers = append(f.containers[:i], f.containers[i+1:]...)
+			return nil
+		}
+	}
+	return fakeNotFoundError{"container", containerID}
+}
+
+// ImagePull implements DockerAPI
+func (f *FakeDocker) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	if err := f.call(ctx, "ImagePull"); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	required := f.pullAuth
+	f.lock.Unlock()
+	auth := options.RegistryAuth
+	if auth != required && options.PrivilegeFunc != nil { // docker client retries once with new credentials
+		var err error
+		if auth, err = options.PrivilegeFunc(); err != nil {
+			return nil, err
+		}
+	}
+	if auth != required {
+		return nil, fmt.Errorf("unauthorized: authentication required")
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ref = fakeNormalizeRef(ref)
+	image, ok := f.remote[ref]
+	for _, published := range f.remote { // pull by digest
+		for _, digest := range published.RepoDigests {
+			if !ok && fakeNormalizeRef(digest) == ref {
+				image, ok = published, true
+			}
+		}
+	}
+	if !ok {
+		return ioutil.NopCloser(strings.NewReader(`{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}`)), nil
+	}
+	f.tag(ref, image)
+	return ioutil.NopCloser(strings.NewReader(`{"status":"Pulling from ` + ref + `"}` + "\n" + `{"status":"Digest: ` + image.RepoDigests[0] + `"}`)), nil
+}
+
+// ImageInspectWithRaw implements DockerAPI
+func (f *FakeDocker) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	if err := f.call(ctx, "ImageInspectWithRaw"); err != nil {
+		return types.ImageInspect{}, nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if id, ok := f.tags[fakeNormalizeRef(imageID)]; ok {
+		imageID = id
+	}
+	image, ok := f.images[imageID]
+	if !ok {
+		return types.ImageInspect{}, nil, fakeNotFoundError{"image", imageID}
+	}
+	return image, nil, nil
+}
+
+// digested return ID of the local image of a reference pinned by digest, lock must be held
+func (f *FakeDocker) digested(ref string) (string, bool) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", false
+	}
+	digested, ok := named.(reference.Digested)
+	if !ok {
+		return "", false
+	}
+	repoDigest := reference.FamiliarName(named) + "@" + digested.Digest().String()
+	for id, image := range f.images {
+		for _, d := range image.RepoDigests {
+			if d == repoDigest {
+				return id, true
+			}
+		}
+	}
+	return "", false
+}
+
+// fakeNormalizeRef return reference in full form with default tag, image IDs are kept
+func fakeNormalizeRef(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	return reference.TagNameOnly(named).String()
+}
+
+// fakeFamiliar return reference in the short form docker uses in RepoTags
+func fakeFamiliar(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	return reference.FamiliarString(named)
+}
+
+// fakeRepository return repository of reference in the short form docker uses in RepoDigests
+func fakeRepository(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	return reference.FamiliarName(named)
+}
@@ -0,0 +1,316 @@
+package main
+
+// Health probes of the services served by bitmark-node container
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/google/logger"
+)
+
+const (
+	defaultProbeTimeout  = 5 * time.Second
+	defaultProbeRetries  = 5
+	defaultProbeInterval = 10 * time.Second
+	// defaultLivenessInterval interval of health check while node runs
+	defaultLivenessInterval = 5 * time.Minute
+	bitmarkdRPCPort         = "2130"
+	bitmarkdPeerPort        = "2136"
+	bitmarkdPublishPort     = "2131"
+	nodeWebUIPort           = "9980"
+	bitmarkdInfoMethod      = "Node.Info"
+)
+
+// HealthProbe check a service of the node once
+type HealthProbe interface {
+	Name() string
+	Settings() ProbeSettings
+	Check(ctx context.Context) error
+}
+
+// ProbeSettings timeout of each check and retries before a probe fails
+type ProbeSettings struct {
+	Timeout  time.Duration
+	Retries  int
+	Interval time.Duration // wait between retries
+}
+
+// DefaultProbeSettings return settings which give a restarted node time to serve
+func DefaultProbeSettings() ProbeSettings {
+	return ProbeSettings{Timeout: defaultProbeTimeout, Retries: defaultProbeRetries, Interval: defaultProbeInterval}
+}
+
+// ProbeResult result of the last run of a probe
+type ProbeResult struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// TCPProbe check a port accepts connection
+type TCPProbe struct {
+	Address string
+	ProbeSettings
+}
+
+// Name implements HealthProbe
+func (p TCPProbe) Name() string {
+	return "tcp " + p.Address
+}
+
+// Settings implements HealthProbe
+func (p TCPProbe) Settings() ProbeSettings {
+	return p.ProbeSettings
+}
+
+// Check implements HealthProbe
+func (p TCPProbe) Check(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// HTTPProbe check a GET request is answered with 2xx or 3xx
+type HTTPProbe struct {
+	URL string
+	ProbeSettings
+}
+
+// Name implements HealthProbe
+func (p HTTPProbe) Name() string {
+	return "http " + p.URL
+}
+
+// Settings implements HealthProbe
+func (p HTTPProbe) Settings() ProbeSettings {
+	return p.ProbeSettings
+}
+
+// Check implements HealthProbe
+func (p HTTPProbe) Check(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, p.URL, nil)
+	if err != nil {
+		return err
+	}
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("GET %s: %s", p.URL, resp.Status)
+	}
+	return nil
+}
+
+// RPCProbe call a JSON-RPC method of bitmarkd and expect a result without error
+type RPCProbe struct {
+	Address string
+	Method  string
+	TLS     bool // bitmarkd serves RPC over TLS with self-signed certificate
+	ProbeSettings
+}
+
+type rpcRequest struct {
+	ID     int           `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	ID     int              `json:"id"`
+	Result *json.RawMessage `json:"result"`
+	Error  interface{}      `json:"error"`
+}
+
+// Name implements HealthProbe
+func (p RPCProbe) Name() string {
+	return "rpc " + p.Address + " " + p.Method
+}
+
+// Settings implements HealthProbe
+func (p RPCProbe) Settings() ProbeSettings {
+	return p.ProbeSettings
+}
+
+// Check implements HealthProbe
+func (p RPCProbe) Check(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return err
+	}
+	if p.TLS {
+		conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	request := rpcRequest{ID: 1, Method: p.Method, Params: []interface{}{struct{}{}}}
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return err
+	}
+	var response rpcResponse
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&response); err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return fmt.Errorf("%s: %v", p.Method, response.Error)
+	}
+	if response.Result == nil {
+		return fmt.Errorf("%s: empty result", p.Method)
+	}
+	return nil
+}
+
+// DefaultProbes return the probes of ports published by getDefaultConfig on host
+func DefaultProbes(host string, settings ProbeSettings) []HealthProbe {
+	return []HealthProbe{
+		TCPProbe{Address: net.JoinHostPort(host, bitmarkdPeerPort), ProbeSettings: settings},
+		TCPProbe{Address: net.JoinHostPort(host, bitmarkdPublishPort), ProbeSettings: settings},
+		HTTPProbe{URL: "http://" + net.JoinHostPort(host, nodeWebUIPort) + "/", ProbeSettings: settings},
+		RPCProbe{Address: net.JoinHostPort(host, bitmarkdRPCPort), Method: bitmarkdInfoMethod, TLS: true, ProbeSettings: settings},
+	}
+}
+
+// runProbe check the probe until it succeeds or retries are used up
+func runProbe(ctx context.Context, probe HealthProbe) ProbeResult {
+	settings := probe.Settings()
+	timeout := settings.Timeout
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	var err error
+	for attempt := 0; attempt <= settings.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ProbeResult{Name: probe.Name(), Error: ctx.Err().Error(), CheckedAt: time.Now()}
+			case <-time.After(settings.Interval):
+			}
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, timeout)
+		err = probe.Check(checkCtx)
+		cancel()
+		if err == nil {
+			return ProbeResult{Name: probe.Name(), Healthy: true, CheckedAt: time.Now()}
+		}
+		log.Info("probe:", probe.Name(), " attempt:", attempt, " error:", err)
+	}
+	return ProbeResult{Name: probe.Name(), Error: err.Error(), CheckedAt: time.Now()}
+}
+
+// runProbes run probes concurrently, error is returned if any of them fails
+func runProbes(ctx context.Context, probes []HealthProbe) ([]ProbeResult, error) {
+	results := make([]ProbeResult, len(probes))
+	var wg sync.WaitGroup
+	for i, probe := range probes {
+		wg.Add(1)
+		go func(i int, probe HealthProbe) {
+			defer wg.Done()
+			results[i] = runProbe(ctx, probe)
+		}(i, probe)
+	}
+	wg.Wait()
+	for _, result := range results {
+		if !result.Healthy {
+			return results, ErrCombind(ErrorHealthCheck, fmt.Errorf("%s: %s", result.Name, result.Error))
+		}
+	}
+	return results, nil
+}
+
+// checkHealth run watcher's probes and keep the results
+func (w *NodeWatcher) checkHealth() error {
+	if len(w.Probes) == 0 {
+		return nil
+	}
+	results, err := runProbes(w.BackgroundContex, w.Probes)
+	w.setProbeResults(results)
+	return err
+}
+
+// healthState results of the last health checks, the ones of updates are kept apart from liveness ones
+type healthState struct {
+	lock     sync.Mutex
+	results  []ProbeResult
+	liveness []ProbeResult
+}
+
+func (w *NodeWatcher) setProbeResults(results []ProbeResult) {
+	w.health.lock.Lock()
+	defer w.health.lock.Unlock()
+	w.health.results = results
+}
+
+func (w *NodeWatcher) setLivenessResults(results []ProbeResult) {
+	w.health.lock.Lock()
+	defer w.health.lock.Unlock()
+	w.health.liveness = results
+}
+
+// ProbeResults return results of the last health check of an update
+func (w *NodeWatcher) ProbeResults() []ProbeResult {
+	w.health.lock.Lock()
+	defer w.health.lock.Unlock()
+	return append([]ProbeResult{}, w.health.results...)
+}
+
+// LivenessResults return results of the last liveness check
+func (w *NodeWatcher) LivenessResults() []ProbeResult {
+	w.health.lock.Lock()
+	defer w.health.lock.Unlock()
+	return append([]ProbeResult{}, w.health.liveness...)
+}
+
+// checkLiveness run watcher's probes against the running node, it is skipped while an update or rollback
+// replaces the container
+func (w *NodeWatcher) checkLiveness() {
+	if len(w.Probes) == 0 {
+		return
+	}
+	if w.status.operating() {
+		log.Info("liveness check of container:", w.ContainerName, " is skipped, an update or rollback runs")
+		return
+	}
+	results, err := runProbes(w.BackgroundContex, w.Probes)
+	w.setLivenessResults(results)
+	if err != nil {
+		log.Warning(ErrCombind(ErrorLiveness, err))
+		return
+	}
+	log.Info("node container is healthy")
+}
+
+// livenessRoutine check health of the running node periodically
+func livenessRoutine(w *NodeWatcher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.BackgroundContex.Done():
+			return
+		case <-ticker.C:
+			w.checkLiveness()
+		}
+	}
+}
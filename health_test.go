@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testProbeSettings = ProbeSettings{Timeout: time.Second, Retries: 2, Interval: time.Millisecond}
+
+// stubProbe fails until it has been checked failures times
+type stubProbe struct {
+	failures int
+	checked  int
+}
+
+func (p *stubProbe) Name() string            { return "stub" }
+func (p *stubProbe) Settings() ProbeSettings { return testProbeSettings }
+func (p *stubProbe) Check(ctx context.Context) error {
+	p.checked++
+	if p.checked <= p.failures {
+		return errors.New("not ready")
+	}
+	return nil
+}
+
+// serveRPC answer bitmarkd style JSON-RPC requests on listener
+func serveRPC(t *testing.T, listener net.Listener, fail bool) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			var request rpcRequest
+			if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&request); err != nil {
+				return
+			}
+			assert.Equal(t, bitmarkdInfoMethod, request.Method)
+			if fail {
+				conn.Write([]byte(`{"id":1,"result":null,"error":"not synchronised"}` + "\n"))
+				return
+			}
+			conn.Write([]byte(`{"id":1,"result":{"chain":"bitmark","mode":"Normal"},"error":null}` + "\n"))
+		}(conn)
+	}
+}
+
+func TestTCPProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	probe := TCPProbe{Address: listener.Addr().String(), ProbeSettings: testProbeSettings}
+	result := runProbe(context.Background(), probe)
+	assert.True(t, result.Healthy)
+
+	listener.Close()
+	result = runProbe(context.Background(), probe)
+	assert.False(t, result.Healthy)
+	assert.NotEmpty(t, result.Error)
+}
+
+func TestHTTPProbe(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	probe := HTTPProbe{URL: server.URL, ProbeSettings: testProbeSettings}
+	assert.True(t, runProbe(context.Background(), probe).Healthy)
+	status = http.StatusBadGateway
+	assert.False(t, runProbe(context.Background(), probe).Healthy)
+}
+
+func TestRPCProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go serveRPC(t, listener, false)
+	probe := RPCProbe{Address: listener.Addr().String(), Method: bitmarkdInfoMethod, ProbeSettings: testProbeSettings}
+	assert.True(t, runProbe(context.Background(), probe).Healthy)
+
+	failListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer failListener.Close()
+	go serveRPC(t, failListener, true)
+	probe.Address = failListener.Addr().String()
+	result := runProbe(context.Background(), probe)
+	assert.False(t, result.Healthy)
+	assert.Contains(t, result.Error, "not synchronised")
+}
+
+func TestRPCProbeTLS(t *testing.T) {
+	// borrow the self-signed certificate of httptest
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server.TLS)
+	assert.NoError(t, err)
+	defer listener.Close()
+	go serveRPC(t, listener, false)
+	probe := RPCProbe{Address: listener.Addr().String(), Method: bitmarkdInfoMethod, TLS: true, ProbeSettings: testProbeSettings}
+	assert.True(t, runProbe(context.Background(), probe).Healthy)
+}
+
+func TestProbeRetries(t *testing.T) {
+	probe := &stubProbe{failures: 2}
+	assert.True(t, runProbe(context.Background(), probe).Healthy)
+	assert.Equal(t, 3, probe.checked)
+
+	probe = &stubProbe{failures: 3}
+	assert.False(t, runProbe(context.Background(), probe).Healthy)
+	assert.Equal(t, 3, probe.checked)
+}
+
+func TestRunUpdateHealthCheck(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	oldID := docker.Container(watcher.ContainerName).ID
+	watcher.Probes = []HealthProbe{&stubProbe{failures: 10}}
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+
+	_, err = runUpdate(watcher, update)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ErrorHealthCheck.Error())
+	assert.Equal(t, oldID, docker.Container(watcher.ContainerName).ID)
+	mockData.assertDBRenamed(t, watcher, false)
+	results := watcher.ProbeResults()
+	assert.Len(t, results, 1)
+	assert.False(t, results[0].Healthy)
+}
+
+func TestLivenessCheck(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	probe := &stubProbe{}
+	watcher.Probes = []HealthProbe{probe}
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+	_, err = runUpdate(watcher, update)
+	assert.NoError(t, err)
+	checked := probe.checked
+
+	// a failing liveness check does not replace the results of the update
+	probe.failures = probe.checked + 10
+	watcher.checkLiveness()
+	if results := watcher.ProbeResults(); assert.Len(t, results, 1) {
+		assert.True(t, results[0].Healthy)
+	}
+	if results := watcher.LivenessResults(); assert.Len(t, results, 1) {
+		assert.False(t, results[0].Healthy)
+	}
+	assert.Equal(t, checked+testProbeSettings.Retries+1, probe.checked)
+
+	// no liveness check runs while an update replaces the container
+	checked = probe.checked
+	watcher.status.beginOperation()
+	watcher.checkLiveness()
+	watcher.status.endOperation()
+	assert.Equal(t, checked, probe.checked)
+	assert.False(t, watcher.status.operating())
+}
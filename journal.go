@@ -0,0 +1,272 @@
+package main
+
+// On-disk journal of updates, an update interrupted by a crash is completed or rolled back on startup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+	log "github.com/google/logger"
+)
+
+// States of an update in the order they are recorded
+const (
+	journalStarted     = "started"      // nothing is changed
+	journalStopping    = "stopping"     // old container is being stopped
+	journalOldStopped  = "old_stopped"  // old container is stopped
+	journalOldRenamed  = "old_renamed"  // old container is renamed with postfix
+	journalCreated     = "created"      // new container is created
+	journalDBMoving    = "db_moving"    // databases are being saved into a snapshot
+	journalDBSaved     = "db_saved"     // snapshot is complete, databases are being removed
+	journalDBMoved     = "db_moved"     // databases are removed
+	journalStarting    = "starting"     // new container is being started, it may write databases
+	journalNewStarted  = "new_started"  // new container is started and being watched
+	journalRollingBack = "rolling_back" // rollback is in progress
+)
+
+const defaultJournalDir = watcherStateDir + "/journal"
+
+// JournalEntry an update in progress
+type JournalEntry struct {
+	Container      string        `json:"container"`
+	State          string        `json:"state"`
+	Update         ImageUpdate   `json:"update"`
+	OldContainerID string        `json:"old_container_id,omitempty"`
+	NewContainerID string        `json:"new_container_id,omitempty"`
+	Snapshot       string        `json:"snapshot,omitempty"`       // snapshot holding the databases, set when it is complete
+	DBTransaction  []DBMove      `json:"db_transaction,omitempty"` // database moves in progress, undone on resume
+	NewStarted     bool          `json:"new_started"`              // new container may have written databases
+	StartedAt      time.Time     `json:"started_at"`
+	Steps          []JournalStep `json:"steps"`
+}
+
+// JournalStep a state change of an entry
+type JournalStep struct {
+	State string    `json:"state"`
+	At    time.Time `json:"at"`
+}
+
+// Journal persist the update in progress of a container, nil journal records nothing
+type Journal struct {
+	lock  sync.Mutex
+	path  string
+	entry *JournalEntry
+}
+
+// NewJournal create journal of container in dir, dir is created by the first update
+func NewJournal(dir, containerName string) *Journal {
+	return &Journal{path: filepath.Join(dir, containerName+".json")}
+}
+
+// Begin record a new update, nothing must be changed when it fails
+func (j *Journal) Begin(containerName string, update ImageUpdate) error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	now := time.Now()
+	j.entry = &JournalEntry{Container: containerName, State: journalStarted, Update: update, StartedAt: now,
+		Steps: []JournalStep{{State: journalStarted, At: now}}}
+	return j.save()
+}
+
+// Step record state of the update after change is applied to the entry
+func (j *Journal) Step(state string, change func(entry *JournalEntry)) error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.entry == nil {
+		return nil
+	}
+	if change != nil {
+		change(j.entry)
+	}
+	j.entry.State = state
+	j.entry.Steps = append(j.entry.Steps, JournalStep{State: state, At: time.Now()})
+	return j.save()
+}
+
+// Update apply change to the entry without recording a step
+func (j *Journal) Update(change func(entry *JournalEntry)) error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.entry == nil {
+		return nil
+	}
+	change(j.entry)
+	return j.save()
+}
+
+// Finish remove the entry of a completed or rolled back update
+func (j *Journal) Finish() error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.entry = nil
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return ErrCombind(ErrorJournal, err)
+	}
+	return nil
+}
+
+// Load read the entry of an interrupted update, nil when there is none
+func (j *Journal) Load() (*JournalEntry, error) {
+	if j == nil {
+		return nil, nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	data, err := ioutil.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, ErrCombind(ErrorJournal, err)
+	}
+	entry := &JournalEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, ErrCombind(ErrorJournal, fmt.Errorf("%s: %s", j.path, err))
+	}
+	j.entry = entry
+	copied := *entry
+	return &copied, nil
+}
+
+// save write entry to a temporary file and rename it over the journal, lock must be held
+func (j *Journal) save() error {
+	data, err := json.MarshalIndent(j.entry, "", "  ")
+	if err != nil {
+		return ErrCombind(ErrorJournal, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return ErrCombind(ErrorJournal, err)
+	}
+	if err := writeFileSynced(j.path, data); err != nil {
+		return ErrCombind(ErrorJournal, err)
+	}
+	return nil
+}
+
+// journalStep record a step of the running update, a failure is logged and the update goes on
+func (w *NodeWatcher) journalStep(state string, change func(entry *JournalEntry)) {
+	if err := w.Journal.Step(state, change); err != nil {
+		log.Error(err)
+	}
+}
+
+// finishJournal remove the journal of the completed update
+func (w *NodeWatcher) finishJournal() {
+	if err := w.Journal.Finish(); err != nil {
+		log.Error(err)
+	}
+}
+
+// resumeUpdate finish the update interrupted by a crash, the new container is kept only when it was started
+// and still passes watch and health checks, otherwise the update is rolled back
+func (w *NodeWatcher) resumeUpdate() error {
+	entry, err := w.Journal.Load()
+	if err != nil || entry == nil {
+		return err
+	}
+	w.status.beginOperation()
+	defer w.status.endOperation()
+	log.Warning("resume update of container:", w.ContainerName, " interrupted at state:", entry.State)
+	update := entry.Update
+	update.Trigger = triggerResume
+	record := UpdateRecord{Container: w.ContainerName, Trigger: triggerResume, StartedAt: time.Now(),
+		OldImageID: update.OldID, OldDigest: update.OldDigest, NewImageID: update.NewID, NewDigest: update.NewDigest}
+	defer func() {
+		record.FinishedAt = time.Now()
+		w.status.recordUpdate(record)
+		w.metrics.recordUpdate(record)
+	}()
+
+	if entry.State == journalNewStarted {
+		err = w.watchContainer(entry.NewContainerID)
+		if err == nil {
+			err = w.checkHealth()
+		}
+		if err == nil {
+			record.Result = updateSucceeded
+			w.unpinImage()
+			w.notify(eventUpdateSucceeded, update, nil)
+			return w.Journal.Finish()
+		}
+		record.Error = err.Error()
+		if !w.shuttingDown() {
+			w.pinImage(update)
+		}
+	} else {
+		record.Error = "interrupted at " + entry.State
+	}
+	w.journalStep(journalRollingBack, nil)
+	if rollbackErr := w.detached().resumeRollback(entry); rollbackErr != nil {
+		record.Result = updateFailed
+		record.Error += "; " + rollbackErr.Error()
+		w.notify(eventUpdateFailed, update, rollbackErr)
+		return rollbackErr // journal is kept to retry on next start
+	}
+	record.Result = updateRolledBack
+	w.notify(eventRollback, update, err)
+	return w.Journal.Finish()
+}
+
+// resumeRollback bring back the state before the journaled update, it can be repeated
+func (w *NodeWatcher) resumeRollback(entry *JournalEntry) error {
+	// a container holding node name which is not the old one is created by the update, recorded or not
+	if named, err := w.DockerClient.ContainerInspect(w.BackgroundContex, w.ContainerName); err == nil && named.ID != entry.OldContainerID {
+		if err := w.forceRemoveContainer(named.ID); err != nil {
+			return ErrCombind(ErrorRollback, err)
+		}
+	}
+	if len(entry.NewContainerID) > 0 {
+		if err := w.forceRemoveContainer(entry.NewContainerID); err != nil && !client.IsErrContainerNotFound(err) {
+			return ErrCombind(ErrorRollback, err)
+		}
+	}
+	if err := undoDBMoves(entry.DBTransaction); err != nil {
+		return ErrCombind(ErrorRecoverDB, err)
+	}
+	w.journalDBMoves(nil)
+	if len(entry.Snapshot) > 0 { // databases are in place until the snapshot is complete
+		snapshot, err := w.Backups.Load(w.ContainerName, entry.Snapshot)
+		if err != nil {
+			return ErrCombind(ErrorRecoverDB, err)
+		}
+		if err := w.restoreDB(snapshot); err != nil {
+			return err
+		}
+		w.notify(eventDBRestored, ImageUpdate{}, nil)
+	}
+	if len(entry.OldContainerID) == 0 { // node container is brand new
+		return nil
+	}
+	old, err := w.DockerClient.ContainerInspect(w.BackgroundContex, entry.OldContainerID)
+	if err != nil {
+		return ErrCombind(ErrorRollback, err)
+	}
+	if old.Name != "/"+w.ContainerName {
+		if err := w.DockerClient.ContainerRename(w.BackgroundContex, old.ID, w.ContainerName); err != nil {
+			return ErrCombind(ErrorRollback, err)
+		}
+	}
+	if err := w.startContainer(old.ID); err != nil {
+		return ErrCombind(ErrorRollback, err)
+	}
+	log.Info("resumed rollback of container:", w.ContainerName, " to ", old.ID)
+	return nil
+}
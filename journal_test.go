@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// getJournaledWatcher return a watcher journaling its updates in a new directory
+func getJournaledWatcher(t *testing.T) (*NodeWatcher, *FakeDocker) {
+	watcher, docker := mockData.getWatcher(t)
+	dir, err := ioutil.TempDir(mockData.BaseDir, "journal")
+	assert.NoError(t, err)
+	watcher.Journal = NewJournal(dir, watcher.ContainerName)
+	return watcher, docker
+}
+
+// restartWatcher return the watcher of a new process on the same daemon, data and journal
+func restartWatcher(t *testing.T, crashed *NodeWatcher, docker *FakeDocker) *NodeWatcher {
+	watcher := NewNodeWatcher(docker, context.Background(), crashed.ImageName, crashed.ContainerName)
+	watcher.Rollback = crashed.Rollback
+	watcher.DataRoot = crashed.DataRoot
+	watcher.Node.BaseDir = crashed.Node.BaseDir
+	watcher.Backups = crashed.Backups
+	watcher.Journal = NewJournal(filepath.Dir(crashed.Journal.path), crashed.ContainerName)
+	return watcher
+}
+
+// crashUpdate run an update which panics in the hook of method on a container of image
+func crashUpdate(t *testing.T, watcher *NodeWatcher, docker *FakeDocker, method, image string, inContainer func()) {
+	crashing := true
+	docker.Hook(method, func(c *types.ContainerJSON) {
+		if method == "ContainerInspect" && c.State.Status == "created" {
+			return // the created container is inspected for its environment before it starts
+		}
+		if crashing && c.Image == image {
+			crashing = false
+			if inContainer != nil {
+				inContainer()
+			}
+			panic("watcher crashed")
+		}
+	})
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+	defer func() {
+		assert.NotNil(t, recover(), "update is not interrupted")
+	}()
+	runUpdate(watcher, update)
+}
+
+func TestJournal(t *testing.T) {
+	watcher, _ := getJournaledWatcher(t)
+	journal := watcher.Journal
+	entry, err := journal.Load()
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+
+	update := ImageUpdate{Updated: true, NewID: mockNewImageID, NewDigest: mockNewDigest, Trigger: triggerPoll}
+	assert.NoError(t, journal.Begin(watcher.ContainerName, update))
+	assert.NoError(t, journal.Step(journalCreated, func(entry *JournalEntry) { entry.NewContainerID = "new" }))
+	entry, err = (&Journal{path: journal.path}).Load()
+	assert.NoError(t, err)
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, journalCreated, entry.State)
+		assert.Equal(t, "new", entry.NewContainerID)
+		assert.Equal(t, mockNewDigest, entry.Update.NewDigest)
+		assert.Len(t, entry.Steps, 2)
+	}
+
+	assert.NoError(t, journal.Finish())
+	_, err = os.Stat(journal.path)
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, journal.Step(journalDBMoved, nil)) // no update is running
+	_, err = os.Stat(journal.path)
+	assert.True(t, os.IsNotExist(err))
+
+	var nilJournal *Journal
+	assert.NoError(t, nilJournal.Begin(watcher.ContainerName, update))
+	entry, err = nilJournal.Load()
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+}
+
+func TestResumeRollback(t *testing.T) {
+	cases := []struct {
+		name   string
+		method string
+		image  string
+		state  string
+		newDB  bool // new container creates databases before the crash
+	}{
+		{name: "stop", method: "ContainerStop", image: mockOldImageID, state: journalStopping},
+		{name: "rename", method: "ContainerRename", image: mockOldImageID, state: journalOldStopped},
+		{name: "create", method: "ContainerCreate", image: mockNewImageID, state: journalOldRenamed},
+		{name: "start", method: "ContainerStart", image: mockNewImageID, state: journalStarting},
+		{name: "start with new db", method: "ContainerStart", image: mockNewImageID, state: journalStarting, newDB: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			watcher, docker := getJournaledWatcher(t)
+			oldID := docker.Container(watcher.ContainerName).ID
+			var inContainer func()
+			if c.newDB {
+				inContainer = func() {
+					for _, dir := range watcher.dataDirs() {
+						assert.NoError(t, os.MkdirAll(dir+"/"+blockLevelDB, 0700))
+					}
+				}
+			}
+			crashUpdate(t, watcher, docker, c.method, c.image, inContainer)
+			entry, err := watcher.Journal.Load()
+			assert.NoError(t, err)
+			if assert.NotNil(t, entry) {
+				assert.Equal(t, c.state, entry.State)
+			}
+
+			restarted := restartWatcher(t, watcher, docker)
+			assert.NoError(t, restarted.resumeUpdate())
+			node := docker.Container(watcher.ContainerName)
+			if assert.NotNil(t, node) {
+				assert.Equal(t, oldID, node.ID)
+				assert.True(t, node.State.Running)
+			}
+			assert.Nil(t, docker.Container(watcher.ContainerName+watcher.Postfix))
+			mockData.assertDBRenamed(t, restarted, false)
+			history := restarted.status.updates()
+			if assert.Len(t, history, 1) {
+				assert.Equal(t, triggerResume, history[0].Trigger)
+				assert.Equal(t, updateRolledBack, history[0].Result)
+			}
+			entry, err = restarted.Journal.Load()
+			assert.NoError(t, err)
+			assert.Nil(t, entry)
+		})
+	}
+}
+
+func TestResumeStartedUpdate(t *testing.T) {
+	for _, healthy := range []bool{true, false} {
+		watcher, docker := getJournaledWatcher(t)
+		oldID := docker.Container(watcher.ContainerName).ID
+		crashUpdate(t, watcher, docker, "ContainerInspect", mockNewImageID, nil)
+		entry, err := watcher.Journal.Load()
+		assert.NoError(t, err)
+		if assert.NotNil(t, entry) {
+			assert.Equal(t, journalNewStarted, entry.State)
+		}
+		if !healthy {
+			docker.Container(watcher.ContainerName).State.Running = false
+		}
+
+		restarted := restartWatcher(t, watcher, docker)
+		if healthy {
+			assert.NoError(t, restarted.resumeUpdate())
+			assert.Equal(t, mockNewImageID, docker.Container(watcher.ContainerName).Image)
+			mockData.assertDBRenamed(t, restarted, true)
+			assert.Equal(t, updateSucceeded, restarted.status.updates()[0].Result)
+		} else {
+			assert.NoError(t, restarted.resumeUpdate())
+			assert.Equal(t, oldID, docker.Container(watcher.ContainerName).ID)
+			mockData.assertDBRenamed(t, restarted, false)
+			assert.Equal(t, updateRolledBack, restarted.status.updates()[0].Result)
+			assert.Equal(t, mockNewDigest, restarted.pinnedImage().NewDigest)
+		}
+		entry, err = restarted.Journal.Load()
+		assert.NoError(t, err)
+		assert.Nil(t, entry)
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/docker/docker/client"
 	log "github.com/google/logger"
@@ -20,13 +22,19 @@ const (
 )
 
 func main() {
+	// -v is verbose
+	cli.VersionFlag = cli.BoolFlag{Name: "version", Usage: "print the version"}
 	// assign it to the standard logger
 	app := cli.NewApp()
 	app.Name = "bitmark-node-updater"
 	app.Version = version + " - " + commit + " - " + date
 	app.Usage = "Automatically update running bitmark-node container"
-	app.Before = before
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config, c",
+			Usage:  "YAML configuration file, flags and environment variables override its values",
+			EnvVar: "WATCHER_CONFIG",
+		},
 		cli.StringFlag{
 			Name:   "host, H",
 			Usage:  "daemon socket to connect to",
@@ -36,73 +44,361 @@ func main() {
 
 		cli.StringFlag{
 			Name:  "image, i",
-			Usage: "image name to pull",
+			Usage: "image name to pull, not allowed with nodes of configuration file",
 			Value: "bitmark/bitmark-node",
 		},
+		cli.StringFlag{
+			Name:   "registry, r",
+			Usage:  "registry base URL to query image digest",
+			Value:  defaultRegistryURL,
+			EnvVar: "REGISTRY_URL",
+		},
 		cli.StringFlag{
 			Name:  "name, n",
-			Usage: "container name to create",
+			Usage: "container name to create, not allowed with nodes of configuration file",
 			Value: "bitmarkNode",
 		},
+		cli.DurationFlag{
+			Name:  "rollback-grace",
+			Usage: "time to watch the new container before the update is considered successful",
+			Value: defaultRollbackGracePeriod,
+		},
+		cli.IntFlag{
+			Name:  "rollback-restarts",
+			Usage: "restarts of the new container allowed during grace period",
+			Value: defaultRollbackMaxRestarts,
+		},
+		cli.StringFlag{
+			Name:   "health-host",
+			Usage:  "host to probe node ports after update, empty to disable health probes",
+			EnvVar: "HEALTH_HOST",
+		},
+		cli.DurationFlag{
+			Name:  "liveness-interval",
+			Usage: "interval of health probes while node runs, 0 to disable",
+			Value: defaultLivenessInterval,
+		},
+		cli.StringFlag{
+			Name:  "api-listen",
+			Usage: "address of HTTP status API, host:port or unix:///path/to/socket, empty to disable",
+		},
 		cli.BoolFlag{
 			Name:  "verbose, v",
 			Usage: "log level",
 		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print what the next update would do and exit, same as plan command",
+		},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:  "update",
+			Usage: "update node containers, exit codes of --once: 0 no update, 1 invalid flags or configuration, 2 updated, 3 update failed and rolled back, 4 update failed and not recovered, 5 new image refused by verification, 6 shutdown before the update, 7 image check failed",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "once",
+					Usage: "run a single check and update cycle and exit",
+				},
+				cli.StringFlag{
+					Name:  "db-reset",
+					Usage: "databases reset by the update of --once: always, never or label, empty for db.reset of configuration",
+				},
+			},
+			Action: updateAction,
+		},
+		{
+			Name:  "plan",
+			Usage: "print what the next update of each node would do without changing docker or files",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print plans as JSON instead of diff",
+				},
+				cli.StringFlag{
+					Name:  "db-reset",
+					Usage: "plan with db reset mode always, never or label, empty for db.reset of configuration",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return planAction(c, c.Bool("json"))
+			},
+		},
+		{
+			Name:      "restore",
+			Usage:     "stop node container, replace its databases with a snapshot and start it again",
+			ArgsUsage: "<snapshot>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "list",
+					Usage: "list snapshots of each node and exit",
+				},
+			},
+			Action: restoreAction,
+		},
 	}
 
 	app.Action = func(c *cli.Context) error {
-		logfile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
-		if err != nil {
-			fmt.Printf("error opening file: %v", err)
+		if c.GlobalBool("dry-run") {
+			return planAction(c, false)
 		}
-		verbose := c.GlobalBool("verbose")
-		log.Init("bitmark-node-updater-log", verbose, false, logfile)
+		return monitorAction(c)
+	}
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
 
-		defer logfile.Close()
+// monitorAction watch node containers until SIGTERM or SIGINT
+func monitorAction(c *cli.Context) error {
+	config, err := configFromContext(c)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	logfile := openLog(config)
+	defer logfile.Close()
+	watchers, err := newWatchers(config, signalContext())
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	for _, watcher := range watchers {
+		if len(watcher.Probes) > 0 && watcher.LivenessInterval > 0 {
+			go livenessRoutine(watcher, watcher.LivenessInterval)
+		}
+	}
+	if len(config.API.Listen) > 0 {
+		go func() {
+			if err := NewAPIServer(watchers, config.API.Token).ListenAndServe(config.API.Listen); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
 
-		ctx := context.Background()
-		client, err := client.NewEnvClient()
-		if err != nil {
-			log.Error(ErrorGetAPIFail)
-			return err
+	log.Info("Start Monitor host:", config.Docker.Host, " containers:", len(watchers))
+	StartMonitors(watchers)
+	waitNotifications(watchers)
+	log.Info("Shutdown complete")
+	return nil
+}
+
+// updateAction run a single update cycle of every node when once is set, otherwise watch them
+func updateAction(c *cli.Context) error {
+	dbReset, err := dbResetFlag(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitInvalid)
+	}
+	if !c.Bool("once") {
+		if len(dbReset) > 0 {
+			return cli.NewExitError("--db-reset requires --once, use db.reset of configuration for every update", exitInvalid)
 		}
-		// Create a Docker API Client and current Context
-		dockerImage := c.GlobalString("image")
-		dockerRepo := "docker.io/" + dockerImage
-		containerName := c.GlobalString("name")
-		watcher := NodeWatcher{DockerClient: client, BackgroundContex: ctx,
-			Repo: dockerRepo, ImageName: dockerImage, ContainerName: containerName, Postfix: oldDBPostfix}
-
-		err = StartMonitor(watcher)
+		return monitorAction(c)
+	}
+	config, err := configFromContext(c)
+	if err != nil {
+		fmt.Println(err)
+		return cli.NewExitError("", exitInvalid)
+	}
+	logfile := openLog(config)
+	defer logfile.Close()
+	watchers, err := newWatchers(config, signalContext())
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err.Error(), exitInvalid)
+	}
+	exit := exitNoUpdate
+	for _, watcher := range watchers {
+		watcher.status.requestDBReset(dbReset)
+		code, err := UpdateOnce(watcher)
 		if err != nil {
-			log.Errorf(ErrorStartMonitorService.Error(), " image name:", watcher.ImageName)
-			return err
+			log.Error(err, " container:", watcher.ContainerName)
 		}
-		log.Info("Start Monitor host:", c.GlobalString("host"), "image:", c.GlobalString("image"))
-		return nil
+		log.Info("update once container:", watcher.ContainerName, " exit code:", code)
+		exit = worseExit(exit, code)
 	}
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+	waitNotifications(watchers)
+	if exit != exitNoUpdate {
+		return cli.NewExitError("", exit)
+	}
+	return nil
+}
+
+// openLog initialize logger writing to the log file, it logs to stderr only if the file can not be opened
+func openLog(config Config) *os.File {
+	logfile, err := os.OpenFile(config.Log.Path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		fmt.Printf("error opening file: %v", err)
+	}
+	log.Init("bitmark-node-updater-log", config.Log.Verbose, false, logfile)
+	return logfile
+}
+
+// waitNotifications deliver queued webhooks before exit, watchers share the notifier
+func waitNotifications(watchers []*NodeWatcher) {
+	if len(watchers) > 0 && watchers[0].Notifier != nil {
+		if !watchers[0].Notifier.Wait(webhookWaitTimeout) {
+			log.Warning("webhook events are not delivered in ", webhookWaitTimeout, ", they are dropped")
+		}
 	}
 }
 
-func before(c *cli.Context) error {
+// newWatchers connect to docker daemon and build watchers of configured nodes, docker calls are cancelled with ctx
+func newWatchers(config Config, ctx context.Context) ([]*NodeWatcher, error) {
 	// configure environment vars for client
-	err := envConfig(c)
+	if err := envConfig(config); err != nil {
+		return nil, err
+	}
+	client, err := client.NewEnvClient()
+	if err != nil {
+		return nil, ErrCombind(ErrorGetAPIFail, err)
+	}
+	return config.NewWatchers(client, ctx)
+}
+
+// dbResetFlag return mode of --db-reset, empty when it is not given
+func dbResetFlag(c *cli.Context) (string, error) {
+	dbReset := c.String("db-reset")
+	if len(dbReset) > 0 && !validDBReset(dbReset) {
+		return "", fmt.Errorf("--db-reset %q is not one of %s, %s, %s", dbReset, dbResetAlways, dbResetNever, dbResetLabel)
+	}
+	return dbReset, nil
+}
+
+// planAction print plans of next updates, logs go to stderr only when verbose
+func planAction(c *cli.Context, asJSON bool) error {
+	dbReset, err := dbResetFlag(c)
+	if err != nil {
+		return err
+	}
+	config, err := configFromContext(c)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	log.Init("bitmark-node-updater-log", config.Log.Verbose, false, ioutil.Discard)
+	watchers, err := newWatchers(config, context.Background())
 	if err != nil {
-		log.Info("envConfig Error", err)
 		return err
 	}
+	plans := []UpdatePlan{}
+	for _, watcher := range watchers {
+		if len(dbReset) > 0 {
+			watcher.DBReset.Mode = dbReset
+		}
+		plans = append(plans, watcher.Plan())
+	}
+	if asJSON {
+		return WritePlansJSON(os.Stdout, plans)
+	}
+	for i, plan := range plans {
+		if i > 0 {
+			fmt.Println()
+		}
+		plan.WriteText(os.Stdout)
+	}
 	return nil
 }
 
-// envConfig translates the command-line options into environment variables
+// restoreAction restore snapshot of the node container it is taken from, or list snapshots
+func restoreAction(c *cli.Context) error {
+	config, err := configFromContext(c)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	logfile := openLog(config)
+	defer logfile.Close()
+	watchers, err := newWatchers(config, signalContext())
+	if err != nil {
+		return err
+	}
+	if c.Bool("list") {
+		for _, watcher := range watchers {
+			snapshots, err := watcher.Backups.List(watcher.ContainerName)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("container %s snapshots: %d\n", watcher.ContainerName, len(snapshots))
+			for _, snapshot := range snapshots {
+				fmt.Printf("  %s image %s files %d bytes %d\n", snapshot.ID, shortID(strings.TrimPrefix(snapshot.ImageID, "sha256:")), len(snapshot.Files), snapshot.Size)
+			}
+		}
+		return nil
+	}
+	id := c.Args().First()
+	if len(id) == 0 {
+		return cli.NewExitError("snapshot is not given, restore --list prints snapshots", 1)
+	}
+	for _, watcher := range watchers {
+		if _, err := watcher.Backups.Load(watcher.ContainerName, id); err != nil {
+			continue
+		}
+		if err := watcher.RestoreSnapshot(id); err != nil {
+			log.Error(err)
+			return cli.NewExitError(err.Error(), 1)
+		}
+		waitNotifications(watchers)
+		fmt.Printf("snapshot %s of container %s is restored\n", id, watcher.ContainerName)
+		return nil
+	}
+	return cli.NewExitError(fmt.Sprintf("snapshot %s is not found", id), 1)
+}
+
+// configFromContext load configuration file and override it by environment variables and flags
+func configFromContext(c *cli.Context) (Config, error) {
+	config, err := LoadConfig(c.GlobalString("config"))
+	if err != nil {
+		return config, err
+	}
+	config.ApplyEnv()
+	if len(config.Nodes) > 0 {
+		for _, name := range []string{"image", "name"} {
+			if c.GlobalIsSet(name) {
+				return config, ErrCombind(ErrorConfigInvalid, fmt.Errorf("--%s sets the node section only, set %s of each entry of nodes in %s", name, name, c.GlobalString("config")))
+			}
+		}
+	}
+	if c.GlobalIsSet("host") {
+		config.Docker.Host = c.GlobalString("host")
+	}
+	if c.GlobalIsSet("image") {
+		config.Node.Image = c.GlobalString("image")
+	}
+	if c.GlobalIsSet("name") {
+		config.Node.Name = c.GlobalString("name")
+	}
+	if c.GlobalIsSet("registry") {
+		config.Node.Registry = c.GlobalString("registry")
+	}
+	if c.GlobalIsSet("rollback-grace") {
+		config.Rollback.GracePeriod = c.GlobalDuration("rollback-grace")
+	}
+	if c.GlobalIsSet("rollback-restarts") {
+		config.Rollback.MaxRestarts = c.GlobalInt("rollback-restarts")
+	}
+	if c.GlobalIsSet("health-host") {
+		config.Health.Host = c.GlobalString("health-host")
+	}
+	if c.GlobalIsSet("liveness-interval") {
+		config.Health.LivenessInterval = c.GlobalDuration("liveness-interval")
+	}
+	if c.GlobalIsSet("api-listen") {
+		config.API.Listen = c.GlobalString("api-listen")
+	}
+	if c.GlobalIsSet("verbose") {
+		config.Log.Verbose = c.GlobalBool("verbose")
+	}
+	return config, config.Validate()
+}
+
+// envConfig translates the configuration into environment variables
 // that will initialize the api client
-func envConfig(c *cli.Context) error {
-	var err error
-	err = setEnvOptStr("DOCKER_HOST", c.GlobalString("host"))
-	err = setEnvOptStr("DOCKER_API_VERSION", dockerAPIVersion)
-	return err
+func envConfig(config Config) error {
+	if err := setEnvOptStr("DOCKER_HOST", config.Docker.Host); err != nil {
+		return err
+	}
+	return setEnvOptStr("DOCKER_API_VERSION", config.Docker.APIVersion)
 }
 
 func setEnvOptStr(env string, opt string) error {
@@ -0,0 +1,175 @@
+package main
+
+// Prometheus metrics of watcher, served on /metrics of the API
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "bitmark_node_watcher"
+	// reason label of rollbacks
+	rollbackReasonUpdate = "failed_update"
+	rollbackReasonManual = "manual"
+)
+
+// watcherMetrics metrics of a watcher, registered in its own registry with container label
+type watcherMetrics struct {
+	registry         *prometheus.Registry
+	polls            prometheus.Counter
+	pollFailures     *prometheus.CounterVec
+	updateAttempts   *prometheus.CounterVec
+	updateSuccesses  prometheus.Counter
+	refusals         prometheus.Counter
+	rollbacks        *prometheus.CounterVec
+	rollbackFailures prometheus.Counter
+	updateDuration   prometheus.Histogram
+	downtime         prometheus.Histogram
+}
+
+// nodeCollector inspect node container on every scrape
+type nodeCollector struct {
+	watcher *NodeWatcher
+	running *prometheus.Desc
+	info    *prometheus.Desc
+}
+
+func newWatcherMetrics(w *NodeWatcher) *watcherMetrics {
+	m := &watcherMetrics{
+		registry: prometheus.NewRegistry(),
+		polls: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "polls_total",
+			Help:      "Image checks of the monitor loop.",
+		}),
+		pollFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "poll_failures_total",
+			Help:      "Image checks failed to query registry or pull image, by error.",
+		}, []string{"error"}),
+		updateAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "update_attempts_total",
+			Help:      "Attempts to replace node container with a new image, by trigger.",
+		}, []string{"trigger"}),
+		updateSuccesses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "update_successes_total",
+			Help:      "Updates of which new container passed grace period and health checks.",
+		}),
+		refusals: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "image_refusals_total",
+			Help:      "New images refused by verification before deploy.",
+		}),
+		rollbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rollbacks_total",
+			Help:      "Rollbacks to previous container, by failed update or manual request.",
+		}, []string{"reason"}),
+		rollbackFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rollback_failures_total",
+			Help:      "Rollbacks failed to restore previous container.",
+		}),
+		updateDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "update_duration_seconds",
+			Help:      "Time of an update from stopping old container to the result, including grace period.",
+			Buckets:   []float64{5, 15, 30, 60, 90, 120, 300, 600},
+		}),
+		downtime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "container_downtime_seconds",
+			Help:      "Time between stopping old container and starting new container.",
+			Buckets:   []float64{1, 2, 5, 10, 20, 30, 60, 120},
+		}),
+	}
+	registerer := prometheus.WrapRegistererWith(prometheus.Labels{"container": w.ContainerName}, m.registry)
+	registerer.MustRegister(m.polls, m.pollFailures, m.updateAttempts, m.updateSuccesses, m.refusals,
+		m.rollbacks, m.rollbackFailures, m.updateDuration, m.downtime, newNodeCollector(w))
+	return m
+}
+
+func newNodeCollector(w *NodeWatcher) *nodeCollector {
+	return &nodeCollector{
+		watcher: w,
+		running: prometheus.NewDesc(metricsNamespace+"_node_running",
+			"Whether node container is running.", nil, nil),
+		info: prometheus.NewDesc(metricsNamespace+"_info",
+			"Version of watcher and image of node container, always 1.",
+			[]string{"version", "commit", "image", "image_id", "digest"}, nil),
+	}
+}
+
+// Describe implement prometheus.Collector
+func (c *nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.running
+	ch <- c.info
+}
+
+// Collect implement prometheus.Collector
+func (c *nodeCollector) Collect(ch chan<- prometheus.Metric) {
+	running := 0.0
+	image, imageID, digest := "", "", ""
+	if status := c.watcher.containerStatus(); status != nil {
+		if status.State == containerStateRunning {
+			running = 1
+		}
+		image, imageID, digest = status.Image, status.ImageID, status.Digest
+	}
+	ch <- prometheus.MustNewConstMetric(c.running, prometheus.GaugeValue, running)
+	ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, version, commit, image, imageID, digest)
+}
+
+// metricsHandler serve metrics of all watchers, they are labeled by container
+func metricsHandler(watchers []*NodeWatcher) http.Handler {
+	gatherers := prometheus.Gatherers{}
+	for _, watcher := range watchers {
+		gatherers = append(gatherers, watcher.metrics.registry)
+	}
+	return promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+}
+
+func (m *watcherMetrics) recordPoll(err error) {
+	m.polls.Inc()
+	if err != nil {
+		m.pollFailures.WithLabelValues(errorLabel(err)).Inc()
+	}
+}
+
+// recordUpdate count an update attempt and its result, duration is of updates replacing the container only
+func (m *watcherMetrics) recordUpdate(record UpdateRecord) {
+	m.updateAttempts.WithLabelValues(record.Trigger).Inc()
+	if record.Result != updateRefused {
+		m.updateDuration.Observe(record.FinishedAt.Sub(record.StartedAt).Seconds())
+	}
+	switch record.Result {
+	case updateSucceeded:
+		m.updateSuccesses.Inc()
+	case updateRefused:
+		m.refusals.Inc()
+	case updateRolledBack:
+		m.rollbacks.WithLabelValues(rollbackReasonUpdate).Inc()
+	case updateFailed:
+		m.rollbackFailures.Inc()
+	}
+}
+
+// recordRollback count a requested rollback
+func (m *watcherMetrics) recordRollback(record UpdateRecord) {
+	switch record.Result {
+	case updateRolledBack:
+		m.rollbacks.WithLabelValues(rollbackReasonManual).Inc()
+	case updateFailed:
+		m.rollbackFailures.Inc()
+	}
+}
+
+func (m *watcherMetrics) recordDowntime(downtime time.Duration) {
+	m.downtime.Observe(downtime.Seconds())
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorLabel(t *testing.T) {
+	cases := []struct {
+		err   error
+		label string
+	}{
+		{ErrCombind(ErrorImagePull, errors.New("connection refused")), "image_pull"},
+		{ErrCombind(ErrorRegistryQuery, ErrCombind(ErrorRegistryAuth, errors.New("401"))), "registry_auth"},
+		{ErrCombind(ErrorRegistryQuery, errors.New("Image pull failed without prefix")), "registry_query"},
+		{ErrCombind(ErrorRecoverDB, errors.New("exists")), "recover_db"},
+		{errors.New("no such host"), "unknown"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.label, errorLabel(c.err), c.err.Error())
+	}
+}
+
+func TestMetricsUpdate(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	metrics := watcher.metrics
+
+	docker.FailNext("ImagePull", errors.New("network down"))
+	_, err := watcher.checkImage()
+	metrics.recordPoll(err)
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	metrics.recordPoll(err)
+	assert.NoError(t, err)
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.polls))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.pollFailures.WithLabelValues("image_pull")))
+
+	update.Trigger = triggerPoll
+	_, err = runUpdate(watcher, update)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.updateAttempts.WithLabelValues(triggerPoll)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.updateSuccesses))
+
+	assert.NoError(t, watcher.rollbackToPrevious(triggerAPI))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.rollbacks.WithLabelValues(rollbackReasonManual)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.rollbackFailures))
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	server := httptest.NewServer(NewAPIServer([]*NodeWatcher{watcher}, "").Handler())
+	defer server.Close()
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+	update.Trigger = triggerPoll
+	_, err = runUpdate(watcher, update)
+	assert.NoError(t, err)
+
+	resp := apiRequest(t, server, http.MethodGet, "/metrics", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	text := string(body)
+	label := fmt.Sprintf(`container="%s"`, watcher.ContainerName)
+	assert.Contains(t, text, "bitmark_node_watcher_node_running{"+label+"} 1")
+	assert.Contains(t, text, fmt.Sprintf(`bitmark_node_watcher_info{commit="%s",%s,digest="%s",image="%s",image_id="%s",version="%s"} 1`,
+		commit, label, mockNewDigest, watcher.ImageName+"@"+mockNewDigest, mockNewImageID, version))
+	assert.Contains(t, text, `bitmark_node_watcher_update_attempts_total{`+label+`,trigger="poll"} 1`)
+	assert.Contains(t, text, "bitmark_node_watcher_update_duration_seconds_count{"+label+"} 1")
+	assert.Contains(t, text, "bitmark_node_watcher_container_downtime_seconds_count{"+label+"} 1")
+
+	// a refused image replaces nothing, it is counted without duration
+	watcher.metrics.recordUpdate(UpdateRecord{Trigger: triggerPoll, Result: updateRefused, StartedAt: time.Now(), FinishedAt: time.Now()})
+	docker.Container(watcher.ContainerName).State.Status = "exited"
+	resp = apiRequest(t, server, http.MethodGet, "/metrics", "")
+	body, _ = ioutil.ReadAll(resp.Body)
+	text = string(body)
+	assert.Contains(t, text, "bitmark_node_watcher_node_running{"+label+"} 0")
+	assert.Contains(t, text, `bitmark_node_watcher_update_attempts_total{`+label+`,trigger="poll"} 2`)
+	assert.Contains(t, text, "bitmark_node_watcher_image_refusals_total{"+label+"} 1")
+	assert.Contains(t, text, "bitmark_node_watcher_update_duration_seconds_count{"+label+"} 1")
+}
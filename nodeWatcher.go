@@ -3,34 +3,199 @@ package main
 // Check Current containers for bitmark-node container node
 
 import (
-	"io/ioutil"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
 	log "github.com/google/logger"
 )
 
-const newImageDownloadIndicator = "Downloaded newer image"
 const (
 	containerStateRunning = "running"
 )
 
-// pullImage Pull Specific Image
-func (w *NodeWatcher) pullImage() (updated bool, err error) {
-	reader, err := w.DockerClient.ImagePull(w.BackgroundContex, w.Repo, types.ImagePullOptions{})
+// pullImage Pull Specific Image and compare it with the image of the running node container
+func (w *NodeWatcher) pullImage() (ImageUpdate, error) {
+	target, awaiting, err := w.resolveTarget()
+	w.recordAwaiting(awaiting)
 	if err != nil {
-		return false, err
+		return ImageUpdate{}, err
+	}
+	return w.pullTarget(target)
+}
+
+// pullTarget pull the reference chosen by update policy
+func (w *NodeWatcher) pullTarget(target ImageReference) (ImageUpdate, error) {
+	update := ImageUpdate{}
+	if w.Policy.movesTag() {
+		update.Image = target.String()
+	}
+	oldImage, err := w.currentImage()
+	if err != nil {
+		return update, err
+	}
+	if oldImage != nil {
+		update.OldID = oldImage.ID
+		update.OldDigest = w.repoDigest(*oldImage)
+	}
+	options, err := w.pullOptions()
+	if err != nil {
+		return update, ErrCombind(ErrorImagePull, err)
+	}
+	reader, err := w.DockerClient.ImagePull(w.BackgroundContex, target.String(), options)
+	if err != nil {
+		return update, ErrCombind(ErrorImagePull, err)
 	}
 	defer reader.Close()
-	response, err := ioutil.ReadAll(reader)
-	updated = strings.Contains(string(response), newImageDownloadIndicator)
-	return
+	if err := drainPullStream(reader); err != nil {
+		return update, ErrCombind(ErrorImagePull, err)
+	}
+	newImage, _, err := w.DockerClient.ImageInspectWithRaw(w.BackgroundContex, target.String())
+	if err != nil {
+		return update, ErrCombind(ErrorImagePull, err)
+	}
+	update.NewID = newImage.ID
+	update.NewDigest = w.repoDigest(newImage)
+	update.Updated = update.OldID != update.NewID
+	if update.Updated && w.rejected(update.NewID, update.NewDigest) {
+		log.Info("image:", update.NewID, " is rejected by previous rollback")
+		update.Updated = false
+	}
+	return update, nil
+}
+
+// pullOptions authorize the pull with credentials of image registry, docker calls PrivilegeFunc
+// when the registry rejects them and retries with the credentials looked up again
+func (w *NodeWatcher) pullOptions() (types.ImagePullOptions, error) {
+	if w.Credentials == nil {
+		return types.ImagePullOptions{}, nil
+	}
+	host := registryHost(w.Reference.Domain)
+	encoded, err := w.Credentials.EncodedAuth(host)
+	if err != nil {
+		return types.ImagePullOptions{}, ErrCombind(ErrorRegistryAuth, err)
+	}
+	return types.ImagePullOptions{
+		RegistryAuth: encoded,
+		PrivilegeFunc: func() (string, error) {
+			w.Credentials.Invalidate(host)
+			return w.Credentials.EncodedAuth(host)
+		},
+	}, nil
+}
+
+// checkImage query the registry for the digest of the target of update policy and pull only
+// when it differs from node container's
+func (w *NodeWatcher) checkImage() (ImageUpdate, error) {
+	if w.Registry == nil {
+		return w.pullImage()
+	}
+	target, awaiting, err := w.resolveTarget()
+	w.recordAwaiting(awaiting)
+	if err != nil {
+		return ImageUpdate{}, err
+	}
+	remoteDigest, err := w.Registry.ManifestDigest(w.BackgroundContex, target.Path, target.ManifestReference())
+	if err != nil {
+		return ImageUpdate{}, ErrCombind(ErrorRegistryQuery, err)
+	}
+	oldImage, err := w.currentImage()
+	if err != nil {
+		return ImageUpdate{}, err
+	}
+	if oldImage != nil && w.repoDigest(*oldImage) == remoteDigest {
+		return ImageUpdate{OldID: oldImage.ID, OldDigest: remoteDigest, NewID: oldImage.ID, NewDigest: remoteDigest}, nil
+	}
+	if w.rejected("", remoteDigest) {
+		log.Info("remote digest:", remoteDigest, " is rejected by previous rollback")
+		return ImageUpdate{NewDigest: remoteDigest}, nil
+	}
+	log.Info("remote digest:", remoteDigest, " of ", target.String(), " differs from node container, pull image")
+	return w.pullTarget(target)
+}
+
+// currentImage return the image used by the node container, nil if the container does not exist
+func (w *NodeWatcher) currentImage() (*types.ImageInspect, error) {
+	nodeContainer, err := w.DockerClient.ContainerInspect(w.BackgroundContex, w.ContainerName)
+	if err != nil {
+		if client.IsErrContainerNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	image, _, err := w.DockerClient.ImageInspectWithRaw(w.BackgroundContex, nodeContainer.Image)
+	if err != nil {
+		if client.IsErrImageNotFound(err) { // image is removed, only the ID is known
+			return &types.ImageInspect{ID: nodeContainer.Image}, nil
+		}
+		return nil, err
+	}
+	return &image, nil
 }
+
+// repoDigest return the digest of the image in watcher's repository
+func (w *NodeWatcher) repoDigest(image types.ImageInspect) string {
+	for _, repoDigest := range image.RepoDigests {
+		parts := strings.SplitN(repoDigest, "@", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if w.Reference.SameRepository(parts[0]) {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
+// drainPullStream read the pull progress to the end and return the error reported by daemon
+func drainPullStream(reader io.Reader) error {
+	decoder := json.NewDecoder(reader)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if len(msg.ErrorMessage) > 0 {
+			return errors.New(msg.ErrorMessage)
+		}
+	}
+}
+
+// createContainer create node container on the primary network and connect it to the other networks,
+// the container is removed when a network can not be connected
 func (w *NodeWatcher) createContainer(config CreateConfig) (container.ContainerCreateCreatedBody, error) {
-	container, err := w.DockerClient.ContainerCreate(w.BackgroundContex, config.Config, config.HostConfig, config.NetworkingConfig, w.ContainerName)
-	return container, err
+	created, err := w.DockerClient.ContainerCreate(w.BackgroundContex, config.Config, config.HostConfig, config.NetworkingConfig, w.ContainerName)
+	if err != nil {
+		return created, err
+	}
+	names := []string{}
+	for name := range config.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := w.DockerClient.NetworkConnect(w.BackgroundContex, name, created.ID, config.Networks[name]); err != nil {
+			if removeErr := w.forceRemoveContainer(created.ID); removeErr != nil {
+				log.Error("remove container:", created.ID, " failed: ", removeErr)
+			}
+			return container.ContainerCreateCreatedBody{}, fmt.Errorf("connect network %s: %s", name, err)
+		}
+	}
+	return created, nil
 }
 
 // getTartgetContainers get the containers which has the same image name
@@ -48,13 +213,31 @@ func (w *NodeWatcher) getContainersWithImage() ([]types.Container, error) {
 			return targetContainers, err
 		}
 
-		if container.Image == w.ImageName {
+		if w.isWatchedImage(container) {
 			targetContainers = append(targetContainers, container)
 		}
 	}
 	return targetContainers, nil
 }
 
+// isWatchedImage tell if container runs the watched image, by normalized reference, by repository when
+// update policy moves tags, or by image ID when docker lists the container by ID because the tag is moved
+func (w *NodeWatcher) isWatchedImage(c types.Container) bool {
+	if w.Reference.Matches(c.Image) || (w.Policy.movesTag() && w.Reference.SameRepository(c.Image)) {
+		return true
+	}
+	image, _, err := w.DockerClient.ImageInspectWithRaw(w.BackgroundContex, c.ImageID)
+	if err != nil {
+		return false
+	}
+	for _, name := range append(image.RepoTags, image.RepoDigests...) {
+		if w.Reference.SameRepository(name) {
+			return true
+		}
+	}
+	return false
+}
+
 func (w *NodeWatcher) getOldContainer() (*types.Container, error) {
 	//get all containers
 	containers, err := w.DockerClient.ContainerList(w.BackgroundContex, types.ContainerListOptions{All: true})
@@ -0,0 +1,284 @@
+package main
+
+// Webhook notifications of update lifecycle events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/google/logger"
+)
+
+// Events of update lifecycle
+const (
+	eventImageDetected   = "image_detected"
+	eventImageRefused    = "image_refused"
+	eventUpdateStarted   = "update_started"
+	eventUpdateSucceeded = "update_succeeded"
+	eventUpdateFailed    = "update_failed"
+	eventRollback        = "rollback"
+	eventDBRenamed       = "db_renamed"
+	eventDBRestored      = "db_restored"
+)
+
+// Payload formats of webhooks
+const (
+	webhookFormatJSON    = "json"
+	webhookFormatSlack   = "slack"
+	webhookFormatDiscord = "discord"
+)
+
+const (
+	defaultWebhookRetries = 3
+	defaultWebhookBackoff = time.Second
+	defaultWebhookTimeout = 10 * time.Second
+	webhookQueueSize      = 64
+	// longest wait of queued events before exit
+	webhookWaitTimeout = 30 * time.Second
+	// headers of webhook requests
+	webhookEventHeader     = "X-Watcher-Event"
+	webhookSignatureHeader = "X-Watcher-Signature"
+	// default message of slack and discord formats
+	defaultWebhookTemplate = `bitmark-node-watcher {{.Container}}: {{.Event}}` +
+		`{{if .NewDigest}} {{.OldDigest}} -> {{.NewDigest}}{{end}}{{if .Error}} error: {{.Error}}{{end}}`
+)
+
+var webhookEvents = []string{eventImageDetected, eventImageRefused, eventUpdateStarted, eventUpdateSucceeded,
+	eventUpdateFailed, eventRollback, eventDBRenamed, eventDBRestored}
+
+func knownEvent(event string) bool {
+	for _, known := range webhookEvents {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+// NotifyEvent payload of json format and data of message templates
+type NotifyEvent struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Container  string    `json:"container"`
+	Image      string    `json:"image"`
+	Trigger    string    `json:"trigger,omitempty"`
+	OldImageID string    `json:"old_image_id,omitempty"`
+	OldDigest  string    `json:"old_digest,omitempty"`
+	NewImageID string    `json:"new_image_id,omitempty"`
+	NewDigest  string    `json:"new_digest,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Notifier deliver events to webhooks in order of events, each webhook has its own queue
+type Notifier struct {
+	hooks   []*webhook
+	pending sync.WaitGroup
+	ctx     context.Context // retries wait no longer once it is done
+	cancel  context.CancelFunc
+}
+
+type webhook struct {
+	config   WebhookConfig
+	message  *template.Template
+	events   map[string]bool // nil for all events
+	client   *http.Client
+	retries  int
+	backoff  time.Duration
+	queue    chan NotifyEvent
+	notifier *Notifier
+}
+
+// NewNotifier create notifier of configured webhooks and start their delivery routines,
+// retries are given up when ctx is done
+func NewNotifier(config NotifyConfig, ctx context.Context) (*Notifier, error) {
+	n := &Notifier{}
+	n.ctx, n.cancel = context.WithCancel(ctx)
+	for _, hookConfig := range config.Webhooks {
+		message, err := webhookTemplate(hookConfig)
+		if err != nil {
+			return nil, ErrCombind(ErrorWebhook, err)
+		}
+		hook := &webhook{
+			config:   hookConfig,
+			message:  message,
+			client:   &http.Client{Timeout: config.Timeout},
+			retries:  config.Retries,
+			backoff:  config.Backoff,
+			queue:    make(chan NotifyEvent, webhookQueueSize),
+			notifier: n,
+		}
+		if len(hookConfig.Events) > 0 {
+			hook.events = make(map[string]bool)
+			for _, event := range hookConfig.Events {
+				hook.events[event] = true
+			}
+		}
+		n.hooks = append(n.hooks, hook)
+		go hook.deliverRoutine()
+	}
+	return n, nil
+}
+
+// webhookTemplate parse message template of slack and discord formats
+func webhookTemplate(config WebhookConfig) (*template.Template, error) {
+	text := config.Template
+	if len(text) == 0 {
+		text = defaultWebhookTemplate
+	}
+	return template.New(config.URL).Option("missingkey=error").Parse(text)
+}
+
+// Notify queue event to webhooks subscribing it, the event is dropped when a queue is full
+func (n *Notifier) Notify(event NotifyEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, hook := range n.hooks {
+		if hook.events != nil && !hook.events[event.Event] {
+			continue
+		}
+		n.pending.Add(1)
+		select {
+		case hook.queue <- event:
+		default:
+			n.pending.Done()
+			log.Warning("webhook queue is full, drop event:", event.Event, " url:", hook.config.URL)
+		}
+	}
+}
+
+// Wait block until queued events are delivered or given up, retries are given up after timeout.
+// It return false when events are still pending at timeout
+func (n *Notifier) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		n.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		n.cancel()
+		return false
+	}
+}
+
+func (h *webhook) deliverRoutine() {
+	for event := range h.queue {
+		if err := h.deliver(event); err != nil {
+			log.Error(err)
+		}
+		h.notifier.pending.Done()
+	}
+}
+
+// deliver post event and retry with doubling backoff on network errors, 429 and 5xx responses
+func (h *webhook) deliver(event NotifyEvent) error {
+	body, err := h.payload(event)
+	if err != nil {
+		return ErrCombind(ErrorWebhook, err)
+	}
+	backoff := h.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := h.post(event.Event, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= h.retries {
+			return ErrCombind(ErrorWebhook, fmt.Errorf("%s %s after %d attempts: %s", event.Event, h.config.URL, attempt+1, err))
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-h.notifier.ctx.Done():
+			timer.Stop()
+			return ErrCombind(ErrorWebhook, fmt.Errorf("%s %s retry is given up at shutdown after %d attempts: %s", event.Event, h.config.URL, attempt+1, err))
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// payload encode event in format of the webhook
+func (h *webhook) payload(event NotifyEvent) ([]byte, error) {
+	if h.config.Format == webhookFormatJSON || len(h.config.Format) == 0 {
+		return json.Marshal(event)
+	}
+	var message bytes.Buffer
+	if err := h.message.Execute(&message, event); err != nil {
+		return nil, err
+	}
+	if h.config.Format == webhookFormatDiscord {
+		return json.Marshal(map[string]string{"content": message.String()})
+	}
+	return json.Marshal(map[string]string{"text": message.String()})
+}
+
+// post send body once, return whether a failure is worth retrying
+func (h *webhook) post(event string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, h.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event)
+	if len(h.config.Secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signPayload(h.config.Secret, body))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status: %s", resp.Status)
+	default:
+		return false, fmt.Errorf("status: %s", resp.Status)
+	}
+}
+
+// signPayload hex encoded HMAC-SHA256 of body, receivers compare it with X-Watcher-Signature
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify send event of node container to webhooks, nothing is sent without notifier
+func (w *NodeWatcher) notify(event string, update ImageUpdate, err error) {
+	if w.Notifier == nil {
+		return
+	}
+	notifyEvent := NotifyEvent{Event: event, Container: w.ContainerName, Image: w.ImageName, Trigger: update.Trigger,
+		OldImageID: update.OldID, OldDigest: update.OldDigest, NewImageID: update.NewID, NewDigest: update.NewDigest}
+	if err != nil {
+		notifyEvent.Error = err.Error()
+	}
+	w.Notifier.Notify(notifyEvent)
+}
+
+// notifyDetected send image_detected once for each new image, checks finding the same image again send nothing
+func (w *NodeWatcher) notifyDetected(update ImageUpdate) {
+	digest := update.NewDigest
+	if len(digest) == 0 {
+		digest = update.NewID
+	}
+	if w.status.detectImage(digest) {
+		w.notify(eventImageDetected, update, nil)
+	}
+}
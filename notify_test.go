@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// webhookReceiver local HTTP receiver recording delivered requests
+type webhookReceiver struct {
+	lock     sync.Mutex
+	server   *httptest.Server
+	status   []int // status of each request, 200 after they are used up
+	attempts int
+	headers  []http.Header
+	bodies   [][]byte
+}
+
+func newWebhookReceiver(status ...int) *webhookReceiver {
+	r := &webhookReceiver{status: status}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.attempts++
+		if len(r.status) > 0 {
+			code := r.status[0]
+			r.status = r.status[1:]
+			if code != http.StatusOK {
+				w.WriteHeader(code)
+				return
+			}
+		}
+		r.headers = append(r.headers, req.Header)
+		r.bodies = append(r.bodies, body)
+	}))
+	return r
+}
+
+// events return events of delivered json payloads
+func (r *webhookReceiver) events(t *testing.T) []NotifyEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	events := []NotifyEvent{}
+	for _, body := range r.bodies {
+		var event NotifyEvent
+		assert.NoError(t, json.Unmarshal(body, &event))
+		events = append(events, event)
+	}
+	return events
+}
+
+func testNotifyConfig(hooks ...WebhookConfig) NotifyConfig {
+	return NotifyConfig{Webhooks: hooks, Retries: 2, Backoff: time.Millisecond, Timeout: time.Second}
+}
+
+func TestWebhookFormats(t *testing.T) {
+	receiver := newWebhookReceiver()
+	defer receiver.server.Close()
+	notifier, err := NewNotifier(testNotifyConfig(
+		WebhookConfig{URL: receiver.server.URL, Secret: "hmac-key"},
+		WebhookConfig{URL: receiver.server.URL + "/slack", Format: webhookFormatSlack, Events: []string{eventUpdateFailed}},
+		WebhookConfig{URL: receiver.server.URL + "/discord", Format: webhookFormatDiscord, Events: []string{eventUpdateFailed},
+			Template: "{{.Container}} failed: {{.Error}}"},
+	), context.Background())
+	assert.NoError(t, err)
+	notifier.Notify(NotifyEvent{Event: eventUpdateStarted, Container: "bitmarkNode", NewDigest: mockNewDigest})
+	assert.True(t, notifier.Wait(time.Second))
+	assert.Len(t, receiver.bodies, 1)
+	assert.Equal(t, eventUpdateStarted, receiver.headers[0].Get(webhookEventHeader))
+	assert.Equal(t, "sha256="+signPayload("hmac-key", receiver.bodies[0]), receiver.headers[0].Get(webhookSignatureHeader))
+	assert.Equal(t, mockNewDigest, receiver.events(t)[0].NewDigest)
+
+	notifier.Notify(NotifyEvent{Event: eventUpdateFailed, Container: "bitmarkNode", Error: "exited"})
+	assert.True(t, notifier.Wait(time.Second))
+	assert.Len(t, receiver.bodies, 4)
+	messages := map[string]string{}
+	for _, body := range receiver.bodies[1:] {
+		assert.NoError(t, json.Unmarshal(body, &messages))
+	}
+	assert.Equal(t, "bitmark-node-watcher bitmarkNode: update_failed error: exited", messages["text"])
+	assert.Equal(t, "bitmarkNode failed: exited", messages["content"])
+	signed := 0 // webhooks deliver concurrently, only the json one has a secret
+	for _, header := range receiver.headers[1:] {
+		if len(header.Get(webhookSignatureHeader)) > 0 {
+			signed++
+		}
+	}
+	assert.Equal(t, 1, signed)
+}
+
+func TestWebhookRetry(t *testing.T) {
+	receiver := newWebhookReceiver(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer receiver.server.Close()
+	notifier, err := NewNotifier(testNotifyConfig(WebhookConfig{URL: receiver.server.URL}), context.Background())
+	assert.NoError(t, err)
+	notifier.Notify(NotifyEvent{Event: eventRollback})
+	assert.True(t, notifier.Wait(time.Second))
+	assert.Equal(t, 3, receiver.attempts)
+	assert.Len(t, receiver.bodies, 1)
+
+	receiver = newWebhookReceiver(http.StatusBadRequest)
+	defer receiver.server.Close()
+	hook := &webhook{config: WebhookConfig{URL: receiver.server.URL}, client: http.DefaultClient, retries: 2, notifier: notifier}
+	err = hook.deliver(NotifyEvent{Event: eventRollback})
+	assert.Contains(t, err.Error(), ErrorWebhook.Error())
+	assert.Equal(t, 1, receiver.attempts)
+
+	receiver = newWebhookReceiver(http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	defer receiver.server.Close()
+	hook = &webhook{config: WebhookConfig{URL: receiver.server.URL}, client: http.DefaultClient, retries: 2, backoff: time.Millisecond,
+		notifier: notifier}
+	err = hook.deliver(NotifyEvent{Event: eventRollback})
+	assert.Contains(t, err.Error(), "after 3 attempts")
+	assert.Equal(t, 3, receiver.attempts)
+}
+
+func TestWebhookRetryGivenUp(t *testing.T) {
+	receiver := newWebhookReceiver(http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	defer receiver.server.Close()
+	config := testNotifyConfig(WebhookConfig{URL: receiver.server.URL})
+	config.Backoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	notifier, err := NewNotifier(config, ctx)
+	assert.NoError(t, err)
+	notifier.Notify(NotifyEvent{Event: eventRollback})
+	start := time.Now()
+	assert.False(t, notifier.Wait(50*time.Millisecond), "retry waits for the backoff")
+	assert.True(t, notifier.Wait(time.Second), "retry is given up after wait timeout")
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 1, receiver.attempts)
+
+	// shutdown gives up retries without waiting for the backoff
+	receiver = newWebhookReceiver(http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	defer receiver.server.Close()
+	config.Webhooks = []WebhookConfig{{URL: receiver.server.URL}}
+	notifier, err = NewNotifier(config, ctx)
+	assert.NoError(t, err)
+	notifier.Notify(NotifyEvent{Event: eventRollback})
+	cancel()
+	assert.True(t, notifier.Wait(time.Second))
+	assert.Equal(t, 1, receiver.attempts)
+	assert.Empty(t, receiver.bodies)
+}
+
+func TestUpdateNotifications(t *testing.T) {
+	cases := []struct {
+		name    string
+		prepare func(watcher *NodeWatcher, docker *FakeDocker)
+		events  []string
+	}{
+		{
+			name:    "succeeded",
+			prepare: func(watcher *NodeWatcher, docker *FakeDocker) {},
+			events:  []string{eventUpdateStarted, eventDBRenamed, eventUpdateSucceeded},
+		},
+		{
+			name: "rolled back",
+			prepare: func(watcher *NodeWatcher, docker *FakeDocker) {
+				docker.Hook("ContainerStart", func(c *types.ContainerJSON) {
+					if c.Image == mockNewImageID {
+						c.State.Running, c.State.Status = false, "exited"
+					}
+				})
+			},
+			events: []string{eventUpdateStarted, eventDBRenamed, eventDBRestored, eventRollback, eventUpdateFailed},
+		},
+		{
+			name: "backup failed",
+			prepare: func(watcher *NodeWatcher, docker *FakeDocker) {
+				blocker := filepath.Join(watcher.DataRoot, "blocker")
+				ioutil.WriteFile(blocker, []byte("not a directory"), 0600)
+				watcher.Backups.Dir = filepath.Join(blocker, "backups")
+			},
+			events: []string{eventUpdateStarted, eventRollback, eventUpdateFailed},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			receiver := newWebhookReceiver()
+			defer receiver.server.Close()
+			watcher, docker := mockData.getWatcher(t)
+			notifier, err := NewNotifier(testNotifyConfig(WebhookConfig{URL: receiver.server.URL}), context.Background())
+			assert.NoError(t, err)
+			watcher.Notifier = notifier
+			c.prepare(watcher, docker)
+			docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+			update, err := watcher.checkImage()
+			assert.NoError(t, err)
+			runUpdate(watcher, update)
+			assert.True(t, notifier.Wait(time.Second))
+
+			names := []string{}
+			for _, event := range receiver.events(t) {
+				names = append(names, event.Event)
+				assert.Equal(t, watcher.ContainerName, event.Container)
+			}
+			assert.Equal(t, c.events, names)
+			assert.Equal(t, mockNewDigest, receiver.events(t)[0].NewDigest)
+		})
+	}
+}
+
+func TestImageDetectedOnce(t *testing.T) {
+	receiver := newWebhookReceiver()
+	defer receiver.server.Close()
+	watcher, docker := mockData.getWatcher(t)
+	notifier, err := NewNotifier(testNotifyConfig(WebhookConfig{URL: receiver.server.URL, Events: []string{eventImageDetected}}), context.Background())
+	assert.NoError(t, err)
+	watcher.Notifier = notifier
+	// the update waits for a window which never opens during the test
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	window := MaintenanceWindow{Start: now.Add(time.Hour).Sub(midnight)}
+	window.End = window.Start + time.Minute
+	watcher.Schedule = &UpdateSchedule{Location: time.UTC, Windows: []MaintenanceWindow{window}}
+
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	for i := 0; i < 3; i++ {
+		exit, err := UpdateOnce(watcher)
+		assert.NoError(t, err)
+		assert.Equal(t, exitNoUpdate, exit)
+	}
+	docker.PublishImage(watcher.ImageName, "newer", mockVersionDigest(1))
+	exit, err := UpdateOnce(watcher)
+	assert.NoError(t, err)
+	assert.Equal(t, exitNoUpdate, exit)
+	assert.True(t, notifier.Wait(time.Second))
+
+	digests := []string{}
+	for _, event := range receiver.events(t) {
+		assert.Equal(t, eventImageDetected, event.Event)
+		digests = append(digests, event.NewDigest)
+	}
+	assert.Equal(t, []string{mockNewDigest, mockVersionDigest(1)}, digests)
+}
@@ -0,0 +1,246 @@
+package main
+
+// Plan of the next update, it is built by reading docker and data directories without changing them
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+)
+
+// UpdatePlan what the next update of a node container would do
+type UpdatePlan struct {
+	Container string          `json:"container"`
+	Image     string          `json:"image"`
+	Target    string          `json:"target,omitempty"`            // reference chosen by update policy
+	Awaiting  string          `json:"awaiting_approval,omitempty"` // tag of a new major version
+	Matched   []PlanContainer `json:"matched"`                     // containers of the image
+	Stop      *PlanContainer  `json:"stop,omitempty"`              // running node container to stop
+	RemoveOld *PlanContainer  `json:"remove_old,omitempty"`        // old container of previous update to force remove
+	Rename    *PlanRename     `json:"rename,omitempty"`            // node container renamed with old postfix
+	Create    *CreateConfig   `json:"create,omitempty"`
+	BrandNew  bool            `json:"brand_new"` // create from default configuration, no node container to replace
+	DBReset   string          `json:"db_reset"`  // mode of db reset policy, databases move in label mode when the new image declares it
+	DBMoves   []PlanRename    `json:"db_moves"`
+	Warnings  []string        `json:"warnings,omitempty"`
+	Error     string          `json:"error,omitempty"` // the update would fail here
+}
+
+// PlanContainer container touched by an update
+type PlanContainer struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	State string `json:"state"`
+}
+
+// PlanRename a container or directory move
+type PlanRename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func planContainer(c types.Container) *PlanContainer {
+	name := ""
+	if len(c.Names) > 0 {
+		name = c.Names[0]
+	}
+	return &PlanContainer{ID: c.ID, Name: name, Image: c.Image, State: c.State}
+}
+
+// Plan follow the steps of handleExistingContainer and updateContainer with read only calls
+func (w *NodeWatcher) Plan() UpdatePlan {
+	plan := UpdatePlan{Container: w.ContainerName, Image: w.ImageName, Matched: []PlanContainer{}, DBReset: w.DBReset.Mode,
+		DBMoves: []PlanRename{}}
+	planned := *w
+	if w.Policy.movesTag() {
+		target, awaiting, err := w.resolveTarget()
+		plan.Awaiting = awaiting
+		if err != nil {
+			plan.Error = err.Error()
+			return plan
+		}
+		plan.Target = target.String()
+		planned.target = plan.Target
+	}
+	nodeContainers, err := w.getContainersWithImage()
+	if err != nil {
+		plan.Warnings = append(plan.Warnings, ErrCombind(ErrorGetContainerWithImage, err).Error())
+	}
+	for _, c := range nodeContainers {
+		plan.Matched = append(plan.Matched, *planContainer(c))
+	}
+	var nameContainer *types.Container
+	if err == nil && len(nodeContainers) != 0 {
+		if nameContainer = w.getNamedContainer(nodeContainers); nameContainer == nil {
+			plan.Warnings = append(plan.Warnings, ErrorNamedContainerNotFound.Error())
+		}
+	}
+
+	var env []string // environment the node runs with, chains of reset databases are worked out of it
+	if nameContainer != nil {
+		jsonConfig, err := w.DockerClient.ContainerInspect(w.BackgroundContex, nameContainer.ID)
+		if err != nil {
+			plan.Error = ErrCombind(ErrorHandleExistingContainer, err).Error()
+			return plan
+		}
+		if nameContainer.State == containerStateRunning {
+			plan.Stop = planContainer(*nameContainer)
+		}
+		oldContainer, err := w.getOldContainer()
+		if err == nil && oldContainer != nil {
+			plan.RemoveOld = planContainer(*oldContainer)
+		}
+		plan.Rename = &PlanRename{From: nameContainer.Names[0], To: nameContainer.Names[0] + w.Postfix}
+		plan.Create = newCreateConfig(&planned, jsonConfig)
+		if jsonConfig.Config != nil { // variables of the image are left out of the cloned config
+			env = jsonConfig.Config.Env
+		}
+	} else {
+		plan.BrandNew = true
+		plan.Create, err = getDefaultConfig(&planned)
+		if err != nil {
+			plan.Error = ErrCombind(ErrorConfigCreateNew, err).Error()
+			return plan
+		}
+		env = plan.Create.Config.Env
+	}
+	if plan.DBReset == dbResetNever {
+		return plan
+	}
+	for _, db := range w.nodeDBs(w.envChains(env)) {
+		to := filepath.Join(w.Backups.containerDir(w.ContainerName), snapshotNext, db.Chain, db.Name)
+		plan.DBMoves = append(plan.DBMoves, PlanRename{From: db.Path, To: to})
+	}
+	return plan
+}
+
+// WritePlansJSON write plans as an indented JSON array
+func WritePlansJSON(out io.Writer, plans []UpdatePlan) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plans)
+}
+
+// WriteText write plan as a diff, + for what is created, - for what is removed and ~ for what is changed
+func (p UpdatePlan) WriteText(out io.Writer) {
+	fmt.Fprintf(out, "container %s image %s\n", p.Container, p.Image)
+	if len(p.Target) > 0 {
+		fmt.Fprintf(out, "  target of update policy: %s\n", p.Target)
+	}
+	if len(p.Awaiting) > 0 {
+		fmt.Fprintf(out, "  ! %s is a new major version awaiting approval\n", p.Awaiting)
+	}
+	fmt.Fprintf(out, "  containers of image: %d\n", len(p.Matched))
+	for _, c := range p.Matched {
+		fmt.Fprintf(out, "    %s %s %s\n", shortID(c.ID), c.Name, c.State)
+	}
+	for _, warning := range p.Warnings {
+		fmt.Fprintf(out, "  ! %s\n", warning)
+	}
+	if len(p.Error) > 0 {
+		fmt.Fprintf(out, "  ! update fails: %s\n", p.Error)
+		return
+	}
+	if p.Stop != nil {
+		fmt.Fprintf(out, "  ~ stop %s %s\n", shortID(p.Stop.ID), p.Stop.Name)
+	}
+	if p.RemoveOld != nil {
+		fmt.Fprintf(out, "  - remove %s %s\n", shortID(p.RemoveOld.ID), p.RemoveOld.Name)
+	}
+	if p.Rename != nil {
+		fmt.Fprintf(out, "  ~ rename %s => %s\n", p.Rename.From, p.Rename.To)
+	}
+	if p.Create != nil {
+		source := "from node container"
+		if p.BrandNew {
+			source = "from default configuration"
+		}
+		fmt.Fprintf(out, "  + create /%s %s\n", p.Container, source)
+		writeCreateConfig(out, p.Create)
+	}
+	switch p.DBReset {
+	case dbResetNever:
+		fmt.Fprintf(out, "  databases are kept, db reset policy is %s\n", p.DBReset)
+	case dbResetLabel:
+		fmt.Fprintf(out, "  ? databases move only when the new image declares a reset by its labels\n")
+	}
+	for _, move := range p.DBMoves {
+		fmt.Fprintf(out, "  ~ move %s => %s\n", move.From, move.To)
+	}
+}
+
+func writeCreateConfig(out io.Writer, config *CreateConfig) {
+	line := func(key string, values ...string) {
+		if joined := strings.Join(values, " "); len(joined) > 0 {
+			fmt.Fprintf(out, "      %s: %s\n", key, joined)
+		}
+	}
+	if config.Config != nil {
+		line("image", config.Config.Image)
+		line("cmd", config.Config.Cmd...)
+		line("env", config.Config.Env...)
+		ports := []string{}
+		for port := range config.Config.ExposedPorts {
+			ports = append(ports, string(port))
+		}
+		sort.Strings(ports)
+		line("ports", ports...)
+	}
+	if config.HostConfig != nil {
+		line("network_mode", string(config.HostConfig.NetworkMode))
+		line("binds", config.HostConfig.Binds...)
+		mounts := []string{}
+		for _, m := range config.HostConfig.Mounts {
+			mounts = append(mounts, m.Source+":"+m.Target)
+		}
+		line("mounts", mounts...)
+	}
+	if config.NetworkingConfig != nil {
+		for name, endpoint := range config.NetworkingConfig.EndpointsConfig {
+			line("network", describeEndpoint(name, endpoint))
+		}
+	}
+	names := []string{}
+	for name := range config.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		line("connect", describeEndpoint(name, config.Networks[name]))
+	}
+}
+
+func describeEndpoint(name string, endpoint *network.EndpointSettings) string {
+	description := []string{name}
+	if endpoint == nil {
+		return name
+	}
+	if endpoint.IPAMConfig != nil {
+		for _, ip := range []string{endpoint.IPAMConfig.IPv4Address, endpoint.IPAMConfig.IPv6Address} {
+			if len(ip) > 0 {
+				description = append(description, "ip="+ip)
+			}
+		}
+	}
+	if len(endpoint.Aliases) > 0 {
+		description = append(description, "aliases="+strings.Join(endpoint.Aliases, ","))
+	}
+	if len(endpoint.Links) > 0 {
+		description = append(description, "links="+strings.Join(endpoint.Links, ","))
+	}
+	return strings.Join(description, " ")
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+func TestPlan(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	nodeID := docker.Container(watcher.ContainerName).ID
+	oldID := docker.AddContainer(watcher.ContainerName+watcher.Postfix, watcher.ImageName, "exited")
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+
+	plan := watcher.Plan()
+	for _, call := range docker.Calls() {
+		assert.Contains(t, []string{"ContainerList", "ContainerInspect", "ImageInspectWithRaw"}, call)
+	}
+	mockData.assertDBRenamed(t, watcher, false)
+	assert.True(t, docker.Container(watcher.ContainerName).State.Running)
+
+	assert.Len(t, plan.Matched, 2)
+	assert.Empty(t, plan.Error)
+	if assert.NotNil(t, plan.Stop) {
+		assert.Equal(t, nodeID, plan.Stop.ID)
+	}
+	if assert.NotNil(t, plan.RemoveOld) {
+		assert.Equal(t, oldID, plan.RemoveOld.ID)
+	}
+	assert.Equal(t, &PlanRename{From: "/" + watcher.ContainerName, To: "/" + watcher.ContainerName + watcher.Postfix}, plan.Rename)
+	assert.False(t, plan.BrandNew)
+	if assert.NotNil(t, plan.Create) {
+		assert.Equal(t, watcher.ImageName, plan.Create.Config.Image)
+	}
+	assert.Len(t, plan.DBMoves, 2*len(watcher.dataDirs()))
+	for _, move := range plan.DBMoves {
+		assert.True(t, strings.HasPrefix(move.To, watcher.Backups.containerDir(watcher.ContainerName)+"/"+snapshotNext+"/"), move.To)
+	}
+
+	var text bytes.Buffer
+	plan.WriteText(&text)
+	assert.Contains(t, text.String(), "  ~ stop "+shortID(nodeID)+" /"+watcher.ContainerName+"\n")
+	assert.Contains(t, text.String(), "  - remove "+shortID(oldID)+" /"+watcher.ContainerName+watcher.Postfix+"\n")
+	assert.Contains(t, text.String(), "  + create /"+watcher.ContainerName+" from node container\n")
+	assert.Contains(t, text.String(), "  ~ move "+plan.DBMoves[0].From+" => "+plan.DBMoves[0].To+"\n")
+
+	var encoded bytes.Buffer
+	assert.NoError(t, WritePlansJSON(&encoded, []UpdatePlan{plan}))
+	var decoded []UpdatePlan
+	assert.NoError(t, json.Unmarshal(encoded.Bytes(), &decoded))
+	if assert.Len(t, decoded, 1) {
+		assert.Equal(t, plan.DBMoves, decoded[0].DBMoves)
+		assert.Equal(t, plan.Rename, decoded[0].Rename)
+	}
+}
+
+func TestPlanBrandNew(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	docker.ContainerRemove(watcher.BackgroundContex, watcher.ContainerName, types.ContainerRemoveOptions{Force: true})
+
+	plan := watcher.Plan()
+	assert.Empty(t, plan.Matched)
+	assert.Nil(t, plan.Stop)
+	assert.Nil(t, plan.Rename)
+	assert.True(t, plan.BrandNew)
+	assert.Empty(t, plan.Error)
+	assert.NotNil(t, plan.Create)
+	assert.Nil(t, docker.Container(watcher.ContainerName))
+
+	watcher.Node.BaseDir = ""
+	plan = watcher.Plan()
+	assert.Contains(t, plan.Error, ErrorConfigCreateNew.Error())
+	var text bytes.Buffer
+	plan.WriteText(&text)
+	assert.Contains(t, text.String(), "  ! update fails: ")
+}
+
+func TestPlanInvalidFlags(t *testing.T) {
+	global := flag.NewFlagSet("watcher", flag.ContinueOnError)
+	global.String("host", "", "")
+	assert.NoError(t, global.Parse([]string{"--host", "bad host"}))
+	set := flag.NewFlagSet("plan", flag.ContinueOnError)
+	set.String("db-reset", "", "")
+	assert.NoError(t, set.Parse([]string{"--db-reset", "sometimes"}))
+	c := cli.NewContext(cli.NewApp(), set, cli.NewContext(cli.NewApp(), global, nil))
+
+	err := planAction(c, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "--db-reset \"sometimes\"", "flags are checked before connecting to docker")
+	}
+}
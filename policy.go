@@ -0,0 +1,182 @@
+package main
+
+// Update policies choosing the image an update moves to, a tag, the highest semver tag of a constraint
+// or channel, or a pinned digest
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Masterminds/semver/v3"
+	log "github.com/google/logger"
+)
+
+// Tracks of UpdatePolicy
+const (
+	trackTag     = "tag"     // follow the tag of image
+	trackSemver  = "semver"  // follow the highest release tag matching constraint
+	trackChannel = "channel" // follow the highest tag of channel matching constraint
+	trackDigest  = "digest"  // stay on digest
+)
+
+// Channels of channel track
+const (
+	channelStable = "stable" // releases only
+	channelBeta   = "beta"   // prereleases too
+)
+
+// UpdatePolicy how the image of an update is chosen, nil policy follows the tag of image
+type UpdatePolicy struct {
+	Track          string
+	Constraint     *semver.Constraints // versions semver and channel tracks may move to, nil for all
+	Channel        string
+	Digest         string
+	ApprovedMajor  uint64 // major version updates may move to without approval, beside the running one
+	AllowDowngrade bool   // semver and channel tracks may move to a version lower than the running one
+}
+
+// NewUpdatePolicy build policy of configuration, nil when the tag of image is followed
+func NewUpdatePolicy(config PolicyConfig) (*UpdatePolicy, error) {
+	policy := &UpdatePolicy{Track: config.Track, Channel: config.Channel, Digest: config.Digest,
+		ApprovedMajor: config.ApprovedMajor, AllowDowngrade: config.AllowDowngrade}
+	switch config.Track {
+	case "", trackTag:
+		return nil, nil
+	case trackSemver, trackChannel:
+		if config.Track == trackChannel && config.Channel != channelStable && config.Channel != channelBeta {
+			return nil, fmt.Errorf("channel %q is not one of %s, %s", config.Channel, channelStable, channelBeta)
+		}
+		if len(config.Constraint) > 0 {
+			constraint, err := semver.NewConstraint(config.Constraint)
+			if err != nil {
+				return nil, fmt.Errorf("constraint %q: %s", config.Constraint, err)
+			}
+			policy.Constraint = constraint
+		}
+	case trackDigest:
+		if _, err := ParseImageReference("image@" + config.Digest); err != nil {
+			return nil, fmt.Errorf("digest %q: %s", config.Digest, err)
+		}
+	default:
+		return nil, fmt.Errorf("track %q is not one of %s, %s, %s, %s", config.Track, trackTag, trackSemver, trackChannel, trackDigest)
+	}
+	return policy, nil
+}
+
+// movesTag tell if the node container may run another tag or digest than the one of image
+func (p *UpdatePolicy) movesTag() bool {
+	return p != nil && p.Track != trackTag
+}
+
+// accepts tell if version may be the target, prereleases are accepted by beta channel only
+// and checked against constraint as their release
+func (p *UpdatePolicy) accepts(version *semver.Version) bool {
+	if len(version.Prerelease()) > 0 {
+		if p.Track != trackChannel || p.Channel != channelBeta {
+			return false
+		}
+		release, err := version.SetPrerelease("")
+		if err != nil {
+			return false
+		}
+		version = &release
+	}
+	return p.Constraint == nil || p.Constraint.Check(version)
+}
+
+// pickVersion return the tag of the highest accepted version whose major is at most allowedMajor,
+// and the tag of a higher major version awaiting approval, empty when there is none.
+// Versions lower than running are not picked unless downgrade is allowed
+func (p *UpdatePolicy) pickVersion(tags []string, allowedMajor uint64, running *semver.Version) (tag, awaiting string) {
+	versions := []*semver.Version{}
+	byVersion := map[*semver.Version]string{}
+	for _, t := range tags {
+		version, err := semver.NewVersion(t)
+		if err != nil || !p.accepts(version) {
+			continue
+		}
+		if running != nil && !p.AllowDowngrade && version.LessThan(running) {
+			continue
+		}
+		versions = append(versions, version)
+		byVersion[version] = t
+	}
+	sort.Sort(sort.Reverse(semver.Collection(versions)))
+	for _, version := range versions {
+		if version.Major() <= allowedMajor {
+			return byVersion[version], awaiting
+		}
+		if len(awaiting) == 0 {
+			awaiting = byVersion[version]
+		}
+	}
+	return "", awaiting
+}
+
+// resolveTarget return the reference the next update moves to and the tag awaiting major version approval
+func (w *NodeWatcher) resolveTarget() (ImageReference, string, error) {
+	target := w.Reference
+	switch {
+	case !w.Policy.movesTag():
+		return target, "", nil
+	case w.Policy.Track == trackDigest:
+		target.Tag, target.Digest = "", w.Policy.Digest
+		return target, "", nil
+	case w.Registry == nil:
+		return target, "", fmt.Errorf("%s track lists tags of registry, registry is not set", w.Policy.Track)
+	}
+	tags, err := w.Registry.Tags(w.BackgroundContex, target.Path)
+	if err != nil {
+		return target, "", ErrCombind(ErrorRegistryQuery, err)
+	}
+	allowedMajor := w.Policy.ApprovedMajor
+	if approved := w.status.approvedMajor(); approved > allowedMajor {
+		allowedMajor = approved
+	}
+	running := w.runningVersion()
+	if running != nil && running.Major() > allowedMajor {
+		allowedMajor = running.Major()
+	}
+	tag, awaiting := w.Policy.pickVersion(tags, allowedMajor, running)
+	if len(tag) == 0 && running != nil && !w.Policy.AllowDowngrade {
+		return target, awaiting, fmt.Errorf("no tag of %s from running version %s up is accepted by %s track, downgrade is not allowed",
+			target.Name(), running.Original(), w.Policy.Track)
+	}
+	if len(tag) == 0 {
+		return target, awaiting, fmt.Errorf("no tag of %s is accepted by %s track", target.Name(), w.Policy.Track)
+	}
+	target.Tag, target.Digest = tag, ""
+	return target, awaiting, nil
+}
+
+// runningVersion return the version of the tag node container is created from, nil when it is not a version
+func (w *NodeWatcher) runningVersion() *semver.Version {
+	nodeContainer, err := w.DockerClient.ContainerInspect(w.BackgroundContex, w.ContainerName)
+	if err != nil || nodeContainer.Config == nil {
+		return nil
+	}
+	ref, err := ParseImageReference(nodeContainer.Config.Image)
+	if err != nil || !w.Reference.SameRepository(ref.Name()) {
+		return nil
+	}
+	version, err := semver.NewVersion(ref.Tag)
+	if err != nil {
+		return nil
+	}
+	return version
+}
+
+// recordAwaiting keep the version waiting for major approval in status, it is logged once
+func (w *NodeWatcher) recordAwaiting(awaiting string) {
+	if len(awaiting) > 0 && awaiting != w.status.awaitingApproval() {
+		log.Warning("image:", w.Reference.Name(), ":", awaiting, " is a new major version, it waits for approval")
+	}
+	w.status.setAwaiting(awaiting)
+}
+
+// ApproveMajor allow updates to move to major version, the image is checked again
+func (w *NodeWatcher) ApproveMajor(major uint64) {
+	w.status.approveMajor(major)
+	log.Info("major version:", major, " of container:", w.ContainerName, " is approved")
+	w.status.requestCheck(triggerAPI)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+const mockPolicyImage = "bitmark/bitmark-node-test"
+
+// mockTagRegistry registry stand-in listing its tags in two pages, tags can be published while it runs
+type mockTagRegistry struct {
+	*httptest.Server
+	lock sync.Mutex
+	tags map[string]string // tag -> digest
+}
+
+func newMockTagRegistry(tags map[string]string) *mockTagRegistry {
+	registry := &mockTagRegistry{tags: tags}
+	mux := http.NewServeMux()
+	registry.Server = httptest.NewServer(mux)
+	mux.HandleFunc("/v2/"+mockPolicyImage+"/tags/list", func(w http.ResponseWriter, r *http.Request) {
+		registry.lock.Lock()
+		defer registry.lock.Unlock()
+		names := []string{}
+		for tag := range registry.tags {
+			names = append(names, tag)
+		}
+		sort.Strings(names)
+		half := len(names) / 2
+		page := names[:half]
+		if last := r.URL.Query().Get("last"); len(last) > 0 {
+			page = names[half:]
+		} else {
+			w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?last=%s&n=%d>; rel="next"`, mockPolicyImage, names[half-1], half))
+		}
+		json.NewEncoder(w).Encode(tagsResponse{Tags: page})
+	})
+	mux.HandleFunc("/v2/"+mockPolicyImage+"/manifests/", func(w http.ResponseWriter, r *http.Request) {
+		registry.lock.Lock()
+		defer registry.lock.Unlock()
+		ref := strings.TrimPrefix(r.URL.Path, "/v2/"+mockPolicyImage+"/manifests/")
+		digest, ok := registry.tags[ref]
+		for _, d := range registry.tags {
+			ok = ok || d == ref
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if len(digest) == 0 {
+			digest = ref
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+	})
+	return registry
+}
+
+// publish push image of tag to registry and to the registry of fake daemon
+func (r *mockTagRegistry) publish(docker *FakeDocker, tag, id, digest string) {
+	r.lock.Lock()
+	r.tags[tag] = digest
+	r.lock.Unlock()
+	docker.PublishImage(mockPolicyImage+":"+tag, id, digest)
+}
+
+func mockVersionDigest(n int) string {
+	return fmt.Sprintf("sha256:%064x", 0x100+n)
+}
+
+// getPolicyWatcher return a watcher of node container running tag 1.4.1 with policy of config
+func getPolicyWatcher(t *testing.T, config PolicyConfig) (*NodeWatcher, *FakeDocker, *mockTagRegistry) {
+	docker := NewFakeDocker()
+	watcher := NewNodeWatcher(docker, context.Background(), mockPolicyImage, "bitmarkNodePolicy")
+	watcher.Rollback = RollbackPolicy{}
+	dataRoot, err := ioutil.TempDir(mockData.BaseDir, "root")
+	assert.NoError(t, err)
+	watcher.DataRoot = dataRoot
+	watcher.Node.BaseDir = mockData.BaseDir
+	policy, err := NewUpdatePolicy(config)
+	assert.NoError(t, err)
+	watcher.Policy = policy
+
+	registry := newMockTagRegistry(map[string]string{"latest": mockVersionDigest(0)})
+	watcher.Registry = NewRegistryClient(registry.URL)
+	registry.publish(docker, "1.4.1", mockOldImageID, mockOldDigest)
+	docker.AddImage(mockPolicyImage+":1.4.1", mockOldImageID, mockOldDigest)
+	docker.AddContainer(watcher.ContainerName, mockPolicyImage+":1.4.1", containerStateRunning)
+	return watcher, docker, registry
+}
+
+func TestNewUpdatePolicy(t *testing.T) {
+	for _, config := range []PolicyConfig{{}, {Track: trackTag}} {
+		policy, err := NewUpdatePolicy(config)
+		assert.NoError(t, err)
+		assert.Nil(t, policy)
+	}
+	for _, config := range []PolicyConfig{{Track: trackSemver, Constraint: "~1.4"}, {Track: trackSemver},
+		{Track: trackChannel, Channel: channelBeta, Constraint: "^1.2.0"}, {Track: trackDigest, Digest: mockNewDigest}} {
+		policy, err := NewUpdatePolicy(config)
+		assert.NoError(t, err, config.Track)
+		assert.True(t, policy.movesTag())
+	}
+	for _, config := range []PolicyConfig{{Track: "newest"}, {Track: trackSemver, Constraint: "about 1.4"},
+		{Track: trackChannel, Channel: "nightly"}, {Track: trackDigest, Digest: "latest"}} {
+		_, err := NewUpdatePolicy(config)
+		assert.Error(t, err, config.Track)
+	}
+}
+
+func TestPickVersion(t *testing.T) {
+	tags := []string{"latest", "1.3.9", "1.4.0", "v1.4.2", "1.4.3-beta.1", "1.5.0", "1.5.1-rc.1", "2.0.0", "2.1.0-beta.1"}
+	cases := []struct {
+		config   PolicyConfig
+		major    uint64
+		running  string
+		tag      string
+		awaiting string
+	}{
+		{config: PolicyConfig{Track: trackSemver, Constraint: "~1.4"}, major: 1, tag: "v1.4.2"},
+		{config: PolicyConfig{Track: trackSemver}, major: 1, tag: "1.5.0", awaiting: "2.0.0"},
+		{config: PolicyConfig{Track: trackSemver}, major: 2, tag: "2.0.0"},
+		{config: PolicyConfig{Track: trackChannel, Channel: channelStable}, major: 2, tag: "2.0.0"},
+		{config: PolicyConfig{Track: trackChannel, Channel: channelBeta, Constraint: "~1.4"}, major: 1, tag: "1.4.3-beta.1"},
+		{config: PolicyConfig{Track: trackChannel, Channel: channelBeta}, major: 1, tag: "1.5.1-rc.1", awaiting: "2.1.0-beta.1"},
+		{config: PolicyConfig{Track: trackSemver, Constraint: ">=3"}, major: 3, tag: ""},
+		{config: PolicyConfig{Track: trackSemver, Constraint: "~1.4"}, major: 1, running: "1.4.1", tag: "v1.4.2"},
+		{config: PolicyConfig{Track: trackSemver, Constraint: "~1.4"}, major: 1, running: "1.5.0", tag: ""},
+		{config: PolicyConfig{Track: trackSemver, Constraint: "~1.4", AllowDowngrade: true}, major: 1, running: "1.5.0", tag: "v1.4.2"},
+		{config: PolicyConfig{Track: trackChannel, Channel: channelStable}, major: 1, running: "1.5.1-rc.1", tag: "", awaiting: "2.0.0"},
+	}
+	for _, c := range cases {
+		policy, err := NewUpdatePolicy(c.config)
+		assert.NoError(t, err)
+		var running *semver.Version
+		if len(c.running) > 0 {
+			running = semver.MustParse(c.running)
+		}
+		tag, awaiting := policy.pickVersion(tags, c.major, running)
+		assert.Equal(t, c.tag, tag, "%+v", c.config)
+		assert.Equal(t, c.awaiting, awaiting, "%+v", c.config)
+	}
+}
+
+func TestSemverUpdate(t *testing.T) {
+	watcher, docker, registry := getPolicyWatcher(t, PolicyConfig{Track: trackSemver, Constraint: ">=1.4"})
+	defer registry.Close()
+	registry.publish(docker, "1.4.2", mockNewImageID, mockNewDigest)
+	registry.publish(docker, "1.3.9", "old-release", mockVersionDigest(1))
+
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+	assert.True(t, update.Updated)
+	assert.Equal(t, "docker.io/"+mockPolicyImage+":1.4.2", update.Image)
+	assert.Equal(t, mockNewDigest, update.NewDigest)
+	_, err = runUpdate(watcher, update)
+	assert.NoError(t, err)
+	node := docker.Container(watcher.ContainerName)
+	assert.Equal(t, mockNewImageID, node.Image)
+	assert.Equal(t, update.Image+"@"+update.NewDigest, node.Config.Image)
+
+	// a new major version waits for approval
+	registry.publish(docker, "2.0.0", "major", mockVersionDigest(2))
+	update, err = watcher.checkImage()
+	assert.NoError(t, err)
+	assert.False(t, update.Updated)
+	assert.Equal(t, "2.0.0", watcher.Status().Awaiting)
+	plan := watcher.Plan()
+	assert.Equal(t, "2.0.0", plan.Awaiting)
+	assert.Equal(t, "docker.io/"+mockPolicyImage+":1.4.2", plan.Target)
+
+	recorder := httptest.NewRecorder()
+	NewAPIServer([]*NodeWatcher{watcher}, "").Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/approve", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	update, err = watcher.checkImage()
+	assert.NoError(t, err)
+	assert.True(t, update.Updated)
+	assert.Equal(t, "docker.io/"+mockPolicyImage+":2.0.0", update.Image)
+	assert.Empty(t, watcher.Status().Awaiting)
+
+	recorder = httptest.NewRecorder()
+	NewAPIServer([]*NodeWatcher{watcher}, "").Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/approve", nil))
+	assert.Equal(t, http.StatusConflict, recorder.Code, "nothing awaits approval")
+}
+
+func TestSemverRefusesDowngrade(t *testing.T) {
+	watcher, docker, registry := getPolicyWatcher(t, PolicyConfig{Track: trackSemver})
+	defer registry.Close()
+	// the registry drops 1.4.1 which the node container runs
+	registry.lock.Lock()
+	delete(registry.tags, "1.4.1")
+	registry.lock.Unlock()
+	registry.publish(docker, "1.4.0", "dropped-below", mockVersionDigest(1))
+
+	update, err := watcher.checkImage()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "downgrade is not allowed")
+	}
+	assert.False(t, update.Updated)
+	assert.Equal(t, mockOldImageID, docker.Container(watcher.ContainerName).Image)
+
+	watcher.Policy.AllowDowngrade = true
+	update, err = watcher.checkImage()
+	assert.NoError(t, err)
+	assert.True(t, update.Updated)
+	assert.Equal(t, "docker.io/"+mockPolicyImage+":1.4.0", update.Image)
+}
+
+func TestDigestPolicy(t *testing.T) {
+	watcher, docker, registry := getPolicyWatcher(t, PolicyConfig{Track: trackDigest, Digest: mockNewDigest})
+	defer registry.Close()
+	registry.publish(docker, "1.4.2", mockNewImageID, mockNewDigest)
+	registry.publish(docker, "1.5.0", "newer", mockVersionDigest(1))
+
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+	assert.True(t, update.Updated)
+	assert.Equal(t, "docker.io/"+mockPolicyImage+"@"+mockNewDigest, update.Image)
+	_, err = runUpdate(watcher, update)
+	assert.NoError(t, err)
+	assert.Equal(t, mockNewImageID, docker.Container(watcher.ContainerName).Image)
+
+	update, err = watcher.checkImage()
+	assert.NoError(t, err)
+	assert.False(t, update.Updated, "pinned digest is running")
+}
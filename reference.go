@@ -0,0 +1,90 @@
+package main
+
+// Normalized image references, names given as docker CLI accepts them are resolved to registry, repository,
+// tag and digest so that short and full forms of the same image compare equal
+
+import (
+	"github.com/docker/distribution/reference"
+)
+
+const dockerHubDomain = "docker.io"
+
+// ImageReference an image in a registry
+type ImageReference struct {
+	Domain string // registry host[:port], docker.io for docker hub
+	Path   string // repository in the registry, official images are under library/
+	Tag    string // latest when neither tag nor digest is given
+	Digest string // sha256:..., the image is pinned when set
+}
+
+// ParseImageReference normalize name such as bitmark/bitmark-node, docker.io/library/alpine:3 or
+// registry.local:5000/bitmark/bitmark-node:v1.2@sha256:...
+func ParseImageReference(name string) (ImageReference, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return ImageReference{}, err
+	}
+	ref := ImageReference{Domain: reference.Domain(named), Path: reference.Path(named)}
+	if tagged, ok := named.(reference.Tagged); ok {
+		ref.Tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		ref.Digest = digested.Digest().String()
+	}
+	if len(ref.Tag) == 0 && len(ref.Digest) == 0 {
+		ref.Tag = defaultImageTag
+	}
+	return ref, nil
+}
+
+// Name return domain/path, the repository of RepoDigests and RepoTags in full form
+func (r ImageReference) Name() string {
+	return r.Domain + "/" + r.Path
+}
+
+// String return the full reference to pull
+func (r ImageReference) String() string {
+	s := r.Name()
+	if len(r.Tag) > 0 {
+		s += ":" + r.Tag
+	}
+	if len(r.Digest) > 0 {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// ManifestReference return the digest or tag to query the manifest of
+func (r ImageReference) ManifestReference() string {
+	if len(r.Digest) > 0 {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// RegistryURL return URL of the registry API of the domain
+func (r ImageReference) RegistryURL() string {
+	if r.Domain == dockerHubDomain {
+		return defaultRegistryURL
+	}
+	return "https://" + r.Domain
+}
+
+// SameRepository tell if name, in short or full form with or without tag, is in the repository of r
+func (r ImageReference) SameRepository(name string) bool {
+	other, err := ParseImageReference(name)
+	return err == nil && other.Name() == r.Name()
+}
+
+// Matches tell if name refers to the same tag or digest of the repository of r,
+// a name without digest matches the tag of a reference pinned by digest
+func (r ImageReference) Matches(name string) bool {
+	other, err := ParseImageReference(name)
+	if err != nil || other.Name() != r.Name() {
+		return false
+	}
+	if len(other.Digest) > 0 && len(r.Digest) > 0 {
+		return other.Digest == r.Digest
+	}
+	return other.Tag == r.Tag
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const mockCustomImage = "registry.local:5000/bitmark/bitmark-node:v1.2"
+
+func TestParseImageReference(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected ImageReference
+		full     string
+	}{
+		{name: "bitmark/bitmark-node", expected: ImageReference{Domain: "docker.io", Path: "bitmark/bitmark-node", Tag: "latest"},
+			full: "docker.io/bitmark/bitmark-node:latest"},
+		{name: "bitmark/bitmark-node:v1.2", expected: ImageReference{Domain: "docker.io", Path: "bitmark/bitmark-node", Tag: "v1.2"},
+			full: "docker.io/bitmark/bitmark-node:v1.2"},
+		{name: "alpine", expected: ImageReference{Domain: "docker.io", Path: "library/alpine", Tag: "latest"},
+			full: "docker.io/library/alpine:latest"},
+		{name: mockCustomImage, expected: ImageReference{Domain: "registry.local:5000", Path: "bitmark/bitmark-node", Tag: "v1.2"},
+			full: mockCustomImage},
+		{name: "localhost/bitmark-node@" + mockNewDigest,
+			expected: ImageReference{Domain: "localhost", Path: "bitmark-node", Digest: mockNewDigest},
+			full:     "localhost/bitmark-node@" + mockNewDigest},
+	}
+	for _, c := range cases {
+		ref, err := ParseImageReference(c.name)
+		assert.NoError(t, err, c.name)
+		assert.Equal(t, c.expected, ref, c.name)
+		assert.Equal(t, c.full, ref.String(), c.name)
+	}
+	for _, name := range []string{"", "Bitmark/Node", "bitmark/bitmark-node:v1:2"} {
+		_, err := ParseImageReference(name)
+		assert.Error(t, err, name)
+	}
+
+	ref, _ := ParseImageReference(mockCustomImage)
+	assert.Equal(t, "https://registry.local:5000", ref.RegistryURL())
+	assert.Equal(t, "v1.2", ref.ManifestReference())
+	ref, _ = ParseImageReference("bitmark/bitmark-node")
+	assert.Equal(t, defaultRegistryURL, ref.RegistryURL())
+	assert.Equal(t, dockerHubHost, registryHost(ref.Domain))
+}
+
+func TestImageReferenceMatches(t *testing.T) {
+	ref, _ := ParseImageReference("bitmark/bitmark-node")
+	for _, name := range []string{"bitmark/bitmark-node", "bitmark/bitmark-node:latest", "docker.io/bitmark/bitmark-node:latest",
+		"index.docker.io/bitmark/bitmark-node"} {
+		assert.True(t, ref.Matches(name), name)
+	}
+	for _, name := range []string{"bitmark/bitmark-node:v1.2", "bitmark/bitmark-node-test", "registry.local:5000/bitmark/bitmark-node",
+		mockOldImageID} {
+		assert.False(t, ref.Matches(name), name)
+	}
+	assert.True(t, ref.SameRepository("bitmark/bitmark-node:v1.2"))
+	assert.True(t, ref.SameRepository("bitmark/bitmark-node@"+mockOldDigest))
+
+	pinned, _ := ParseImageReference("bitmark/bitmark-node@" + mockOldDigest)
+	assert.True(t, pinned.Matches("docker.io/bitmark/bitmark-node@"+mockOldDigest))
+	assert.False(t, pinned.Matches("bitmark/bitmark-node@"+mockNewDigest))
+}
+
+func TestUpdateCustomRegistry(t *testing.T) {
+	docker := NewFakeDocker()
+	watcher := NewNodeWatcher(docker, context.Background(), mockCustomImage, "bitmarkNodeCustom")
+	watcher.Rollback = RollbackPolicy{}
+	watcher.Node.BaseDir = mockData.BaseDir
+	assert.Equal(t, mockCustomImage, watcher.Reference.String())
+	docker.AddImage(mockCustomImage, mockOldImageID, mockOldDigest)
+	docker.AddImage("bitmark/bitmark-node:v1.2", "other", mockNewDigest) // same path on docker hub
+	docker.AddContainer(watcher.ContainerName, mockCustomImage, containerStateRunning)
+	docker.AddContainer("hubNode", "bitmark/bitmark-node:v1.2", containerStateRunning)
+
+	matched, err := watcher.getContainersWithImage()
+	assert.NoError(t, err)
+	if assert.Len(t, matched, 1) {
+		assert.Equal(t, "/"+watcher.ContainerName, matched[0].Names[0])
+	}
+
+	docker.PublishImage(mockCustomImage, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+	assert.True(t, update.Updated)
+	assert.Equal(t, mockOldDigest, update.OldDigest)
+	assert.Equal(t, mockNewDigest, update.NewDigest)
+
+	// the tag is moved, docker lists the node container by image ID
+	matched, err = watcher.getContainersWithImage()
+	assert.NoError(t, err)
+	if assert.Len(t, matched, 1) {
+		assert.Equal(t, mockOldImageID, matched[0].Image)
+	}
+	runUpdate(watcher, update)
+	assert.Equal(t, mockNewImageID, docker.Container(watcher.ContainerName).Image)
+	assert.Equal(t, "other", docker.Container("hubNode").Image)
+}
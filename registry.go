@@ -0,0 +1,311 @@
+package main
+
+// Query image manifest digests from a docker registry (v2 API) without pulling
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRegistryURL     = "https://registry-1.docker.io"
+	registryRequestTimeout = 30 * time.Second
+	registryClientID       = "bitmark-node-watcher" // client_id of OAuth2 token requests
+	defaultImageTag        = "latest"
+)
+
+// manifestMediaTypes accepted manifest, list types first so digest matches the one recorded by docker pull
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// RegistryClient query manifest digest from a registry
+type RegistryClient struct {
+	BaseURL     string
+	HTTPClient  *http.Client
+	Credentials *CredentialStore // credentials of token server and basic auth, nil to query anonymously
+	lock        sync.Mutex
+	tokens      map[string]registryToken // scope -> token
+}
+
+type registryToken struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+// tokenResponse is the response of token server
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// NewRegistryClient create a RegistryClient for registry baseURL
+func NewRegistryClient(baseURL string) *RegistryClient {
+	if len(baseURL) == 0 {
+		baseURL = defaultRegistryURL
+	}
+	return &RegistryClient{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: registryRequestTimeout},
+		tokens:     make(map[string]registryToken),
+	}
+}
+
+// ManifestDigest return the digest of manifest of repository:tag
+func (r *RegistryClient) ManifestDigest(ctx context.Context, repository, tag string) (string, error) {
+	manifestURL := fmt.Sprintf("%s/v2/%s/manifests/%s", r.BaseURL, repository, tag)
+	resp, err := r.do(ctx, http.MethodHead, manifestURL, repository)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if digest := resp.Header.Get("Docker-Content-Digest"); len(digest) > 0 {
+		return digest, nil
+	}
+	// Some registries do not return digest for HEAD, compute it from the manifest content
+	resp, err = r.do(ctx, http.MethodGet, manifestURL, repository)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if digest := resp.Header.Get("Docker-Content-Digest"); len(digest) > 0 {
+		return digest, nil
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, resp.Body); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), nil
+}
+
+// tagsResponse is the response of tags list
+type tagsResponse struct {
+	Tags []string `json:"tags"`
+}
+
+// Tags return all tags of repository, pages given by Link headers are followed
+func (r *RegistryClient) Tags(ctx context.Context, repository string) ([]string, error) {
+	tags := []string{}
+	next := fmt.Sprintf("%s/v2/%s/tags/list", r.BaseURL, repository)
+	for len(next) > 0 {
+		resp, err := r.do(ctx, http.MethodGet, next, repository)
+		if err != nil {
+			return nil, err
+		}
+		var page tagsResponse
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		link := resp.Header.Get("Link")
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page.Tags...)
+		next = ""
+		if start, end := strings.Index(link, "<"), strings.Index(link, ">"); start >= 0 && end > start &&
+			strings.Contains(link[end:], `rel="next"`) {
+			u, err := url.Parse(r.BaseURL)
+			if err != nil {
+				return nil, err
+			}
+			ref, err := url.Parse(link[start+1 : end])
+			if err != nil {
+				return nil, err
+			}
+			next = u.ResolveReference(ref).String()
+		}
+	}
+	return tags, nil
+}
+
+// do send request and authorize with bearer token or basic credentials when the registry ask for it
+func (r *RegistryClient) do(ctx context.Context, method, target, repository string) (*http.Response, error) {
+	scope := "repository:" + repository + ":pull"
+	authorization := ""
+	if token := r.cachedToken(scope); len(token) > 0 {
+		authorization = "Bearer " + token
+	}
+	resp, err := r.send(ctx, method, target, authorization)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		authorization, err = r.authorize(ctx, challenge, scope)
+		if err != nil {
+			r.Credentials.Invalidate(r.BaseURL) // rejected credentials are looked up again next time
+			return nil, ErrCombind(ErrorRegistryAuth, err)
+		}
+		resp, err = r.send(ctx, method, target, authorization)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			r.Credentials.Invalidate(r.BaseURL)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, target, resp.Status)
+	}
+	return resp, nil
+}
+
+// authorize return Authorization header answering the challenge
+func (r *RegistryClient) authorize(ctx context.Context, challenge, scope string) (string, error) {
+	if strings.HasPrefix(strings.ToLower(strings.TrimSpace(challenge)), "basic") {
+		auth, err := r.Credentials.Get(r.BaseURL)
+		if err != nil {
+			return "", err
+		}
+		if len(auth.Username) == 0 {
+			return "", fmt.Errorf("registry requires credentials of %s", registryHost(r.BaseURL))
+		}
+		return "Basic " + basicAuth(auth.Username, auth.Password), nil
+	}
+	token, err := r.fetchToken(ctx, challenge, scope)
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + token, nil
+}
+
+func (r *RegistryClient) send(ctx context.Context, method, target, authorization string) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if len(authorization) > 0 {
+		req.Header.Set("Authorization", authorization)
+	}
+	return r.HTTPClient.Do(req)
+}
+
+func (r *RegistryClient) cachedToken(scope string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	token, ok := r.tokens[scope]
+	if !ok || time.Now().After(token.ExpiresAt) {
+		return ""
+	}
+	return token.Token
+}
+
+// fetchToken get a token from the realm given in the challenge, credentials are sent as basic auth,
+// an identity token is exchanged by OAuth2 refresh token grant
+func (r *RegistryClient) fetchToken(ctx context.Context, challenge, scope string) (string, error) {
+	params := parseAuthChallenge(challenge)
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("unsupported auth challenge: %q", challenge)
+	}
+	auth, err := r.Credentials.Get(r.BaseURL)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	query.Set("scope", scope)
+	var req *http.Request
+	if len(auth.IdentityToken) > 0 {
+		query.Set("grant_type", "refresh_token")
+		query.Set("refresh_token", auth.IdentityToken)
+		query.Set("client_id", registryClientID)
+		req, err = http.NewRequest(http.MethodPost, realm, strings.NewReader(query.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest(http.MethodGet, realm+"?"+query.Encode(), nil)
+		if err == nil && len(auth.Username) > 0 {
+			req.SetBasicAuth(auth.Username, auth.Password)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", fmt.Errorf("token server: %s", resp.Status)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", err
+	}
+	token := tr.Token
+	if len(token) == 0 {
+		token = tr.AccessToken
+	}
+	if len(token) == 0 {
+		return "", fmt.Errorf("token server returns empty token")
+	}
+	expiresIn := time.Duration(tr.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = 60 * time.Second // default lifetime of the token spec
+	}
+	r.lock.Lock()
+	r.tokens[scope] = registryToken{Token: token, ExpiresAt: time.Now().Add(expiresIn)}
+	r.lock.Unlock()
+	return token, nil
+}
+
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+// parseAuthChallenge parse `Bearer realm="...",service="...",scope="..."` into key/value
+func parseAuthChallenge(challenge string) map[string]string {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return params
+	}
+	rest := parts[1]
+	for len(rest) > 0 {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return params
+}
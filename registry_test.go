@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const mockManifestDigest = "sha256:4b825dc642cb6eb9a060e54bf8d69288fbee4904b4e1ab1c1b1a1b2c3d4e5f60"
+
+// newMockRegistry start a registry stand-in which requires a bearer token from its token endpoint
+func newMockRegistry(t *testing.T, withDigestHeader bool) (*httptest.Server, *int) {
+	tokenRequests := 0
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		assert.Equal(t, "registry.test", r.URL.Query().Get("service"))
+		assert.Equal(t, "repository:bitmark/bitmark-node:pull", r.URL.Query().Get("scope"))
+		fmt.Fprint(w, `{"token":"test-token","expires_in":300}`)
+	})
+	mux.HandleFunc("/v2/bitmark/bitmark-node/manifests/latest", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Bearer realm="%s/token",service="registry.test",scope="repository:bitmark/bitmark-node:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if withDigestHeader {
+			w.Header().Set("Docker-Content-Digest", mockManifestDigest)
+		}
+		if r.Method == http.MethodGet {
+			fmt.Fprint(w, "{}")
+		}
+	})
+	return server, &tokenRequests
+}
+
+func TestManifestDigestWithToken(t *testing.T) {
+	server, tokenRequests := newMockRegistry(t, true)
+	defer server.Close()
+	registry := NewRegistryClient(server.URL)
+	digest, err := registry.ManifestDigest(context.Background(), "bitmark/bitmark-node", "latest")
+	assert.NoError(t, err, ErrorRegistryQuery.Error())
+	assert.Equal(t, mockManifestDigest, digest)
+	// token is cached
+	_, err = registry.ManifestDigest(context.Background(), "bitmark/bitmark-node", "latest")
+	assert.NoError(t, err, ErrorRegistryQuery.Error())
+	assert.Equal(t, 1, *tokenRequests)
+}
+
+func TestManifestDigestWithoutHeader(t *testing.T) {
+	server, _ := newMockRegistry(t, false)
+	defer server.Close()
+	registry := NewRegistryClient(server.URL)
+	digest, err := registry.ManifestDigest(context.Background(), "bitmark/bitmark-node", "latest")
+	assert.NoError(t, err, ErrorRegistryQuery.Error())
+	// sha256 of "{}"
+	assert.Equal(t, "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", digest)
+}
+
+func TestManifestDigestNotFound(t *testing.T) {
+	server, _ := newMockRegistry(t, true)
+	defer server.Close()
+	registry := NewRegistryClient(server.URL)
+	_, err := registry.ManifestDigest(context.Background(), "bitmark/bitmark-node", "missing")
+	assert.Error(t, err)
+}
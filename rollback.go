@@ -0,0 +1,185 @@
+package main
+
+// Watch the new node container and bring back the old one when it fails
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	log "github.com/google/logger"
+)
+
+const (
+	defaultRollbackGracePeriod = 60 * time.Second
+	defaultRollbackInterval    = 2 * time.Second
+	defaultRollbackMaxRestarts = 2
+)
+
+// RollbackPolicy decide how long and how strict a new container is watched
+type RollbackPolicy struct {
+	GracePeriod   time.Duration
+	CheckInterval time.Duration
+	MaxRestarts   int
+}
+
+// DefaultRollbackPolicy return the policy used when nothing is configured
+func DefaultRollbackPolicy() RollbackPolicy {
+	return RollbackPolicy{
+		GracePeriod:   defaultRollbackGracePeriod,
+		CheckInterval: defaultRollbackInterval,
+		MaxRestarts:   defaultRollbackMaxRestarts,
+	}
+}
+
+// watchContainer watch the new container during grace period, return error when it exits,
+// restarts more than allowed or is reported unhealthy by docker
+func (w *NodeWatcher) watchContainer(containerID string) error {
+	deadline := time.Now().Add(w.Rollback.GracePeriod)
+	interval := w.Rollback.CheckInterval
+	if interval <= 0 {
+		interval = defaultRollbackInterval
+	}
+	initialRestarts := -1
+	for {
+		info, err := w.DockerClient.ContainerInspect(w.BackgroundContex, containerID)
+		if err != nil {
+			return err
+		}
+		if initialRestarts < 0 {
+			initialRestarts = info.RestartCount
+		}
+		state := info.State
+		switch {
+		case state == nil:
+			return ErrCombind(ErrorContainerExited, fmt.Errorf("no state"))
+		case info.RestartCount-initialRestarts > w.Rollback.MaxRestarts:
+			return ErrCombind(ErrorContainerRestarting, fmt.Errorf("restart count: %d", info.RestartCount-initialRestarts))
+		case !state.Running && !state.Restarting:
+			return ErrCombind(ErrorContainerExited, fmt.Errorf("status: %s exit code: %d", state.Status, state.ExitCode))
+		case state.Health != nil && state.Health.Status == types.Unhealthy:
+			return ErrCombind(ErrorContainerUnhealthy, fmt.Errorf("failing streak: %d", state.Health.FailingStreak))
+		}
+		if !time.Now().Before(deadline) {
+			return nil
+		}
+		if !w.sleep(interval) {
+			return w.BackgroundContex.Err()
+		}
+	}
+}
+
+// rollback remove the new container, bring back the old container and the databases of snapshot
+func (w *NodeWatcher) rollback(newContainerID string, snapshot *SnapshotManifest) (finalerr error) {
+	log.Warning("rollback container:", w.ContainerName, " new container:", newContainerID)
+	if len(newContainerID) > 0 {
+		if err := w.forceRemoveContainer(newContainerID); err != nil {
+			return ErrCombind(ErrorRollback, err)
+		}
+	}
+	nodeContainer, err := w.DockerClient.ContainerInspect(w.BackgroundContex, w.ContainerName)
+	if err == nil { // update failed before the old container is renamed
+		if err := w.startContainer(nodeContainer.ID); err != nil {
+			return ErrCombind(ErrorRollback, err)
+		}
+		return nil
+	}
+	oldContainer, err := w.getOldContainer()
+	if err != nil {
+		return ErrCombind(ErrorRollback, err)
+	}
+	if oldContainer == nil {
+		return ErrCombind(ErrorRollback, ErrorNamedContainerNotFound)
+	}
+	if snapshot != nil {
+		if finalerr = w.restoreDB(snapshot); finalerr != nil {
+			log.Error(finalerr)
+		}
+		w.notify(eventDBRestored, ImageUpdate{}, finalerr)
+	}
+	if err := w.DockerClient.ContainerRename(w.BackgroundContex, oldContainer.ID, w.ContainerName); err != nil {
+		return ErrCombind(ErrorRollback, err)
+	}
+	if err := w.startContainer(oldContainer.ID); err != nil {
+		return ErrCombind(ErrorRollback, err)
+	}
+	log.Info("rollback container:", w.ContainerName, " to ", oldContainer.ID)
+	return finalerr
+}
+
+// rollbackToPrevious replace node container with the old container kept by the last update
+func (w *NodeWatcher) rollbackToPrevious(trigger string) error {
+	w.status.beginOperation()
+	defer w.status.endOperation()
+	oldContainer, err := w.getOldContainer()
+	if err != nil {
+		return ErrCombind(ErrorRollback, err)
+	}
+	if oldContainer == nil {
+		return ErrorNoPreviousContainer
+	}
+	current := ImageUpdate{}
+	if image, err := w.currentImage(); err == nil && image != nil {
+		current.NewID, current.NewDigest = image.ID, w.repoDigest(*image)
+	}
+	if image, _, err := w.DockerClient.ImageInspectWithRaw(w.BackgroundContex, oldContainer.ImageID); err == nil {
+		current.OldID, current.OldDigest = image.ID, w.repoDigest(image)
+	}
+	record := UpdateRecord{Container: w.ContainerName, Trigger: trigger, StartedAt: time.Now(),
+		OldImageID: current.NewID, OldDigest: current.NewDigest, NewImageID: current.OldID, NewDigest: current.OldDigest}
+	defer func() {
+		record.FinishedAt = time.Now()
+		w.status.recordUpdate(record)
+		w.metrics.recordRollback(record)
+	}()
+
+	nodeContainerID := ""
+	if nodeContainer, err := w.DockerClient.ContainerInspect(w.BackgroundContex, w.ContainerName); err == nil {
+		nodeContainerID = nodeContainer.ID
+	}
+	if err := w.detached().rollback(nodeContainerID, w.previousSnapshot(oldContainer.ImageID)); err != nil {
+		record.Result, record.Error = updateFailed, err.Error()
+		return err
+	}
+	record.Result = updateRolledBack
+	if len(current.NewID) > 0 {
+		w.pinImage(current)
+	}
+	w.notify(eventRollback, ImageUpdate{Trigger: trigger, OldID: current.NewID, OldDigest: current.NewDigest,
+		NewID: current.OldID, NewDigest: current.OldDigest}, nil)
+	return nil
+}
+
+// pinImage keep the current image and reject the new image of failed update
+func (w *NodeWatcher) pinImage(update ImageUpdate) {
+	log.Warning("pin image:", update.OldID, " ", update.OldDigest, " reject:", update.NewID, " ", update.NewDigest)
+	w.status.lock.Lock()
+	defer w.status.lock.Unlock()
+	w.status.pinned = &update
+}
+
+// unpinImage accept new images again after a successful update
+func (w *NodeWatcher) unpinImage() {
+	w.status.lock.Lock()
+	defer w.status.lock.Unlock()
+	w.status.pinned = nil
+}
+
+// pinnedImage return the update rolled back, nil if no image is pinned
+func (w *NodeWatcher) pinnedImage() *ImageUpdate {
+	w.status.lock.Lock()
+	defer w.status.lock.Unlock()
+	return w.status.pinned
+}
+
+// rejected tell if the image is the one rejected by rollback
+func (w *NodeWatcher) rejected(imageID, digest string) bool {
+	pinned := w.pinnedImage()
+	if pinned == nil {
+		return false
+	}
+	if len(digest) > 0 && digest == pinned.NewDigest {
+		return true
+	}
+	return len(imageID) > 0 && imageID == pinned.NewID
+}
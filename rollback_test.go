@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunUpdateRollback(t *testing.T) {
+	cases := []struct {
+		name      string
+		errReturn error
+		prepare   func(docker *FakeDocker)
+	}{
+		{
+			name:      "exit",
+			errReturn: ErrorContainerExited,
+			prepare: func(docker *FakeDocker) {
+				docker.Hook("ContainerStart", func(c *types.ContainerJSON) {
+					if c.Image != mockNewImageID {
+						return
+					}
+					c.State.Running = false
+					c.State.Status = "exited"
+					c.State.ExitCode = 1
+				})
+			},
+		},
+		{
+			name:      "restart",
+			errReturn: ErrorContainerRestarting,
+			prepare: func(docker *FakeDocker) {
+				docker.Hook("ContainerInspect", func(c *types.ContainerJSON) {
+					if c.Image != mockNewImageID {
+						return
+					}
+					c.RestartCount++
+				})
+			},
+		},
+		{
+			name:      "unhealthy",
+			errReturn: ErrorContainerUnhealthy,
+			prepare: func(docker *FakeDocker) {
+				docker.Hook("ContainerStart", func(c *types.ContainerJSON) {
+					if c.Image != mockNewImageID {
+						return
+					}
+					c.State.Health = &types.Health{Status: types.Unhealthy, FailingStreak: 3}
+				})
+			},
+		},
+		{
+			name:      "start",
+			errReturn: ErrorContainerStart,
+			prepare: func(docker *FakeDocker) {
+				docker.FailNext("ContainerStart", errors.New("injected failure"))
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			watcher, docker := mockData.getWatcher(t)
+			watcher.Rollback = RollbackPolicy{GracePeriod: 50 * time.Millisecond, CheckInterval: time.Millisecond, MaxRestarts: 2}
+			oldID := docker.Container(watcher.ContainerName).ID
+			docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+			update, err := watcher.checkImage()
+			assert.NoError(t, err)
+			assert.True(t, update.Updated)
+
+			c.prepare(docker)
+			_, err = runUpdate(watcher, update)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), c.errReturn.Error())
+
+			node := docker.Container(watcher.ContainerName)
+			assert.Equal(t, oldID, node.ID)
+			assert.True(t, node.State.Running)
+			assert.Nil(t, docker.Container(watcher.ContainerName+watcher.Postfix))
+			mockData.assertDBRenamed(t, watcher, false)
+
+			// the rejected image is not installed again
+			update, err = watcher.checkImage()
+			assert.NoError(t, err)
+			assert.False(t, update.Updated)
+		})
+	}
+}
+
+func TestRunUpdateHealthy(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	watcher.Rollback = RollbackPolicy{GracePeriod: 20 * time.Millisecond, CheckInterval: time.Millisecond}
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+	_, err = runUpdate(watcher, update)
+	assert.NoError(t, err)
+	assert.Equal(t, mockNewImageID, docker.Container(watcher.ContainerName).Image)
+	assert.Nil(t, watcher.pinnedImage())
+}
+
+func TestRollbackBeforeRename(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	oldID := docker.Container(watcher.ContainerName).ID
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+
+	docker.FailNext("ContainerRename", errors.New("injected failure"))
+	_, err = runUpdate(watcher, update)
+	assert.Error(t, err)
+	node := docker.Container(watcher.ContainerName)
+	assert.Equal(t, oldID, node.ID)
+	assert.True(t, node.State.Running)
+	assert.Nil(t, watcher.pinnedImage(), "docker failure should not reject the image")
+}
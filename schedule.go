@@ -0,0 +1,163 @@
+package main
+
+// Maintenance windows and cron schedule limiting when an update may start
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const maxWindowSearchDays = 8
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// UpdateSchedule times an update is allowed to start, a cron activation allows the whole minute
+type UpdateSchedule struct {
+	Location *time.Location
+	Cron     []cron.Schedule
+	Windows  []MaintenanceWindow
+}
+
+// MaintenanceWindow daily period on some weekdays, a window crossing midnight belongs to the day it starts
+type MaintenanceWindow struct {
+	Days  map[time.Weekday]bool // nil for every day
+	Start time.Duration         // offset from midnight
+	End   time.Duration         // offset from midnight, not after Start when crossing midnight
+}
+
+// NewUpdateSchedule parse schedule configuration, nil is returned when nothing limits updates
+func NewUpdateSchedule(config ScheduleConfig) (*UpdateSchedule, error) {
+	if len(config.Cron) == 0 && len(config.Windows) == 0 {
+		return nil, nil
+	}
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, ErrCombind(ErrorSchedule, err)
+	}
+	schedule := &UpdateSchedule{Location: location}
+	for _, spec := range config.Cron {
+		parsed, err := cron.ParseStandard(spec)
+		if err != nil {
+			return nil, ErrCombind(ErrorSchedule, fmt.Errorf("cron %q: %s", spec, err))
+		}
+		if parsed.Next(time.Now()).IsZero() {
+			return nil, ErrCombind(ErrorSchedule, fmt.Errorf("cron %q never fires", spec))
+		}
+		schedule.Cron = append(schedule.Cron, parsed)
+	}
+	for _, windowConfig := range config.Windows {
+		window, err := parseWindow(windowConfig)
+		if err != nil {
+			return nil, ErrCombind(ErrorSchedule, err)
+		}
+		schedule.Windows = append(schedule.Windows, window)
+	}
+	if schedule.Next(time.Now()).IsZero() {
+		return nil, ErrCombind(ErrorSchedule, fmt.Errorf("no cron or window ever opens"))
+	}
+	return schedule, nil
+}
+
+func parseWindow(config WindowConfig) (MaintenanceWindow, error) {
+	window := MaintenanceWindow{}
+	var err error
+	if window.Start, err = parseClock(config.Start); err != nil {
+		return window, err
+	}
+	if window.End, err = parseClock(config.End); err != nil {
+		return window, err
+	}
+	if window.Start == window.End {
+		return window, fmt.Errorf("window %s-%s is empty", config.Start, config.End)
+	}
+	if len(config.Days) > 0 {
+		window.Days = make(map[time.Weekday]bool)
+		for _, day := range config.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return window, fmt.Errorf("%q is not a weekday of sun, mon, tue, wed, thu, fri, sat", day)
+			}
+			window.Days[weekday] = true
+		}
+	}
+	return window, nil
+}
+
+// parseClock parse HH:MM into offset from midnight
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of HH:MM", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Allowed report whether an update may start at t
+func (s *UpdateSchedule) Allowed(t time.Time) bool {
+	t = t.In(s.Location)
+	minute := t.Truncate(time.Minute)
+	for _, schedule := range s.Cron {
+		if schedule.Next(minute.Add(-time.Second)).Equal(minute) {
+			return true
+		}
+	}
+	for _, window := range s.Windows {
+		for _, days := range []int{0, -1} { // window of yesterday may cross midnight
+			start, end, ok := window.on(t, days)
+			if ok && !t.Before(start) && t.Before(end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Next return t when an update may start at t, otherwise the earliest time it may start,
+// zero when the schedule never opens
+func (s *UpdateSchedule) Next(t time.Time) time.Time {
+	if s.Allowed(t) {
+		return t
+	}
+	t = t.In(s.Location)
+	next := time.Time{}
+	earlier := func(candidate time.Time) {
+		if !candidate.IsZero() && (next.IsZero() || candidate.Before(next)) {
+			next = candidate
+		}
+	}
+	for _, schedule := range s.Cron {
+		earlier(schedule.Next(t))
+	}
+	for _, window := range s.Windows {
+		for days := 0; days < maxWindowSearchDays; days++ {
+			if start, _, ok := window.on(t, days); ok && start.After(t) {
+				earlier(start)
+				break
+			}
+		}
+	}
+	return next
+}
+
+// on return period of the window on the day days after t, false if the window is not open that day
+func (window MaintenanceWindow) on(t time.Time, days int) (time.Time, time.Time, bool) {
+	year, month, day := t.Date()
+	day += days
+	if window.Days != nil && !window.Days[time.Date(year, month, day, 0, 0, 0, 0, t.Location()).Weekday()] {
+		return time.Time{}, time.Time{}, false
+	}
+	endDay := day
+	if window.End <= window.Start {
+		endDay++
+	}
+	// clock is normalized as wall time, so windows keep their clock across daylight saving changes
+	start := time.Date(year, month, day, 0, 0, 0, int(window.Start), t.Location())
+	end := time.Date(year, month, endDay, 0, 0, 0, int(window.End), t.Location())
+	return start, end, true
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateSchedule(t *testing.T) {
+	schedule, err := NewUpdateSchedule(ScheduleConfig{
+		Timezone: "Asia/Taipei",
+		Cron:     []string{"30 12 * * 3"},
+		Windows: []WindowConfig{
+			{Days: []string{"sat", "Sun"}, Start: "22:00", End: "02:00"},
+			{Days: []string{"mon"}, Start: "03:00", End: "04:00"},
+		},
+	})
+	assert.NoError(t, err)
+	taipei, _ := time.LoadLocation("Asia/Taipei")
+	at := func(day, hour, minute int) time.Time { // days of 2024-06, 06-01 is saturday
+		return time.Date(2024, 6, day, hour, minute, 0, 0, taipei)
+	}
+	cases := []struct {
+		now     time.Time
+		allowed bool
+		next    time.Time
+	}{
+		{at(1, 23, 0), true, at(1, 23, 0)},
+		{at(2, 1, 59).UTC(), true, at(2, 1, 59)}, // saturday window crosses midnight
+		{at(2, 2, 0), false, at(2, 22, 0)},
+		{at(3, 1, 0), true, at(3, 1, 0)}, // sunday window crosses into monday
+		{at(3, 2, 30), false, at(3, 3, 0)},
+		{at(3, 4, 0), false, at(5, 12, 30)},
+		{at(5, 12, 30).Add(59 * time.Second), true, at(5, 12, 30).Add(59 * time.Second)},
+		{at(5, 12, 31), false, at(8, 22, 0)},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.allowed, schedule.Allowed(c.now), c.now.String())
+		assert.True(t, c.next.Equal(schedule.Next(c.now)), "%s next %s", c.now, schedule.Next(c.now))
+	}
+}
+
+func TestNewUpdateScheduleInvalid(t *testing.T) {
+	schedule, err := NewUpdateSchedule(ScheduleConfig{Timezone: "Mars/Olympus"})
+	assert.NoError(t, err)
+	assert.Nil(t, schedule)
+	for _, config := range []ScheduleConfig{
+		{Timezone: "Mars/Olympus", Cron: []string{"0 3 * * *"}},
+		{Timezone: "UTC", Cron: []string{"0 25 * * *"}},
+		{Timezone: "UTC", Windows: []WindowConfig{{Start: "3am", End: "04:00"}}},
+		{Timezone: "UTC", Windows: []WindowConfig{{Start: "03:00", End: "03:00"}}},
+		{Timezone: "UTC", Windows: []WindowConfig{{Days: []string{"someday"}, Start: "03:00", End: "04:00"}}},
+		{Timezone: "UTC", Cron: []string{"0 0 30 2 *"}},
+		{Timezone: "UTC", Cron: []string{"0 3 * * *", "0 0 31 4 *"}},
+	} {
+		_, err := NewUpdateSchedule(config)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), ErrorSchedule.Error())
+	}
+}
+
+func TestScheduledUpdate(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	watcher.PollInterval = time.Hour
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	window := MaintenanceWindow{Start: now.Add(300 * time.Millisecond).Sub(midnight)}
+	window.End = window.Start + time.Hour
+	watcher.Schedule = &UpdateSchedule{Location: time.UTC, Windows: []MaintenanceWindow{window}}
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+
+	updated := make(chan ImageUpdate)
+	go imageUpdateRoutine(watcher, updated)
+	deadline := time.Now().Add(time.Second)
+	for watcher.status.pendingUpdate() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	pending := watcher.Status().Pending
+	if assert.NotNil(t, pending) {
+		assert.Equal(t, mockNewDigest, pending.NewDigest)
+		assert.True(t, pending.ScheduledAt.After(pending.DetectedAt))
+	}
+
+	select {
+	case update := <-updated:
+		assert.Equal(t, triggerSchedule, update.Trigger)
+		assert.False(t, time.Now().Before(pending.ScheduledAt))
+		assert.Nil(t, watcher.status.pendingUpdate())
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduled update is not applied")
+	}
+}
+
+func TestRequestedUpdateIgnoreSchedule(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	watcher.PollInterval = time.Hour
+	schedule, err := NewUpdateSchedule(ScheduleConfig{Timezone: "UTC", Cron: []string{"0 0 29 2 *"}})
+	assert.NoError(t, err)
+	watcher.Schedule = schedule
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+
+	updated := make(chan ImageUpdate)
+	go imageUpdateRoutine(watcher, updated)
+	deadline := time.Now().Add(time.Second)
+	for watcher.status.pendingUpdate() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.NotNil(t, watcher.status.pendingUpdate())
+	watcher.status.requestCheck(triggerAPI)
+	select {
+	case update := <-updated:
+		assert.Equal(t, triggerAPI, update.Trigger)
+	case <-time.After(5 * time.Second):
+		t.Fatal("requested update is not applied")
+	}
+}
+
+func TestScheduleNeverOpens(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	watcher.PollInterval = time.Hour
+	never, err := cron.ParseStandard("0 0 30 2 *")
+	assert.NoError(t, err)
+	watcher.Schedule = &UpdateSchedule{Location: time.UTC, Cron: []cron.Schedule{never}}
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+
+	updated := make(chan ImageUpdate)
+	go imageUpdateRoutine(watcher, updated)
+	deadline := time.Now().Add(time.Second)
+	for watcher.status.pendingUpdate() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if pending := watcher.status.pendingUpdate(); assert.NotNil(t, pending) {
+		assert.True(t, pending.ScheduledAt.IsZero())
+	}
+	firstPoll, _ := watcher.status.poll()
+	time.Sleep(50 * time.Millisecond)
+	lastPoll, _ := watcher.status.poll()
+	assert.Equal(t, firstPoll, lastPoll, "image is not checked again before the next poll")
+
+	watcher.status.requestCheck(triggerAPI)
+	select {
+	case update := <-updated:
+		assert.Equal(t, triggerAPI, update.Trigger)
+	case <-time.After(5 * time.Second):
+		t.Fatal("requested update is not applied")
+	}
+}
@@ -1,6 +1,10 @@
 #!/bin/bash
 ## How to run bitmarkNodeWatcher as a docker container
 ## Setup your nase mount directory (here is staging directory)
+## $nodeDir/watcher keeps the journal of the running update, resumed after a restart, and database
+## snapshots of updates. it is not the mount of node data so snapshots are copied, not linked: each one
+## takes the size of the chain databases, up to backup.keep of them (3 by default), and the node is
+## stopped while they are copied
 nodeDir=$HOME/bitmark-node-data-test
 docker run -d --name bitmarkNodeWatcher \
 -e DOCKER_HOST="unix:///var/run/docker.sock" \
@@ -8,6 +12,7 @@ docker run -d --name bitmarkNodeWatcher \
 -e NODE_NAME="bitmarkNodeTest" \
 -e USER_HOME_BASE_DIR=$nodeDir \
 -v $nodeDir/watcherlog:/var/log \
+-v $nodeDir/watcher:/.config/bitmark-node/watcher \
 -v /var/run/docker.sock:/var/run/docker.sock \
 -v $nodeDir/data:/.config/bitmark-node/bitmarkd/bitmark/data \
 -v $nodeDir/data-test:/.config/bitmark-node/bitmarkd/testing/data \
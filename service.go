@@ -1,7 +1,10 @@
 package main
 
 import (
-	"os"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
@@ -21,101 +24,322 @@ const (
 
 // Database to remove
 const (
+	nodeConfigDir       = "/.config/bitmark-node"
+	watcherStateDir     = nodeConfigDir + "/watcher" // volume of watcher state surviving its container, see scripts/run.sh
 	nodeDataDirMainnet  = "/.config/bitmark-node/bitmarkd/bitmark/data"
 	nodeDataDirTestnet  = "/.config/bitmark-node/bitmarkd/testing/data"
 	blockLevelDB        = "bitmark-blocks.leveldb"
 	indexLevelDB        = "bitmark-index.leveldb"
 	oldCotnainerPostfix = ".old"
-	oldDBPostfix        = ".old"
+	chainBitmark        = "bitmark"
+	chainTesting        = "testing"
 )
 
-// StartMonitor  Monitor process
-func StartMonitor(watcher NodeWatcher) error {
-	log.Info("Monitoring Process Start")
+// Exit codes of a single update cycle, a larger rank is reported when nodes end differently
+const (
+	exitNoUpdate     = 0
+	exitInvalid      = 1 // invalid flags, configuration or setup, urfave/cli exits with it on its own errors too
+	exitUpdated      = 2
+	exitRolledBack   = 3
+	exitNotRecovered = 4
+	exitRefused      = 5
+	exitShutdown     = 6 // shutdown starts before the update
+	exitCheckFailed  = 7
+)
+
+var exitRanks = map[int]int{exitNoUpdate: 0, exitUpdated: 1, exitShutdown: 2, exitCheckFailed: 3, exitRefused: 4, exitRolledBack: 5, exitNotRecovered: 6}
+
+// worseExit return the exit code of higher rank
+func worseExit(a, b int) int {
+	if exitRanks[b] > exitRanks[a] {
+		return b
+	}
+	return a
+}
+
+// UpdateOnce run a single check and update cycle, an interrupted update is resumed first,
+// an image outside of update schedule is not applied
+func UpdateOnce(watcher *NodeWatcher) (int, error) {
+	if err := watcher.resumeUpdate(); err != nil {
+		return exitNotRecovered, err
+	}
+	update, err := watcher.checkImage()
+	watcher.status.recordPoll(err)
+	watcher.metrics.recordPoll(err)
+	if err != nil {
+		return exitCheckFailed, ErrCombind(ErrorImageUpdateRoutine, err)
+	}
+	if !update.Updated {
+		log.Info("no new image found container:", watcher.ContainerName)
+		return exitNoUpdate, nil
+	}
+	watcher.notifyDetected(update)
+	if now := time.Now(); watcher.Schedule != nil && !watcher.Schedule.Allowed(now) {
+		log.Info("update of image:", update.NewID, " is not allowed until ", watcher.Schedule.Next(now))
+		return exitNoUpdate, nil
+	}
+	update.Trigger = triggerOnce
+	update.DBReset = watcher.status.takeDBReset()
+	record, err := runUpdate(watcher, update)
+	if err == ErrorShutdown { // nothing is changed
+		return exitShutdown, err
+	}
+	switch record.Result {
+	case updateSucceeded:
+		return exitUpdated, nil
+	case updateRolledBack:
+		return exitRolledBack, err
+	case updateRefused:
+		return exitRefused, err
+	default:
+		return exitNotRecovered, err
+	}
+}
+
+// StartMonitors run monitor process of every watcher, a failing watcher does not stop the others
+func StartMonitors(watchers []*NodeWatcher) {
+	var wg sync.WaitGroup
+	for _, watcher := range watchers {
+		wg.Add(1)
+		go func(watcher *NodeWatcher) {
+			defer wg.Done()
+			if err := StartMonitor(watcher); err != nil {
+				log.Error(ErrCombind(ErrorStartMonitorService, err), " container:", watcher.ContainerName)
+			}
+		}(watcher)
+	}
+	wg.Wait()
+}
+
+// StartMonitor  Monitor process, it is restarted after a panic
+func StartMonitor(watcher *NodeWatcher) error {
+	log.Info("Monitoring Process Start container:", watcher.ContainerName)
+	if err := watcher.resumeUpdate(); err != nil {
+		log.Error(err, " container:", watcher.ContainerName)
+	}
+	for {
+		monitor(watcher)
+		if watcher.shuttingDown() {
+			log.Info("Monitoring Process Stop container:", watcher.ContainerName)
+			return nil
+		}
+		log.Error(ErrorStartMonitorService.Error() + ": waiting for restart service container:" + watcher.ContainerName)
+		watcher.sleep(recoverWaitTime)
+	}
+}
+
+// monitor apply new images until a panic happens or shutdown starts
+func monitor(watcher *NodeWatcher) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Error(ErrorStartMonitorService.Error() + ": waiting for restart service")
-			time.Sleep(recoverWaitTime)
-			go StartMonitor(watcher)
+			log.Error("monitor of container:", watcher.ContainerName, " panic: ", r)
 		}
 	}()
 	for {
-		updated := make(chan bool)
-		go imageUpdateRoutine(&watcher, updated)
-		<-updated
-		createConf, err := handleExistingContainer(watcher)
-		if err != nil {
-			log.Error(ErrCombind(ErrorHandleExistingContainer, err))
+		updated := make(chan ImageUpdate)
+		go imageUpdateRoutine(watcher, updated)
+		update, ok := <-updated
+		if !ok { // shutdown
+			return
+		}
+		log.Info("new image found old:", update.OldID, " ", update.OldDigest, " new:", update.NewID, " ", update.NewDigest)
+		if _, err := runUpdate(watcher, update); err != nil {
+			log.Error(err)
 			continue
 		}
+		log.Info("Start container successfully")
+	}
+}
 
-		var newContainer container.ContainerCreateCreatedBody
-		if createConf != nil { // err == nil and createConf == nil => container does not exist
-			newContainer, err = watcher.createContainer(*createConf)
-			if err != nil {
-				log.Error(ErrCombind(ErrorContainerCreate, err))
-				continue
-			}
-		} else {
-			log.Info("Creating a brand new container")
-			newContainerConfig, err := getDefaultConfig(&watcher)
-			if err != nil {
-				log.Error(ErrCombind(ErrorConfigCreateNew, err))
-				continue
-			}
-			newContainer, err = watcher.DockerClient.ContainerCreate(watcher.BackgroundContex, newContainerConfig.Config,
-				newContainerConfig.HostConfig, nil, watcher.ContainerName)
+// runUpdate replace node container and watch it, rollback to the old container when the new one fails.
+// The record of the update is returned, it has no result when shutdown starts before the update
+func runUpdate(watcher *NodeWatcher, update ImageUpdate) (record UpdateRecord, err error) {
+	watcher.status.beginOperation()
+	defer watcher.status.endOperation()
+	if watcher.shuttingDown() {
+		return UpdateRecord{Container: watcher.ContainerName, Trigger: update.Trigger}, ErrorShutdown
+	}
+	record = UpdateRecord{Container: watcher.ContainerName, Trigger: update.Trigger, StartedAt: time.Now(),
+		OldImageID: update.OldID, OldDigest: update.OldDigest, NewImageID: update.NewID, NewDigest: update.NewDigest}
+	defer func() {
+		record.FinishedAt = time.Now()
+		watcher.status.recordUpdate(record)
+		watcher.metrics.recordUpdate(record)
+	}()
+	if err := watcher.verifyImage(update); err != nil { // refused image is not retried until a new one is found
+		log.Error(err)
+		record.Result = updateRefused
+		record.Error = err.Error()
+		watcher.pinImage(update)
+		watcher.notify(eventImageRefused, update, err)
+		return record, err
+	}
+	record.DBReset = watcher.decideDBReset(&update)
+	record.ResetDB = update.ResetDB
+	if err := watcher.Journal.Begin(watcher.ContainerName, update); err != nil {
+		record.Result = updateFailed
+		record.Error = err.Error()
+		return record, err
+	}
+	watcher.notify(eventUpdateStarted, update, nil)
+
+	// switching containers is not interrupted, shutdown is handled while the new container is watched
+	switching := watcher.detached()
+	switching.target = update.Image
+	switching.verified = switching.verifiedReference(update)
+	newContainerID, err := updateContainer(switching, update)
+	if err == nil {
+		err = watcher.watchContainer(newContainerID)
+	}
+	if err == nil {
+		err = watcher.checkHealth()
+	}
+	if err != nil && watcher.shuttingDown() {
+		err = ErrCombind(ErrorShutdown, err)
+	}
+	if err == nil {
+		watcher.unpinImage()
+		record.Result = updateSucceeded
+		watcher.notify(eventUpdateSucceeded, update, nil)
+		watcher.finishJournal()
+		return record, nil
+	}
+	log.Error(err)
+	record.Error = err.Error()
+	if len(newContainerID) > 0 && !watcher.shuttingDown() { // new container is created and failed
+		watcher.pinImage(update)
+	}
+	watcher.journalStep(journalRollingBack, nil)
+	if rollbackErr := watcher.detached().rollback(newContainerID, switching.snapshot); rollbackErr != nil {
+		record.Result = updateFailed
+		record.Error += "; " + rollbackErr.Error()
+		watcher.notify(eventUpdateFailed, update, fmt.Errorf("%s", record.Error))
+		return record, rollbackErr // journal is kept to retry the rollback on next start
+	}
+	watcher.finishJournal()
+	record.Result = updateRolledBack
+	watcher.notify(eventRollback, update, err)
+	watcher.notify(eventUpdateFailed, update, err)
+	return record, err
+}
+
+// updateContainer replace node container with a new one created from the pulled image of update,
+// the ID of new container is returned if it is created
+func updateContainer(watcher *NodeWatcher, update ImageUpdate) (string, error) {
+	stoppedAt := time.Now()
+	createConf, err := handleExistingContainer(*watcher)
+	if err != nil {
+		return "", ErrCombind(ErrorHandleExistingContainer, err)
+	}
+
+	var newContainer container.ContainerCreateCreatedBody
+	var env []string
+	if createConf != nil { // err == nil and createConf == nil => container does not exist
+		newContainer, err = watcher.createContainer(*createConf)
+		if err != nil {
+			return "", ErrCombind(ErrorContainerCreate, err)
 		}
-		err = renameDB()
+		env = createConf.Config.Env
+	} else {
+		log.Info("Creating a brand new container")
+		newContainerConfig, err := getDefaultConfig(watcher)
 		if err != nil {
-			log.Error(ErrCombind(ErrorRenameDB, err))
+			return "", ErrCombind(ErrorConfigCreateNew, err)
 		}
-		err = watcher.startContainer(newContainer.ID)
+		newContainer, err = watcher.DockerClient.ContainerCreate(watcher.BackgroundContex, newContainerConfig.Config,
+			newContainerConfig.HostConfig, nil, watcher.ContainerName)
 		if err != nil {
-			log.Error(ErrCombind(ErrorContainerStart, err))
-			err = recoverDB()
-			if err != nil {
-				log.Error(ErrCombind(ErrorRecoverDB, err))
+			return "", ErrCombind(ErrorContainerCreate, err)
+		}
+		env = newContainerConfig.Config.Env
+	}
+	watcher.journalStep(journalCreated, func(entry *JournalEntry) { entry.NewContainerID = newContainer.ID })
+	if update.ResetDB {
+		watcher.journalStep(journalDBMoving, nil)
+		// a cloned config leaves out variables of the image, such as its NETWORK, the created container has them
+		err = watcher.backupDB(update, watcher.envChains(watcher.containerEnv(newContainer.ID, env)))
+		if err != nil { // the new node does not start on databases which are not saved or half moved
+			return newContainer.ID, err
+		}
+		watcher.notify(eventDBRenamed, update, nil)
+		watcher.journalStep(journalDBMoved, nil)
+	}
+	watcher.journalStep(journalStarting, func(entry *JournalEntry) { entry.NewStarted = true })
+	err = watcher.startContainer(newContainer.ID)
+	if err != nil {
+		if watcher.snapshot != nil {
+			recoverErr := watcher.restoreDB(watcher.snapshot)
+			if recoverErr != nil {
+				log.Error(recoverErr)
 			}
-			continue
+			watcher.notify(eventDBRestored, update, recoverErr)
+			watcher.snapshot = nil
 		}
-		log.Info("Start container successfully")
+		return newContainer.ID, ErrCombind(ErrorContainerStart, err)
 	}
-	return nil
+	watcher.journalStep(journalNewStarted, nil)
+	if createConf != nil { // old container is stopped by handleExistingContainer
+		watcher.metrics.recordDowntime(time.Since(stoppedAt))
+	}
+	return newContainer.ID, nil
 }
 
-// imageUpdateRoutine check image periodically
-func imageUpdateRoutine(w *NodeWatcher, updateStatus chan bool) {
-	ticker := time.NewTicker(pullImageInterval)
+// imageUpdateRoutine check image periodically or when it is requested
+func imageUpdateRoutine(w *NodeWatcher, updateStatus chan ImageUpdate) {
+	ticker := time.NewTicker(w.PollInterval)
 	defer func() {
 		ticker.Stop()
 		close(updateStatus)
 	}()
-	// For the first time
-	newImage, err := w.pullImage()
-	if err != nil {
-		log.Info(ErrCombind(ErrorImagePull, err).Error())
-	}
-	if newImage {
-		log.Info("imageUpdateRoutine update a new image")
-		updateStatus <- true
-	}
-	// End of the first time ---- can be delete later
-	for { // start  periodically check routine
-		select {
-		case <-ticker.C:
-			newImage, err := w.pullImage()
-			if err != nil {
-				log.Info(ErrCombind(ErrorImagePull, err))
-				continue
-			}
-			if newImage {
+	var scheduled <-chan time.Time
+	trigger := triggerPoll
+	for { // the first check runs immediately
+		update, err := w.checkImage()
+		w.status.recordPoll(err)
+		w.metrics.recordPoll(err)
+		if err != nil {
+			log.Info(ErrCombind(ErrorImageUpdateRoutine, err))
+		} else if update.Updated {
+			w.notifyDetected(update)
+			pending := w.status.pendingUpdate()
+			now := time.Now()
+			// requested checks are not limited by schedule
+			if w.Schedule == nil || trigger == triggerAPI || w.Schedule.Allowed(now) {
 				log.Info("imageUpdateRoutine update a new image")
-				updateStatus <- true
-				break
+				w.status.setPending(nil)
+				update.Trigger = trigger
+				update.DBReset = w.status.takeDBReset() // a requested mode waits for the update it is meant for
+				updateStatus <- update
+				return
+			}
+			if pending == nil || pending.NewID != update.NewID {
+				pending = &PendingUpdate{ImageUpdate: update, DetectedAt: now, ScheduledAt: w.Schedule.Next(now)}
+				w.status.setPending(pending)
+				if pending.ScheduledAt.IsZero() {
+					log.Warning("schedule of container:", w.ContainerName, " never opens, update of image:", update.NewID, " waits for a request")
+				} else {
+					log.Info("update of image:", update.NewID, " is scheduled at ", pending.ScheduledAt)
+				}
 			}
+			scheduled = nil
+			if !pending.ScheduledAt.IsZero() {
+				scheduled = time.After(time.Until(pending.ScheduledAt))
+			}
+		} else {
+			w.status.setPending(nil)
+			scheduled = nil
 			log.Info("no new image found")
 		}
+		select {
+		case <-w.BackgroundContex.Done():
+			return
+		case <-ticker.C:
+			trigger = triggerPoll
+		case <-scheduled:
+			trigger = triggerSchedule
+		case trigger = <-w.status.trigger:
+			log.Info("image check is requested by ", trigger)
+		}
 	}
 }
 
@@ -138,24 +362,14 @@ func handleExistingContainer(watcher NodeWatcher) (*CreateConfig, error) {
 			return nil, err
 		}
 
-		newConfig := container.Config{
-			Image:        watcher.ImageName,
-			ExposedPorts: jsonConfig.Config.ExposedPorts,
-			Env:          jsonConfig.Config.Env,
-			Volumes:      jsonConfig.Config.Volumes,
-			Cmd:          jsonConfig.Config.Cmd,
-		}
-
-		newNetworkConf := network.NetworkingConfig{
-			EndpointsConfig: jsonConfig.NetworkSettings.Networks,
-		}
-
+		watcher.journalStep(journalStopping, func(entry *JournalEntry) { entry.OldContainerID = nameContainer.ID })
 		namedContainers := append([]types.Container{}, *nameContainer)
-		err = watcher.stopContainers(namedContainers, containerStopWaitTime)
+		err = watcher.stopContainers(namedContainers, watcher.StopTimeout)
 
 		if err != nil {
 			return nil, err
 		}
+		watcher.journalStep(journalOldStopped, nil)
 
 		oldContainers, err := watcher.getOldContainer()
 		if err == nil && oldContainers != nil {
@@ -165,12 +379,42 @@ func handleExistingContainer(watcher NodeWatcher) (*CreateConfig, error) {
 		if err != nil {
 			return nil, err
 		}
-		return &CreateConfig{Config: &newConfig, HostConfig: jsonConfig.HostConfig, NetworkingConfig: &newNetworkConf}, err
+		watcher.journalStep(journalOldRenamed, nil)
+		return newCreateConfig(&watcher, jsonConfig), err
 	}
 	// no container
 	return nil, nil
 }
 
+// newCreateConfig build configuration of new container from the inspected node container,
+// fields provided by the old image are left to the new image
+func newCreateConfig(watcher *NodeWatcher, jsonConfig types.ContainerJSON) *CreateConfig {
+	var oldImage *container.Config
+	if image, _, err := watcher.DockerClient.ImageInspectWithRaw(watcher.BackgroundContex, jsonConfig.Image); err == nil {
+		oldImage = &container.Config{}
+		if image.Config != nil {
+			oldImage = image.Config
+		}
+	} else {
+		log.Warning("inspect image of node container failed, all settings are kept: ", err)
+	}
+	newConfig := container.Config{Image: watcher.image()}
+	if jsonConfig.Config != nil {
+		newConfig = *cloneConfig(*jsonConfig.Config, oldImage, jsonConfig.ID, watcher.image())
+	}
+
+	var networks map[string]*network.EndpointSettings
+	var networkMode container.NetworkMode
+	if jsonConfig.NetworkSettings != nil {
+		networks = jsonConfig.NetworkSettings.Networks
+	}
+	if jsonConfig.HostConfig != nil {
+		networkMode = jsonConfig.HostConfig.NetworkMode
+	}
+	newNetworkConf, additional := cloneNetworks(networkMode, networks, jsonConfig.ID)
+	return &CreateConfig{Config: &newConfig, HostConfig: jsonConfig.HostConfig, NetworkingConfig: newNetworkConf, Networks: additional}
+}
+
 func getDefaultConfig(watcher *NodeWatcher) (*CreateConfig, error) {
 	config := CreateConfig{}
 
@@ -180,83 +424,41 @@ func getDefaultConfig(watcher *NodeWatcher) (*CreateConfig, error) {
 		return nil, err
 	}
 
-	baseTargetDir := "/.config/bitmark-node"
-	publicIP := os.Getenv("PUBLIC_IP")
-	chain := os.Getenv("NETWORK")
-	if len(publicIP) == 0 {
-		publicIP = "127.0.0.1"
-	}
-	if len(chain) == 0 {
-		chain = "BITMARK"
-	}
-	additionEnv := append([]string{}, "PUBLIC_IP="+publicIP, "NETWORK="+chain)
-	exposePorts := nat.PortMap{
-		"2136/tcp": []nat.PortBinding{
-			{
-				HostIP:   "0.0.0.0",
-				HostPort: "2136",
-			},
-		},
-		"2130/tcp": []nat.PortBinding{
-			{
-				HostIP:   "0.0.0.0",
-				HostPort: "2130",
-			},
-		},
-		"2131/tcp": []nat.PortBinding{
-			{
-				HostIP:   "0.0.0.0",
-				HostPort: "2131",
-			},
-		},
-		"9980/tcp": []nat.PortBinding{
+	node := watcher.Node
+	additionEnv := append([]string{}, "PUBLIC_IP="+node.PublicIP, "NETWORK="+node.Network)
+	exposePorts := nat.PortMap{}
+	portmap := nat.PortSet{}
+	for _, p := range node.Ports {
+		port := nat.Port(strconv.Itoa(p) + "/tcp")
+		exposePorts[port] = []nat.PortBinding{
 			{
 				HostIP:   "0.0.0.0",
-				HostPort: "9980",
+				HostPort: strconv.Itoa(p),
 			},
-		},
+		}
+		portmap[port] = struct{}{}
+	}
+	mounts := []mount.Mount{}
+	for _, m := range node.Mounts {
+		source := m.Source
+		if !filepath.IsAbs(source) {
+			source = baseDir + "/" + source
+		}
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeBind,
+			Source: source,
+			Target: m.Target,
+		})
 	}
 
 	hconfig := container.HostConfig{
 		NetworkMode:  "default",
 		PortBindings: exposePorts,
-		Mounts: []mount.Mount{
-			{
-				Type:   mount.TypeBind,
-				Source: baseDir + "/db",
-				Target: baseTargetDir + "/db",
-			},
-			{
-				Type:   mount.TypeBind,
-				Source: baseDir + "/data",
-				Target: baseTargetDir + "/bitmarkd/bitmark/data",
-			},
-			{
-				Type:   mount.TypeBind,
-				Source: baseDir + "/data-test",
-				Target: baseTargetDir + "/bitmarkd/testing/data",
-			},
-			{
-				Type:   mount.TypeBind,
-				Source: baseDir + "/log",
-				Target: baseTargetDir + "/bitmarkd/bitmark/log",
-			},
-			{
-				Type:   mount.TypeBind,
-				Source: baseDir + "/log-test",
-				Target: baseTargetDir + "/bitmarkd/testing/log",
-			},
-		},
+		Mounts:       mounts,
 	}
 	config.HostConfig = &hconfig
-	portmap := nat.PortSet{
-		"2136/tcp": struct{}{},
-		"2130/tcp": struct{}{},
-		"2131/tcp": struct{}{},
-		"9980/tcp": struct{}{},
-	}
 	config.Config = &container.Config{
-		Image:        watcher.ImageName,
+		Image:        watcher.image(),
 		Env:          additionEnv,
 		ExposedPorts: portmap,
 	}
@@ -264,60 +466,10 @@ func getDefaultConfig(watcher *NodeWatcher) (*CreateConfig, error) {
 	return &config, nil
 }
 
-func renameDB() (finalerr error) {
-	log.Info("befire:", nodeDataDirMainnet+"/"+blockLevelDB, " after:", nodeDataDirMainnet+"/"+blockLevelDB+oldDBPostfix)
-
-	mainnetBlockDB := nodeDataDirMainnet + "/" + blockLevelDB
-	_, err := os.Stat(mainnetBlockDB)
-	if nil == err {
-		if err := os.Rename(mainnetBlockDB, mainnetBlockDB+oldDBPostfix); err != nil {
-			finalerr = err
-		}
-	}
-	mainnetIndexDB := nodeDataDirMainnet + "/" + indexLevelDB
-	_, err = os.Stat(mainnetIndexDB)
-	if nil == err {
-		if err = os.Rename(mainnetIndexDB, mainnetIndexDB+oldDBPostfix); err != nil {
-			finalerr = err
-		}
-	}
-	//
-	testnetBlockDB := nodeDataDirTestnet + "/" + blockLevelDB
-	_, err = os.Stat(testnetBlockDB)
-	if nil == err {
-		if err = os.Rename(testnetBlockDB, testnetBlockDB+oldDBPostfix); err != nil {
-			finalerr = err
-		}
-	}
-	testnetIndexDB := nodeDataDirTestnet + "/" + indexLevelDB
-	_, err = os.Stat(testnetIndexDB)
-	if nil == err {
-		if err = os.Rename(testnetIndexDB, testnetIndexDB+oldDBPostfix); err != nil {
-			finalerr = err
-		}
-	}
-	return finalerr
-}
 func builDefaultVolumSrcBaseDir(watcher *NodeWatcher) (string, error) {
-	homeDir := os.Getenv("USER_NODE_BASE_DIR")
+	homeDir := watcher.Node.BaseDir
 	if 0 == len(homeDir) {
 		return "", ErrorUserNodeDirEnv
 	}
 	return homeDir, nil
 }
-
-func recoverDB() (err error) {
-	if err := os.Rename(nodeDataDirMainnet+"/"+blockLevelDB+oldDBPostfix, nodeDataDirMainnet+"/"+blockLevelDB); err != nil {
-		err = err
-	}
-	if err := os.Rename(nodeDataDirTestnet+"/"+blockLevelDB+oldDBPostfix, nodeDataDirTestnet+"/"+blockLevelDB); err != nil {
-		err = err
-	}
-	if err := os.Rename(nodeDataDirMainnet+"/"+indexLevelDB+oldDBPostfix, nodeDataDirMainnet+"/"+indexLevelDB); err != nil {
-		err = err
-	}
-	if err := os.Rename(nodeDataDirTestnet+"/"+indexLevelDB+oldDBPostfix, nodeDataDirTestnet+"/"+indexLevelDB); err != nil {
-		return err
-	}
-	return nil
-}
@@ -0,0 +1,63 @@
+package main
+
+// Shutdown on SIGTERM and SIGINT, the running update reaches a checkpoint or is rolled back before exit
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/google/logger"
+)
+
+// signalContext return the root context, it is cancelled by the first SIGTERM or SIGINT
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Warning("received ", sig, ", shutting down after node container is consistent")
+		cancel()
+		for sig := range signals {
+			log.Warning("received ", sig, ", shutdown is in progress")
+		}
+	}()
+	return ctx
+}
+
+// detachedContext keep values of the parent but is never cancelled
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// detached return a copy of watcher whose docker calls are not cancelled by shutdown,
+// it runs steps which must finish to leave node container consistent
+func (w *NodeWatcher) detached() *NodeWatcher {
+	copied := *w
+	copied.BackgroundContex = detachedContext{w.BackgroundContex}
+	return &copied
+}
+
+// shuttingDown report whether the root context is cancelled
+func (w *NodeWatcher) shuttingDown() bool {
+	return w.BackgroundContex.Err() != nil
+}
+
+// sleep wait d, false is returned when shutdown starts before d passes
+func (w *NodeWatcher) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-w.BackgroundContex.Done():
+		return false
+	}
+}
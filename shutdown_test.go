@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// getCancellableWatcher return a watcher whose root context is cancelled by the returned function
+func getCancellableWatcher(t *testing.T) (*NodeWatcher, *FakeDocker, context.CancelFunc) {
+	watcher, docker := getJournaledWatcher(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	watcher.BackgroundContex = ctx
+	return watcher, docker, cancel
+}
+
+// assertShutdownRollback check node is back to the old container and the image is retried after restart
+func assertShutdownRollback(t *testing.T, watcher *NodeWatcher, docker *FakeDocker, oldID string, err error) {
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), ErrorShutdown.Error())
+	}
+	node := docker.Container(watcher.ContainerName)
+	if assert.NotNil(t, node) {
+		assert.Equal(t, oldID, node.ID)
+		assert.True(t, node.State.Running)
+	}
+	mockData.assertDBRenamed(t, watcher, false)
+	assert.Nil(t, watcher.pinnedImage())
+	entry, loadErr := watcher.Journal.Load()
+	assert.NoError(t, loadErr)
+	assert.Nil(t, entry)
+	history := watcher.status.updates()
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, updateRolledBack, history[0].Result)
+	}
+}
+
+func TestShutdownDuringSwitch(t *testing.T) {
+	watcher, docker, cancel := getCancellableWatcher(t)
+	oldID := docker.Container(watcher.ContainerName).ID
+	docker.Hook("ContainerStop", func(c *types.ContainerJSON) { cancel() })
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+
+	_, err = runUpdate(watcher, update)
+	assert.Contains(t, docker.Calls(), "ContainerStart") // new container is started before rollback
+	assertShutdownRollback(t, watcher, docker, oldID, err)
+}
+
+func TestShutdownDuringWatch(t *testing.T) {
+	watcher, docker, cancel := getCancellableWatcher(t)
+	watcher.Rollback = RollbackPolicy{GracePeriod: time.Minute, CheckInterval: time.Millisecond}
+	oldID := docker.Container(watcher.ContainerName).ID
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		_, err := runUpdate(watcher, update)
+		done <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for c := docker.Container(watcher.ContainerName); (c == nil || c.Image != mockNewImageID) && time.Now().Before(deadline); c = docker.Container(watcher.ContainerName) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case err = <-done:
+		assertShutdownRollback(t, watcher, docker, oldID, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("update is not stopped by shutdown")
+	}
+
+	record, err := runUpdate(watcher, update)
+	assert.Equal(t, ErrorShutdown, err)
+	assert.Empty(t, record.Result)
+	assert.Len(t, watcher.status.updates(), 1)
+}
+
+func TestShutdownStopsMonitor(t *testing.T) {
+	watcher, _, cancel := getCancellableWatcher(t)
+	watcher.PollInterval = time.Hour
+	done := make(chan error)
+	go func() {
+		done <- StartMonitor(watcher)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor does not stop")
+	}
+}
+
+func TestUpdateOnceShutdown(t *testing.T) {
+	watcher, docker, cancel := getCancellableWatcher(t)
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	watcher.status.beginOperation() // shutdown starts while the update waits for a rollback
+	type result struct {
+		exit int
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		exit, err := UpdateOnce(watcher)
+		done <- result{exit, err}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for lastPoll, _ := watcher.status.poll(); lastPoll.IsZero() && time.Now().Before(deadline); lastPoll, _ = watcher.status.poll() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	watcher.status.endOperation()
+
+	r := <-done
+	assert.Equal(t, exitShutdown, r.exit)
+	assert.Equal(t, ErrorShutdown, r.err)
+	assert.Empty(t, watcher.status.updates())
+	assert.Equal(t, mockOldImageID, docker.Container(watcher.ContainerName).Image)
+}
@@ -0,0 +1,210 @@
+package main
+
+// Status of the watcher shared by the monitor loop and the API
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	maxUpdateHistory = 100
+	// UpdateResult of update records
+	updateSucceeded  = "succeeded"
+	updateRolledBack = "rolled back"
+	updateFailed     = "failed"
+	updateRefused    = "refused"
+	// UpdateTrigger of update records
+	triggerPoll     = "poll"
+	triggerAPI      = "api"
+	triggerSchedule = "schedule"
+	triggerResume   = "resume"
+	triggerOnce     = "once"
+)
+
+// UpdateRecord an update attempt
+type UpdateRecord struct {
+	Container  string    `json:"container"`
+	Trigger    string    `json:"trigger"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	OldImageID string    `json:"old_image_id"`
+	OldDigest  string    `json:"old_digest"`
+	NewImageID string    `json:"new_image_id"`
+	NewDigest  string    `json:"new_digest"`
+	ResetDB    bool      `json:"reset_db"`
+	DBReset    string    `json:"db_reset,omitempty"` // why databases are reset or kept
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// PendingUpdate new image waiting for the update schedule
+type PendingUpdate struct {
+	ImageUpdate
+	DetectedAt  time.Time `json:"detected_at"`
+	ScheduledAt time.Time `json:"scheduled_at"`
+}
+
+// watcherStatus state of the monitor loop
+type watcherStatus struct {
+	lock          sync.Mutex
+	operation     sync.Mutex // serialize update and rollback
+	inOperation   bool       // an update or rollback holds operation
+	trigger       chan string
+	lastPoll      time.Time
+	lastPollError string
+	history       []UpdateRecord
+	pinned        *ImageUpdate // update rolled back or refused, its new image is rejected
+	pending       *PendingUpdate
+	approved      uint64 // major version approved by API
+	awaiting      string // tag of a new major version waiting for approval
+	dbReset       string // db reset mode of the next update, kept until an update runs, empty for the policy
+	detected      string // digest of the last new image notified as detected
+}
+
+func newWatcherStatus() *watcherStatus {
+	return &watcherStatus{trigger: make(chan string, 1)}
+}
+
+// beginOperation wait for the running update or rollback and mark a new one running
+func (s *watcherStatus) beginOperation() {
+	s.operation.Lock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.inOperation = true
+}
+
+// endOperation mark the update or rollback of beginOperation finished
+func (s *watcherStatus) endOperation() {
+	s.lock.Lock()
+	s.inOperation = false
+	s.lock.Unlock()
+	s.operation.Unlock()
+}
+
+// operating tell if an update or rollback runs
+func (s *watcherStatus) operating() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.inOperation
+}
+
+func (s *watcherStatus) recordPoll(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastPoll = time.Now()
+	s.lastPollError = ""
+	if err != nil {
+		s.lastPollError = err.Error()
+	}
+}
+
+func (s *watcherStatus) recordUpdate(record UpdateRecord) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.history = append(s.history, record)
+	if len(s.history) > maxUpdateHistory {
+		s.history = s.history[len(s.history)-maxUpdateHistory:]
+	}
+}
+
+// detectImage record digest as the detected new image, false when it is already
+func (s *watcherStatus) detectImage(digest string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if digest == s.detected {
+		return false
+	}
+	s.detected = digest
+	return true
+}
+
+// poll return time and error of the last image check
+func (s *watcherStatus) poll() (time.Time, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastPoll, s.lastPollError
+}
+
+// updates return update records, oldest first
+func (s *watcherStatus) updates() []UpdateRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]UpdateRecord{}, s.history...)
+}
+
+// requestCheck ask the monitor loop to check image now, false if a request is already waiting
+func (s *watcherStatus) requestCheck(trigger string) bool {
+	select {
+	case s.trigger <- trigger:
+		return true
+	default:
+		return false
+	}
+}
+
+// setPending record the update waiting for schedule, nil when nothing waits
+func (s *watcherStatus) setPending(pending *PendingUpdate) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pending = pending
+}
+
+func (s *watcherStatus) pendingUpdate() *PendingUpdate {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.pending == nil {
+		return nil
+	}
+	pending := *s.pending
+	return &pending
+}
+
+func (s *watcherStatus) approveMajor(major uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if major > s.approved {
+		s.approved = major
+	}
+}
+
+func (s *watcherStatus) approvedMajor() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.approved
+}
+
+func (s *watcherStatus) setAwaiting(tag string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.awaiting = tag
+}
+
+func (s *watcherStatus) awaitingApproval() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.awaiting
+}
+
+// requestDBReset set db reset mode of the next update
+func (s *watcherStatus) requestDBReset(mode string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dbReset = mode
+}
+
+// requestedDBReset return the db reset mode waiting for the next update
+func (s *watcherStatus) requestedDBReset() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dbReset
+}
+
+// takeDBReset return and clear the requested db reset mode
+func (s *watcherStatus) takeDBReset() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	mode := s.dbReset
+	s.dbReset = ""
+	return mode
+}
@@ -2,25 +2,122 @@ package main
 
 import (
 	"context"
+	"io"
+	"time"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
-	dockerClient "github.com/docker/docker/client"
 )
 
+// DockerAPI docker daemon calls used by NodeWatcher, it is implemented by docker client
+type DockerAPI interface {
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig,
+		networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error)
+	ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error
+	ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error
+	ContainerRename(ctx context.Context, containerID, newContainerName string) error
+	ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error
+	NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error
+	ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error)
+	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
+}
+
 // NodeWatcher main data structure of service
 type NodeWatcher struct {
-	DockerClient     *dockerClient.Client
+	DockerClient     DockerAPI
 	BackgroundContex context.Context
-	Repo             string
 	ImageName        string
+	Reference        ImageReference // normalized ImageName
+	Policy           *UpdatePolicy  // image updates move to, nil to follow the tag of image
 	ContainerName    string
 	Postfix          string
+	Registry         *RegistryClient
+	Credentials      *CredentialStore // registry credentials of image pull, nil to pull anonymously
+	DataRoot         string           // prefix of node data directories, empty when running in watcher container
+	Node             NodeConfig
+	PollInterval     time.Duration
+	StopTimeout      time.Duration
+	Rollback         RollbackPolicy
+	Probes           []HealthProbe
+	LivenessInterval time.Duration     // interval of probes while node runs, 0 to probe only after update
+	Notifier         *Notifier         // webhooks of update events, nil to send nothing
+	Schedule         *UpdateSchedule   // times updates may start, nil to update as soon as an image is found
+	Journal          *Journal          // steps of the running update, nil to record nothing
+	Verifier         *ImageVerifier    // checks of new images before deploy, nil to deploy every image
+	Backups          *BackupStore      // snapshots of databases reset by updates
+	DBReset          DBResetPolicy     // when updates reset databases
+	target           string            // reference the running update creates containers from, empty for ImageName
+	verified         string            // reference pinning the image verified by the running update
+	snapshot         *SnapshotManifest // databases saved by the running update, nil when nothing is saved
+	health           *healthState
+	status           *watcherStatus
+	metrics          *watcherMetrics
+}
+
+// NewNodeWatcher create a watcher of the container running imageName with default settings
+func NewNodeWatcher(client DockerAPI, ctx context.Context, imageName, containerName string) *NodeWatcher {
+	reference, _ := ParseImageReference(imageName) // invalid name is rejected by config validation
+	watcher := &NodeWatcher{
+		DockerClient:     client,
+		BackgroundContex: ctx,
+		ImageName:        imageName,
+		Reference:        reference,
+		ContainerName:    containerName,
+		Postfix:          oldCotnainerPostfix,
+		Node:             DefaultConfig().Node,
+		PollInterval:     pullImageInterval,
+		StopTimeout:      containerStopWaitTime,
+		Rollback:         DefaultRollbackPolicy(),
+		Backups:          NewBackupStore(DefaultConfig().Backup),
+		DBReset:          DefaultDBResetPolicy(),
+		health:           &healthState{},
+		status:           newWatcherStatus(),
+	}
+	watcher.metrics = newWatcherMetrics(watcher)
+	return watcher
 }
 
 // CreateConfig collect configs to create a container
 type CreateConfig struct {
 	Config           *container.Config
 	HostConfig       *container.HostConfig
-	NetworkingConfig *network.NetworkingConfig
+	NetworkingConfig *network.NetworkingConfig            // primary network only, docker rejects more on create
+	Networks         map[string]*network.EndpointSettings // networks connected after create
+}
+
+// ImageUpdate result of pulling image, old is the image of the node container
+type ImageUpdate struct {
+	Updated   bool   `json:"updated"`
+	OldID     string `json:"old_image_id"`
+	OldDigest string `json:"old_digest"`
+	NewID     string `json:"new_image_id"`
+	NewDigest string `json:"new_digest"`
+	Trigger   string `json:"trigger,omitempty"`  // what starts the check, poll or api
+	Image     string `json:"image,omitempty"`    // reference chosen by update policy, empty for the image of watcher
+	DBReset   string `json:"db_reset,omitempty"` // db reset mode requested for this update, empty for the policy
+	ResetDB   bool   `json:"reset_db,omitempty"` // databases are reset, decided when the update starts
+}
+
+// image return the reference to create node container from, the verified image during an update
+// so a tag moved after verification is not deployed
+func (w *NodeWatcher) image() string {
+	if len(w.verified) > 0 {
+		return w.verified
+	}
+	if len(w.target) > 0 {
+		return w.target
+	}
+	return w.ImageName
+}
+
+// dataDirs return the data directories of chains with watcher's data root
+func (w *NodeWatcher) dataDirs() []string {
+	dirs := []string{}
+	for _, dir := range w.Node.DataDirs {
+		dirs = append(dirs, w.DataRoot+dir.Path)
+	}
+	return dirs
 }
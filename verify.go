@@ -0,0 +1,264 @@
+package main
+
+// Verification of pulled images before they are deployed, an image passes when its digest is in the allowlist
+// or a detached signature of its digest is valid, and it has the required labels
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/google/logger"
+)
+
+const (
+	signatureSuffix         = ".sig"
+	defaultSignatureTimeout = 30 * time.Second
+)
+
+// ImageVerifier checks of a pulled image, nil verifier accepts every image
+type ImageVerifier struct {
+	Allowlist      string            // file of allowed digests, empty when no digest is allowed by list
+	PublicKey      crypto.PublicKey  // ECDSA or RSA key of signatures, nil when signatures are not checked
+	Signatures     string            // directory or http(s) URL of signature files named after digest
+	RequiredLabels map[string]string // label -> value, empty value for any value
+	client         *http.Client
+}
+
+// NewImageVerifier build verifier of configuration, nil when nothing is checked
+func NewImageVerifier(config VerifyConfig) (*ImageVerifier, error) {
+	if len(config.Allowlist) == 0 && len(config.PublicKey) == 0 && len(config.Signatures) == 0 && len(config.RequiredLabels) == 0 {
+		return nil, nil
+	}
+	if (len(config.PublicKey) == 0) != (len(config.Signatures) == 0) {
+		return nil, fmt.Errorf("public_key and signatures must be set together")
+	}
+	verifier := &ImageVerifier{Allowlist: config.Allowlist, Signatures: config.Signatures,
+		RequiredLabels: map[string]string{}, client: &http.Client{Timeout: defaultSignatureTimeout}}
+	if len(config.PublicKey) > 0 {
+		key, err := readPublicKey(config.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("public_key %q: %s", config.PublicKey, err)
+		}
+		verifier.PublicKey = key
+	}
+	if len(config.Allowlist) > 0 {
+		if _, err := readAllowlist(config.Allowlist); err != nil {
+			return nil, fmt.Errorf("allowlist: %s", err)
+		}
+	}
+	for _, label := range config.RequiredLabels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts[0]) == 0 {
+			return nil, fmt.Errorf("required label %q has no key", label)
+		}
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		verifier.RequiredLabels[parts[0]] = parts[1]
+	}
+	return verifier, nil
+}
+
+// Verify check digest and labels of an image, the allowlist is read again on every check
+func (v *ImageVerifier) Verify(ctx context.Context, digest string, labels map[string]string) error {
+	if v == nil {
+		return nil
+	}
+	if len(digest) == 0 {
+		return fmt.Errorf("image has no registry digest")
+	}
+	if len(v.Allowlist) > 0 || v.PublicKey != nil {
+		if err := v.verifyDigest(ctx, digest); err != nil {
+			return err
+		}
+	}
+	missing := []string{}
+	for key, value := range v.RequiredLabels {
+		actual, ok := labels[key]
+		if !ok || len(actual) == 0 {
+			missing = append(missing, key)
+		} else if len(value) > 0 && actual != value {
+			missing = append(missing, fmt.Sprintf("%s=%s (is %s)", key, value, actual))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("required labels are missing: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// verifyDigest pass digest listed in allowlist, or digest of a valid signature
+func (v *ImageVerifier) verifyDigest(ctx context.Context, digest string) error {
+	problems := []string{}
+	if len(v.Allowlist) > 0 {
+		allowed, err := readAllowlist(v.Allowlist)
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else if allowed[digest] {
+			return nil
+		} else {
+			problems = append(problems, fmt.Sprintf("digest %s is not in allowlist", digest))
+		}
+	}
+	if v.PublicKey != nil {
+		signature, err := v.signature(ctx, digest)
+		if err == nil {
+			err = verifySignature(v.PublicKey, []byte(digest), signature)
+		}
+		if err == nil {
+			return nil
+		}
+		problems = append(problems, "signature: "+err.Error())
+	}
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
+
+// signature read the signature of digest, its file is named sha256-<hex>.sig and holds base64 or raw bytes
+func (v *ImageVerifier) signature(ctx context.Context, digest string) ([]byte, error) {
+	name := strings.Replace(digest, ":", "-", 1) + signatureSuffix
+	var data []byte
+	var err error
+	if strings.HasPrefix(v.Signatures, "http://") || strings.HasPrefix(v.Signatures, "https://") {
+		data, err = v.fetchSignature(ctx, strings.TrimSuffix(v.Signatures, "/")+"/"+name)
+	} else {
+		data, err = ioutil.ReadFile(filepath.Join(v.Signatures, name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		return decoded, nil
+	}
+	return data, nil
+}
+
+// fetchSignature download signature file of url
+func (v *ImageVerifier) fetchSignature(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returns %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// verifySignature check signature of SHA-256 hash of message
+func verifySignature(key crypto.PublicKey, message, signature []byte) error {
+	hash := sha256.Sum256(message)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		var sig struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(signature, &sig); err != nil || len(rest) > 0 {
+			return fmt.Errorf("malformed ECDSA signature")
+		}
+		if !ecdsa.Verify(key, hash[:], sig.R, sig.S) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature)
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// readPublicKey read a PEM encoded PKIX public key
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// readAllowlist read digests of allowlist, one per line, # starts a comment
+func readAllowlist(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	allowed := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			allowed[line] = true
+		}
+	}
+	return allowed, scanner.Err()
+}
+
+// verifyImage check the new image of update before it is deployed
+func (w *NodeWatcher) verifyImage(update ImageUpdate) error {
+	if w.Verifier == nil {
+		return nil
+	}
+	image, _, err := w.DockerClient.ImageInspectWithRaw(w.BackgroundContex, update.NewID)
+	if err != nil {
+		return ErrCombind(ErrorImageUnverified, err)
+	}
+	labels := map[string]string{}
+	if image.Config != nil {
+		labels = image.Config.Labels
+	}
+	if err := w.Verifier.Verify(w.BackgroundContex, update.NewDigest, labels); err != nil {
+		return ErrCombind(ErrorImageUnverified, err)
+	}
+	log.Info("image:", update.NewID, " ", update.NewDigest, " is verified")
+	return nil
+}
+
+// verifiedReference return the reference pinning the new image of update, name@digest or the image ID
+// when it has no registry digest, empty when update has no new image
+func (w *NodeWatcher) verifiedReference(update ImageUpdate) string {
+	if len(update.NewDigest) == 0 {
+		return update.NewID
+	}
+	name := w.image()
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	return name + "@" + update.NewDigest
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const mockRevisionLabel = "org.opencontainers.image.revision"
+
+// writeSigningKey write public key of a new ECDSA key in dir and return the key
+func writeSigningKey(t *testing.T, dir string) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "cosign.pub")
+	assert.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+	return key, path
+}
+
+// signDigest write base64 signature of digest into signatures dir
+func signDigest(t *testing.T, key *ecdsa.PrivateKey, dir, digest string) {
+	hash := sha256.Sum256([]byte(digest))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	assert.NoError(t, err)
+	signature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	assert.NoError(t, err)
+	name := strings.Replace(digest, ":", "-", 1) + signatureSuffix
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(base64.StdEncoding.EncodeToString(signature)), 0600))
+}
+
+func TestImageVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir(mockData.BaseDir, "verify")
+	assert.NoError(t, err)
+	allowlist := filepath.Join(dir, "allowlist")
+	assert.NoError(t, ioutil.WriteFile(allowlist, []byte("# released images\n"+mockOldDigest+" # v1.4.1\n"), 0600))
+	key, publicKey := writeSigningKey(t, dir)
+	signatures := filepath.Join(dir, "signatures")
+	assert.NoError(t, os.MkdirAll(signatures, 0700))
+	signDigest(t, key, signatures, mockNewDigest)
+	labels := map[string]string{mockRevisionLabel: "abc123"}
+
+	verifier, err := NewImageVerifier(VerifyConfig{Allowlist: allowlist, PublicKey: publicKey, Signatures: signatures,
+		RequiredLabels: []string{mockRevisionLabel}})
+	assert.NoError(t, err)
+	assert.NoError(t, verifier.Verify(context.Background(), mockOldDigest, labels), "digest is in allowlist")
+	assert.NoError(t, verifier.Verify(context.Background(), mockNewDigest, labels), "digest is signed")
+	err = verifier.Verify(context.Background(), mockVersionDigest(1), labels)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not in allowlist")
+	assert.Error(t, verifier.Verify(context.Background(), "", labels))
+	err = verifier.Verify(context.Background(), mockOldDigest, map[string]string{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), mockRevisionLabel)
+
+	// allowlist is read again on every check
+	assert.NoError(t, ioutil.WriteFile(allowlist, []byte(mockVersionDigest(1)+"\n"), 0600))
+	assert.NoError(t, verifier.Verify(context.Background(), mockVersionDigest(1), labels))
+
+	// signature of another key is rejected
+	other, _ := writeSigningKey(t, mockData.BaseDir)
+	signDigest(t, other, signatures, mockVersionDigest(2))
+	assert.Error(t, verifier.Verify(context.Background(), mockVersionDigest(2), labels))
+
+	server := httptest.NewServer(http.StripPrefix("/signatures/", http.FileServer(http.Dir(signatures))))
+	defer server.Close()
+	remote, err := NewImageVerifier(VerifyConfig{PublicKey: publicKey, Signatures: server.URL + "/signatures/"})
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Verify(context.Background(), mockNewDigest, nil), "signature is downloaded")
+	assert.Error(t, remote.Verify(context.Background(), mockOldDigest, nil))
+
+	pinned, err := NewImageVerifier(VerifyConfig{RequiredLabels: []string{mockRevisionLabel + "=abc123"}})
+	assert.NoError(t, err)
+	assert.NoError(t, pinned.Verify(context.Background(), mockOldDigest, labels))
+	assert.Error(t, pinned.Verify(context.Background(), mockOldDigest, map[string]string{mockRevisionLabel: "def456"}))
+
+	none, err := NewImageVerifier(VerifyConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, none)
+	assert.NoError(t, none.Verify(context.Background(), "", nil))
+	for _, config := range []VerifyConfig{{PublicKey: publicKey}, {Signatures: signatures},
+		{PublicKey: allowlist, Signatures: signatures}, {Allowlist: filepath.Join(dir, "missing")}, {RequiredLabels: []string{"=x"}}} {
+		_, err := NewImageVerifier(config)
+		assert.Error(t, err, "%+v", config)
+	}
+}
+
+func TestRefusedUpdate(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	verifier, err := NewImageVerifier(VerifyConfig{RequiredLabels: []string{mockRevisionLabel}})
+	assert.NoError(t, err)
+	watcher.Verifier = verifier
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+
+	exit, err := UpdateOnce(watcher)
+	assert.Equal(t, exitRefused, exit)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ErrorImageUnverified.Error())
+	assert.Equal(t, "image_unverified", errorLabel(err))
+	assert.Equal(t, mockOldImageID, docker.Container(watcher.ContainerName).Image, "node container is kept")
+	assert.NotContains(t, docker.Calls(), "ContainerStop")
+	if history := watcher.status.updates(); assert.Len(t, history, 1) {
+		assert.Equal(t, updateRefused, history[0].Result)
+	}
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+	assert.False(t, update.Updated, "refused image is not retried")
+
+	// a labeled image passes
+	docker.PublishImage(watcher.ImageName, "labeled", mockVersionDigest(1))
+	docker.LabelImage(watcher.ImageName, map[string]string{mockRevisionLabel: "abc123"})
+	exit, err = UpdateOnce(watcher)
+	assert.NoError(t, err)
+	assert.Equal(t, exitUpdated, exit)
+	assert.Equal(t, "labeled", docker.Container(watcher.ContainerName).Image)
+}
+
+func TestVerifiedImageIsDeployed(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	verifier, err := NewImageVerifier(VerifyConfig{RequiredLabels: []string{mockRevisionLabel}})
+	assert.NoError(t, err)
+	watcher.Verifier = verifier
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	docker.LabelImage(watcher.ImageName, map[string]string{mockRevisionLabel: "abc123"})
+	update, err := watcher.checkImage()
+	assert.NoError(t, err)
+
+	// the tag is moved to an image which is never verified
+	docker.AddImage(watcher.ImageName, "moved", mockVersionDigest(1))
+	_, err = runUpdate(watcher, update)
+	assert.NoError(t, err)
+	node := docker.Container(watcher.ContainerName)
+	assert.Equal(t, mockNewImageID, node.Image)
+	assert.Equal(t, watcher.ImageName+"@"+mockNewDigest, node.Config.Image)
+}
@@ -3,20 +3,29 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"io/ioutil"
 	"os"
-	"runtime"
 	"testing"
 	"time"
 
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/api/types"
+	"github.com/google/logger"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+const (
+	mockOldImageID = "sha256:0000000000000000000000000000000000000000000000000000000000000001"
+	mockNewImageID = "sha256:0000000000000000000000000000000000000000000000000000000000000002"
+	mockOldDigest  = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	mockNewDigest  = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
 )
 
 var mockData *MockData
 
 type MockData struct {
-	Watcher NodeWatcher
 	BaseDir string
 	Chain   string
 	SubDir  map[string]string
@@ -24,23 +33,67 @@ type MockData struct {
 }
 
 func TestMain(m *testing.M) {
+	logger.Init("bitmark-node-watcher-test", false, false, ioutil.Discard)
 	mockData = &MockData{}
-	mockData.init()
-	if err := cleanContainers(); err != nil {
+	if err := mockData.init(); err != nil {
 		log.Info("Setup Error:", err)
-		panic("cleanContainer Error")
+		panic("mockData init Error")
 	}
-	os.Exit(m.Run())
+	code := m.Run()
+	os.RemoveAll(mockData.BaseDir)
+	os.Exit(code)
 }
 
 func TestPullImage(t *testing.T) {
-	watcher := mockData.getWatcher()
-	_, err := watcher.pullImage()
+	watcher, docker := mockData.getWatcher(t)
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	update, err := watcher.pullImage()
 	assert.NoError(t, err, ErrorImagePull.Error())
+	assert.True(t, update.Updated)
+	assert.Equal(t, mockOldImageID, update.OldID)
+	assert.Equal(t, mockOldDigest, update.OldDigest)
+	assert.Equal(t, mockNewImageID, update.NewID)
+	assert.Equal(t, mockNewDigest, update.NewDigest)
+}
+
+func TestPullImageNoUpdate(t *testing.T) {
+	watcher, _ := mockData.getWatcher(t)
+	update, err := watcher.pullImage()
+	assert.NoError(t, err, ErrorImagePull.Error())
+	assert.False(t, update.Updated)
+	assert.Equal(t, update.OldDigest, update.NewDigest)
+}
+
+func TestRepoDigest(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	image, _, err := docker.ImageInspectWithRaw(watcher.BackgroundContex, mockOldImageID)
+	assert.NoError(t, err)
+	assert.Equal(t, mockOldDigest, watcher.repoDigest(image))
+
+	// digest of the watched repository is chosen when the image is in several repositories
+	image.RepoDigests = append([]string{"registry.local:5000/bitmark/bitmark-node-test@" + mockNewDigest}, image.RepoDigests...)
+	assert.Equal(t, mockOldDigest, watcher.repoDigest(image))
+	image.RepoDigests = image.RepoDigests[:1]
+	assert.Empty(t, watcher.repoDigest(image), "image of another repository has no digest")
+
+	// the same image published under a new digest is not an update
+	docker.PublishImage(watcher.ImageName, mockOldImageID, mockNewDigest)
+	update, err := watcher.pullImage()
+	assert.NoError(t, err)
+	assert.False(t, update.Updated)
+	assert.Equal(t, mockNewDigest, update.NewDigest)
+}
+
+func TestPullImageStreamError(t *testing.T) {
+	watcher, _ := mockData.getWatcher(t)
+	watcher.Reference, _ = ParseImageReference("bitmark/not-exist")
+	_, err := watcher.pullImage()
+	assert.Error(t, err)
 }
 
 func TestStartContainer(t *testing.T) {
-	watcher := mockData.getWatcher()
+	watcher, docker := mockData.getWatcher(t)
+	watcher.ContainerName = "bitmarkNodeNew"
 	newContainerConfig, err := getDefaultConfig(watcher)
 	assert.NoError(t, err, ErrorConfigCreateNew.Error())
 	newContainer, err := watcher.DockerClient.ContainerCreate(watcher.BackgroundContex, newContainerConfig.Config,
@@ -49,17 +102,20 @@ func TestStartContainer(t *testing.T) {
 
 	err = watcher.startContainer(newContainer.ID)
 	assert.NoError(t, err, ErrorContainerStart.Error())
+	assert.True(t, docker.Container(newContainer.ID).State.Running)
 }
 
 func TestStopContainer(t *testing.T) {
-	watcher := mockData.getWatcher()
+	watcher, docker := mockData.getWatcher(t)
 	containers, _ := watcher.getContainersWithImage()
+	assert.Len(t, containers, 1)
 	err := watcher.stopContainers(containers, 10*time.Second)
 	assert.NoError(t, err, ErrorContainerStop.Error())
+	assert.False(t, docker.Container(watcher.ContainerName).State.Running)
 }
 
 func TestRenameContainer(t *testing.T) {
-	watcher := mockData.getWatcher()
+	watcher, _ := mockData.getWatcher(t)
 	containers, _ := watcher.getContainersWithImage()
 	container := watcher.getNamedContainer(containers)
 	assert.NotNil(t, container, 0, "No container to stop")
@@ -67,28 +123,104 @@ func TestRenameContainer(t *testing.T) {
 	container, err := watcher.getOldContainer()
 	assert.NotNil(t, container, "Rename Container fail")
 	assert.NoError(t, err, "get old container fail")
+}
+
+func TestUpdateContainer(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	oldID := docker.Container(watcher.ContainerName).ID
+	docker.AddContainer(watcher.ContainerName+watcher.Postfix, watcher.ImageName, "exited")
+
+	update, err := watcher.checkImage()
+	assert.NoError(t, err, ErrorImagePull.Error())
+	assert.True(t, update.Updated)
+	update.ResetDB = true // decided by runUpdate
+	_, err = updateContainer(watcher, update)
+	assert.NoError(t, err)
 
+	newContainer := docker.Container(watcher.ContainerName)
+	assert.NotNil(t, newContainer)
+	assert.NotEqual(t, oldID, newContainer.ID)
+	assert.Equal(t, mockNewImageID, newContainer.Image)
+	assert.True(t, newContainer.State.Running)
+	oldContainer := docker.Container(watcher.ContainerName + watcher.Postfix)
+	assert.Equal(t, oldID, oldContainer.ID)
+	assert.False(t, oldContainer.State.Running)
+	mockData.assertDBRenamed(t, watcher, true)
 }
+
+func TestUpdateContainerBrandNew(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	docker.ContainerRemove(context.Background(), watcher.ContainerName, types.ContainerRemoveOptions{Force: true})
+	_, err := updateContainer(watcher, ImageUpdate{})
+	assert.NoError(t, err)
+	assert.True(t, docker.Container(watcher.ContainerName).State.Running)
+}
+
+func TestUpdateContainerFailures(t *testing.T) {
+	injected := errors.New("injected failure")
+	cases := []struct {
+		method      string
+		errContains string
+		nodeExists  bool // a container with node name still exists
+	}{
+		// list and inspect failures are handled as no container, the brand new container conflicts with the name
+		{method: "ContainerList", errContains: "already in use", nodeExists: true},
+		{method: "ContainerInspect", errContains: "already in use", nodeExists: true},
+		{method: "ContainerStop", errContains: injected.Error(), nodeExists: true},
+		{method: "ContainerRename", errContains: injected.Error(), nodeExists: true},
+		{method: "ContainerCreate", errContains: injected.Error(), nodeExists: false},
+		{method: "ContainerStart", errContains: injected.Error(), nodeExists: true},
+	}
+	for _, c := range cases {
+		t.Run(c.method, func(t *testing.T) {
+			watcher, docker := mockData.getWatcher(t)
+			docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+			update, err := watcher.pullImage()
+			assert.NoError(t, err, ErrorImagePull.Error())
+			update.ResetDB = true
+
+			docker.FailOn(c.method, injected)
+			_, err = updateContainer(watcher, update)
+			docker.FailOn(c.method, nil)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), c.errContains)
+			mockData.assertDBRenamed(t, watcher, false)
+			assert.Equal(t, c.nodeExists, docker.Container(watcher.ContainerName) != nil)
+		})
+	}
+}
+
+func TestStartMonitor(t *testing.T) {
+	watcher, docker := mockData.getWatcher(t)
+	docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+	go StartMonitor(watcher)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		// the container is read once the update is recorded, the monitor changes it until then
+		if updates := watcher.status.updates(); len(updates) > 0 {
+			assert.Equal(t, updateSucceeded, updates[0].Result)
+			c := docker.Container(watcher.ContainerName)
+			assert.Equal(t, mockNewImageID, c.Image)
+			assert.True(t, c.State.Running)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("node container is not updated")
+}
+
 func (mock *MockData) init() error {
-	ctx := context.Background()
-	client, err := client.NewEnvClient()
+	baseDir, err := ioutil.TempDir("", "bitmark-node-data-test")
 	if err != nil {
 		return err
 	}
-	mock.Watcher = NodeWatcher{DockerClient: client, BackgroundContex: ctx,
-		Repo:          "docker.io/bitmark/bitmark-node-test",
-		ImageName:     "bitmark/bitmark-node-test",
-		ContainerName: "bitmarkNodeTest",
-		Postfix:       oldCotnainerPostfix}
-	// Create Directory For Test
-	mock.createDir()
-	mock.BaseDir = userHomeDir() + "/bitmark-node-data-test"
+	mock.BaseDir = baseDir
 	mock.Chain = "bitmark"
 	// Create Environment Variable
 	mock.Env = make(map[string]string)
 	mock.Env["PUBLIC_IP"] = "127.0.0.1"
 	mock.Env["NETWORK"] = mock.Chain
-	mock.Env["DOCKER_HOST"] = "unix:///var/run/docker.sock"
 	mock.Env["NODE_IMAGE"] = "bitmark/bitmark-node-test"
 	mock.Env["NODE_NAME"] = "bitmarkNodeTest"
 	mock.Env["USER_NODE_BASE_DIR"] = mock.BaseDir
@@ -103,10 +235,58 @@ func (mock *MockData) init() error {
 	mock.SubDir["dirMainLog"] = "/log"
 	mock.SubDir["dirTestLog"] = "/log-test"
 	// Create sub directory  names
-	return nil
+	return mock.createDir()
 }
-func (mock *MockData) getWatcher() *NodeWatcher {
-	return &mock.Watcher
+
+// getWatcher return a watcher on a fake docker with the node container running the old image
+// and the data root holding databases of both chains
+func (mock *MockData) getWatcher(t *testing.T) (*NodeWatcher, *FakeDocker) {
+	return mock.getNamedWatcher(t, "bitmarkNodeTest")
+}
+
+// getNamedWatcher return watcher of the running container name on its own fake daemon
+func (mock *MockData) getNamedWatcher(t *testing.T, name string) (*NodeWatcher, *FakeDocker) {
+	docker := NewFakeDocker()
+	watcher := NewNodeWatcher(docker, context.Background(), "bitmark/bitmark-node-test", name)
+	watcher.Rollback = RollbackPolicy{}
+	docker.AddImage(watcher.ImageName, mockOldImageID, mockOldDigest)
+	docker.AddContainer(watcher.ContainerName, watcher.ImageName, containerStateRunning)
+
+	dataRoot, err := ioutil.TempDir(mock.BaseDir, "root")
+	assert.NoError(t, err)
+	watcher.DataRoot = dataRoot
+	watcher.Node.BaseDir = mock.BaseDir
+	watcher.Backups.Dir = dataRoot + "/backups"
+	for _, dir := range watcher.dataDirs() {
+		for _, db := range []string{blockLevelDB, indexLevelDB} {
+			assert.NoError(t, os.MkdirAll(dir+"/"+db, 0700))
+			assert.NoError(t, ioutil.WriteFile(dir+"/"+db+"/CURRENT", []byte("MANIFEST-000002\n"), 0600))
+			assert.NoError(t, ioutil.WriteFile(dir+"/"+db+"/000005.ldb", []byte(db), 0600))
+		}
+	}
+	return watcher, docker
+}
+
+// assertDBRenamed check all databases are saved into the latest snapshot and removed, or all in place
+func (mock *MockData) assertDBRenamed(t *testing.T, watcher *NodeWatcher, renamed bool) {
+	snapshots, err := watcher.Backups.List(watcher.ContainerName)
+	assert.NoError(t, err)
+	for _, dir := range watcher.dataDirs() {
+		for _, db := range []string{blockLevelDB, indexLevelDB} {
+			path := dir + "/" + db
+			data, err := ioutil.ReadFile(path + "/000005.ldb")
+			assert.Equal(t, renamed, os.IsNotExist(err), path)
+			if !renamed {
+				assert.Equal(t, db, string(data), path)
+			} else if assert.NotEmpty(t, snapshots) {
+				saved := []string{}
+				for _, db := range snapshots[len(snapshots)-1].DBs {
+					saved = append(saved, db.Path)
+				}
+				assert.Contains(t, saved, path)
+			}
+		}
+	}
 }
 
 func (mock *MockData) getSubDir(sub string) string {
@@ -115,70 +295,62 @@ func (mock *MockData) getSubDir(sub string) string {
 }
 
 func (mock *MockData) createDir() error {
-	// Remove file if exist
-	if _, err := os.Stat(mock.BaseDir); nil == err {
-		os.RemoveAll(mock.BaseDir)
-	}
-	//Create file Dirs
-	if err := os.MkdirAll(mock.getSubDir("dirNodeDB"), 0700); err != nil {
-		return err
-	}
-	if _, err := os.Stat(mock.getSubDir("dirNodeDB")); os.IsNotExist(err) {
-		return err
-	}
-	if err := os.MkdirAll(mock.getSubDir("dirMainDB"), 0700); err != nil {
-		return err
-	}
-	if _, err := os.Stat(mock.getSubDir("dirMainDB")); os.IsNotExist(err) {
-		return err
-	}
-	if err := os.MkdirAll(mock.getSubDir("dirTestDB"), 0700); err != nil {
-		return err
-	}
-	if _, err := os.Stat(mock.getSubDir("dirTestDB")); os.IsNotExist(err) {
-		return err
-	}
-	if err := os.MkdirAll(mock.getSubDir("dirMainLog"), 0700); err != nil {
-		return err
-	}
-	if _, err := os.Stat(mock.getSubDir("dirMainLog")); os.IsNotExist(err) {
-		return err
-	}
-	if err := os.MkdirAll(mock.getSubDir("dirTestLog"), 0700); err != nil {
-		return err
-	}
-	if _, err := os.Stat(mock.getSubDir("dirTestLog")); os.IsNotExist(err) {
-		return err
+	for _, sub := range []string{"dirNodeDB", "dirMainDB", "dirTestDB", "dirMainLog", "dirTestLog"} {
+		if err := os.MkdirAll(mock.getSubDir(sub), 0700); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// Utilies
-func cleanContainers() error {
-	// Clean Container
-	watcher := mockData.getWatcher()
-	containers, err := watcher.getContainersWithImage()
-	if err != nil {
-		return err
+func TestUpdateOnce(t *testing.T) {
+	injected := errors.New("injected failure")
+	cases := []struct {
+		name    string
+		publish bool
+		fail    string
+		exit    int
+	}{
+		{name: "no update", exit: exitNoUpdate},
+		{name: "check failed", fail: "ImagePull", exit: exitCheckFailed},
+		{name: "updated", publish: true, exit: exitUpdated},
+		{name: "rolled back", publish: true, fail: "ContainerCreate", exit: exitRolledBack},
+		{name: "not recovered", publish: true, fail: "ContainerStart", exit: exitNotRecovered},
 	}
-	for _, container := range containers {
-		log.Infof("Container ID:%s is going to be removed", container.ID)
-		watcher.forceRemoveContainer(container.ID)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			watcher, docker := mockData.getWatcher(t)
+			if c.publish {
+				docker.PublishImage(watcher.ImageName, mockNewImageID, mockNewDigest)
+			}
+			if len(c.fail) > 0 {
+				docker.FailOn(c.fail, injected)
+			}
+			exit, err := UpdateOnce(watcher)
+			assert.Equal(t, c.exit, exit)
+			assert.Equal(t, c.exit != exitNoUpdate && c.exit != exitUpdated, err != nil)
+			if c.publish {
+				if history := watcher.status.updates(); assert.Len(t, history, 1) {
+					assert.Equal(t, triggerOnce, history[0].Trigger)
+				}
+			}
+		})
 	}
-	containers, err = watcher.getContainersWithImage()
-	if len(containers) > 0 {
-		return errors.New("clean container error")
-	}
-	return nil
+	assert.Equal(t, exitCheckFailed, worseExit(exitUpdated, exitCheckFailed))
+	assert.Equal(t, exitRolledBack, worseExit(exitRolledBack, exitCheckFailed))
+	assert.Equal(t, exitUpdated, worseExit(exitNoUpdate, exitUpdated))
 }
 
-func userHomeDir() string {
-	if runtime.GOOS == "windows" {
-		home := os.Getenv("HOMEDRIVE") + os.Getenv("HOMEPATH")
-		if home == "" {
-			home = os.Getenv("USERPROFILE")
+func TestUpdateOnceInvalidFlags(t *testing.T) {
+	for _, args := range [][]string{{"--once", "--db-reset", "sometimes"}, {"--db-reset", dbResetNever}} {
+		set := flag.NewFlagSet("update", flag.ContinueOnError)
+		set.Bool("once", false, "")
+		set.String("db-reset", "", "")
+		assert.NoError(t, set.Parse(args))
+		err := updateAction(cli.NewContext(cli.NewApp(), set, nil))
+		if exitErr, ok := err.(cli.ExitCoder); assert.True(t, ok, "%v", args) {
+			assert.Equal(t, exitInvalid, exitErr.ExitCode(), "misuse is not a failed image check")
 		}
-		return home
 	}
-	return os.Getenv("HOME")
+	assert.NotEqual(t, exitInvalid, exitCheckFailed)
 }